@@ -104,7 +104,7 @@ func setGenesis(ctx *cli.Context, cfg *config.GenesisConfig) error {
 			cfg.DBFT.GenBlockTime = config.DEFAULT_GEN_BLOCK_TIME
 		}
 	case config.CONSENSUS_TYPE_VBFT:
-		err = governance.CheckVBFTConfig(cfg.VBFT)
+		err = governance.CheckVBFTConfig(cfg.VBFT, 0)
 		if err != nil {
 			return fmt.Errorf("VBFT config error %v", err)
 		}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"math"
+	"math/big"
 	"sort"
 	"strings"
 	"time"
@@ -92,6 +93,24 @@ func genConsensusPayload(cfg *config.VBFTConfig, txhash common.Uint256, height u
 	return json.Marshal(vbftBlockInfo)
 }
 
+// CalcPeerRank returns ceil(stake * scale * k / sum).
+// big.Int is used instead of float64 so the result is exact and identical on
+// every platform; the pos table must never depend on float rounding.
+func CalcPeerRank(stake, scale, k, sum uint64) uint64 {
+	if sum == 0 {
+		return 0
+	}
+	num := new(big.Int).SetUint64(stake)
+	num.Mul(num, new(big.Int).SetUint64(scale))
+	num.Mul(num, new(big.Int).SetUint64(k))
+	den := new(big.Int).SetUint64(sum)
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() != 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	return q.Uint64()
+}
+
 //GenesisChainConfig return chainconfig
 func GenesisChainConfig(config *config.VBFTConfig, peersinfo []*config.VBFTPeerStakeInfo, txhash common.Uint256, height uint32) (*ChainConfig, error) {
 
@@ -124,7 +143,7 @@ func GenesisChainConfig(config *config.VBFTConfig, peersinfo []*config.VBFTPeerS
 	for i := 0; i < int(config.K); i++ {
 		var s uint64 = 1
 		if sum > 0 && peers[i].InitPos > 0 {
-			s = uint64(math.Ceil(float64(peers[i].InitPos) * float64(scale) * float64(config.K) / float64(sum)))
+			s = CalcPeerRank(peers[i].InitPos, uint64(scale), uint64(config.K), sum)
 		}
 		peerRanks = append(peerRanks, s)
 	}
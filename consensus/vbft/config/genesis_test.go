@@ -19,6 +19,7 @@
 package vconfig
 
 import (
+	"math"
 	"testing"
 
 	"github.com/ontio/ontology/common"
@@ -109,3 +110,50 @@ func TestGenesisChainConfig(t *testing.T) {
 	}
 	t.Logf("TestGenesisChainConfig succ: %v", chainconfig.PosTable)
 }
+
+func TestCalcPeerRank(t *testing.T) {
+	vectors := []struct {
+		stake, scale, k, sum uint64
+		rank                 uint64
+	}{
+		{0, 1, 7, 100, 0},
+		{10, 1, 7, 70, 1},
+		{11, 1, 7, 70, 2},
+		{100, 3, 7, 700, 3},
+		{100, 3, 7, 701, 3},
+		{1, 1, 7, 0, 0},
+		{math.MaxUint64, math.MaxUint32, math.MaxUint32, math.MaxUint64, math.MaxUint32 * math.MaxUint32},
+		// float64 loses precision here and rounds the quotient up past 1
+		{36028797018963973, 1, 7, 252201579132747814, 1},
+	}
+	for _, v := range vectors {
+		if r := CalcPeerRank(v.stake, v.scale, v.k, v.sum); r != v.rank {
+			t.Errorf("CalcPeerRank(%d, %d, %d, %d) = %d, expected %d", v.stake, v.scale, v.k, v.sum, r, v.rank)
+		}
+	}
+}
+
+func TestCalcPeerRankMatchesFloat(t *testing.T) {
+	distributions := [][]uint64{
+		{10000, 10000, 10000, 10000, 10000, 10000, 10000},
+		{10000, 20000, 30000, 40000, 50000, 60000, 70000},
+		{1, 1, 1, 1, 1, 1, 1000000},
+		{1000000000, 999999999, 123456789, 87654321, 5000, 1, 1},
+		{3, 5, 7, 11, 13, 17, 19},
+	}
+	for _, stakes := range distributions {
+		var sum uint64
+		for _, s := range stakes {
+			sum += s
+		}
+		k := uint64(len(stakes))
+		for _, scale := range []uint64{1, 2, 3, 7} {
+			for _, s := range stakes {
+				expected := uint64(math.Ceil(float64(s) * float64(scale) * float64(k) / float64(sum)))
+				if r := CalcPeerRank(s, scale, k, sum); r != expected {
+					t.Errorf("stake %d, scale %d, k %d, sum %d: integer rank %d, float rank %d", s, scale, k, sum, r, expected)
+				}
+			}
+		}
+	}
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/ontio/ontology/core/ledger"
 	"github.com/ontio/ontology/core/signature"
 	"github.com/ontio/ontology/core/states"
+	scommon "github.com/ontio/ontology/core/store/common"
 	gov "github.com/ontio/ontology/smartcontract/service/native/governance"
 	nutils "github.com/ontio/ontology/smartcontract/service/native/utils"
 )
@@ -126,16 +127,7 @@ func verifyVrf(pk keypair.PublicKey, blkNum uint32, prevVrf, newVrf, proof []byt
 	return nil
 }
 func GetVbftConfigInfo() (*config.VBFTConfig, error) {
-	storageKey := &states.StorageKey{
-		ContractAddress: nutils.GovernanceContractAddress,
-		Key:             append([]byte(gov.VBFT_CONFIG)),
-	}
-	data, err := ledger.DefLedger.GetStorageItem(storageKey.ContractAddress, storageKey.Key)
-	if err != nil {
-		return nil, err
-	}
-	cfg := new(gov.Configuration)
-	err = cfg.Deserialize(bytes.NewBuffer(data))
+	cfg, err := getGovConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -152,44 +144,115 @@ func GetVbftConfigInfo() (*config.VBFTConfig, error) {
 	return chainconfig, nil
 }
 
-func GetPeersConfig() ([]*config.VBFTPeerStakeInfo, error) {
-	goveranceview, err := GetGovernanceView()
+func getGovConfig() (*gov.Configuration, error) {
+	storageKey := &states.StorageKey{
+		ContractAddress: nutils.GovernanceContractAddress,
+		Key:             append([]byte(gov.VBFT_CONFIG)),
+	}
+	data, err := ledger.DefLedger.GetStorageItem(storageKey.ContractAddress, storageKey.Key)
 	if err != nil {
 		return nil, err
 	}
-	viewBytes, err := gov.GetUint32Bytes(goveranceview.View)
+	cfg := new(gov.Configuration)
+	err = cfg.Deserialize(bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
-	storageKey := &states.StorageKey{
-		ContractAddress: nutils.GovernanceContractAddress,
-		Key:             append([]byte(gov.PEER_POOL), viewBytes...),
+	return cfg, nil
+}
+
+func GetPeersConfig() ([]*config.VBFTPeerStakeInfo, error) {
+	peers, err := getPeerStakes(ledger.DefLedger.GetCurrentBlockHeight())
+	if err != nil {
+		return nil, err
 	}
-	data, err := ledger.DefLedger.GetStorageItem(storageKey.ContractAddress, storageKey.Key)
+	var peerstakes []*config.VBFTPeerStakeInfo
+	for _, peer := range peers {
+		peerstakes = append(peerstakes, &config.VBFTPeerStakeInfo{
+			Index:      peer.Index,
+			PeerPubkey: peer.PeerPubkey,
+			InitPos:    peer.Stake,
+		})
+	}
+	return peerstakes, nil
+}
+
+// getPeerStakes returns the candidate and consensus peers of the current view
+// with the stake governance ranks them by at height
+func getPeerStakes(height uint32) ([]*gov.PeerStakeInfo, error) {
+	goveranceview, err := GetGovernanceView()
 	if err != nil {
 		return nil, err
 	}
-	peerMap := &gov.PeerPoolMap{
-		PeerPoolMap: make(map[string]*gov.PeerPoolItem),
+	viewBytes, err := gov.GetUint32Bytes(goveranceview.View)
+	if err != nil {
+		return nil, err
 	}
-	err = peerMap.Deserialize(bytes.NewBuffer(data))
+	peerMap, err := getPeerPoolMap(viewBytes)
 	if err != nil {
 		return nil, err
 	}
-	var peerstakes []*config.VBFTPeerStakeInfo
+	var peerstakes []*gov.PeerStakeInfo
 	for _, id := range peerMap.PeerPoolMap {
 		if id.Status == gov.CandidateStatus || id.Status == gov.ConsensusStatus {
-			config := &config.VBFTPeerStakeInfo{
+			stake, err := gov.PeerStake(id, height)
+			if err != nil {
+				return nil, err
+			}
+			peerstakes = append(peerstakes, &gov.PeerStakeInfo{
 				Index:      uint32(id.Index),
 				PeerPubkey: id.PeerPubkey,
-				InitPos:    id.InitPos + id.TotalPos,
-			}
-			peerstakes = append(peerstakes, config)
+				Stake:      stake,
+			})
 		}
 	}
 	return peerstakes, nil
 }
 
+// getPeerPoolMap reads the peer pool of a view, stored either as one
+// PeerPoolMap blob or, once migrated, per item with an index list
+func getPeerPoolMap(viewBytes []byte) (*gov.PeerPoolMap, error) {
+	contract := nutils.GovernanceContractAddress
+	peerMap := &gov.PeerPoolMap{
+		PeerPoolMap: make(map[string]*gov.PeerPoolItem),
+	}
+	data, err := ledger.DefLedger.GetStorageItem(contract, append([]byte(gov.PEER_POOL), viewBytes...))
+	if err == nil {
+		if err := peerMap.Deserialize(bytes.NewBuffer(data)); err != nil {
+			return nil, err
+		}
+		return peerMap, nil
+	}
+	if err != scommon.ErrNotFound {
+		return nil, err
+	}
+	data, err = ledger.DefLedger.GetStorageItem(contract, append([]byte(gov.PEER_POOL_INDEX), viewBytes...))
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := gov.DecodePeerPoolIndexes(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		indexBytes, err := gov.GetUint32Bytes(index)
+		if err != nil {
+			return nil, err
+		}
+		key := append(append([]byte(gov.PEER_POOL), viewBytes...), indexBytes...)
+		data, err := ledger.DefLedger.GetStorageItem(contract, key)
+		if err != nil {
+			return nil, err
+		}
+		item := new(gov.PeerPoolItem)
+		if err := item.Deserialize(bytes.NewBuffer(data)); err != nil {
+			return nil, err
+		}
+		peerMap.PeerPoolMap[item.PeerPubkey] = item
+	}
+	return peerMap, nil
+}
+
 func isUpdate(view uint32) (bool, error) {
 	goveranceview, err := GetGovernanceView()
 	if err != nil {
@@ -219,12 +282,12 @@ func GetGovernanceView() (*gov.GovernanceView, error) {
 }
 
 func getChainConfig(blkNum uint32) (*vconfig.ChainConfig, error) {
-	config, err := GetVbftConfigInfo()
+	config, err := getGovConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get chainconfig from leveldb: %s", err)
 	}
 
-	peersinfo, err := GetPeersConfig()
+	peersinfo, err := getPeerStakes(blkNum)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get peersinfo from leveldb: %s", err)
 	}
@@ -233,9 +296,9 @@ func getChainConfig(blkNum uint32) (*vconfig.ChainConfig, error) {
 		return nil, fmt.Errorf("failed to get governanceview failed:%s", err)
 	}
 
-	cfg, err := vconfig.GenesisChainConfig(config, peersinfo, goverview.TxHash, blkNum)
+	cfg, err := gov.CalChainConfig(goverview.TxHash, blkNum, config, peersinfo)
 	if err != nil {
-		return nil, fmt.Errorf("GenesisChainConfig failed: %s", err)
+		return nil, fmt.Errorf("CalChainConfig failed: %s", err)
 	}
 	cfg.View = goverview.View
 	return cfg, err
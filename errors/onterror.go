@@ -37,6 +37,12 @@ func (e ontError) GetRoot() error {
 	return e.root
 }
 
+// Unwrap returns the root error, so that the standard errors.Is and errors.As
+// see through detail errors
+func (e ontError) Unwrap() error {
+	return e.root
+}
+
 func (e ontError) GetCallStack() *CallStack {
 	return e.callstack
 }
@@ -0,0 +1,48 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*
+ * Copyright (C) 2018 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package governance
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// Fuzz is the go-fuzz entry point for PeerPoolMap deserialization. Any blob
+// that decodes must encode again and decode back to the same map.
+func Fuzz(data []byte) int {
+	peerPoolMap := new(PeerPoolMap)
+	if err := peerPoolMap.Deserialize(bytes.NewBuffer(data)); err != nil {
+		return 0
+	}
+	buf := new(bytes.Buffer)
+	if err := peerPoolMap.Serialize(buf); err != nil {
+		panic(err)
+	}
+	decoded := new(PeerPoolMap)
+	if err := decoded.Deserialize(buf); err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(decoded, peerPoolMap) {
+		panic("PeerPoolMap round trip mismatch")
+	}
+	return 1
+}
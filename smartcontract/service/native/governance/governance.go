@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"math"
 
+	"github.com/ontio/ontology-crypto/keypair"
 	"github.com/ontio/ontology/common"
 	"github.com/ontio/ontology/common/config"
 	"github.com/ontio/ontology/common/constants"
@@ -69,26 +70,158 @@ const (
 	TRANSFER_PENALTY                 = "transferPenalty"
 	WITHDRAW_ONG                     = "withdrawOng"
 
+	//event name
+	VIEW_CHANGE_EVENT = "viewChange"
+
 	//key prefix
-	GLOBAL_PARAM    = "globalParam"
-	VBFT_CONFIG     = "vbftConfig"
-	GOVERNANCE_VIEW = "governanceView"
-	CANDIDITE_INDEX = "candidateIndex"
-	PEER_POOL       = "peerPool"
-	VOTE_INFO_POOL  = "voteInfoPool"
-	PEER_INDEX      = "peerIndex"
-	BLACK_LIST      = "blackList"
-	TOTAL_STAKE     = "totalStake"
-	PENALTY_STAKE   = "penaltyStake"
-	SPLIT_CURVE     = "splitCurve"
+	GLOBAL_PARAM         = "globalParam"
+	GLOBAL_PARAM2        = "globalParam2"
+	GLOBAL_PARAM_HISTORY = "globalParamHistory"
+	VBFT_CONFIG          = "vbftConfig"
+	GOVERNANCE_VIEW      = "governanceView"
+	CANDIDITE_INDEX      = "candidateIndex"
+	PEER_POOL            = "peerPool"
+	PEER_POOL_INDEX      = "peerPoolIndex"
+	VOTE_INFO_POOL       = "voteInfoPool"
+	PEER_INDEX           = "peerIndex"
+	BLACK_LIST           = "blackList"
+	TOTAL_STAKE          = "totalStake"
+	PENALTY_STAKE        = "penaltyStake"
+	SLASH_COUNT          = "slashCount"
+	LOCKUP               = "lockup"
+	SPLIT_CURVE          = "splitCurve"
+	SPLIT_CURVE_XI       = "splitCurveXi"
+	SPLIT_FEE            = "splitFee"
+	SPLIT_FEE_REMAINDER  = "splitFeeRemainder"
+	POS_TABLE            = "posTable"
 
 	//global
 	PRECISE = 1000000
 )
 
+// SHA256_SHUFFLE_HEIGHT is the first block height whose pos table is shuffled
+// with shufflehashV2 (sha256). Tables of lower heights keep using the legacy
+// fnv64a shufflehash so old blocks still replay.
+// It stays at math.MaxUint32, i.e. disabled, until a fork height is scheduled.
+var SHA256_SHUFFLE_HEIGHT uint32 = math.MaxUint32
+
+// BINARY_SHUFFLE_HEIGHT is the first block height whose shuffle hash input is
+// serialized with common/serialization instead of encoding/json.
+// Disabled until a fork height is scheduled.
+var BINARY_SHUFFLE_HEIGHT uint32 = math.MaxUint32
+
+// UNBIASED_SHUFFLE_HEIGHT is the first block height whose pos table shuffle
+// draws j from [0, i] as Fisher-Yates requires. Lower heights keep the legacy
+// [0, i-1] range, which never leaves an element in place.
+// Disabled until a fork height is scheduled.
+var UNBIASED_SHUFFLE_HEIGHT uint32 = math.MaxUint32
+
+// PEER_PUBKEY_CURVE is the curve every peer pubkey must be on, it matches the
+// chain's default signature scheme (ECDSA over P-256).
+const PEER_PUBKEY_CURVE = keypair.P256
+
+// Bounds of a peer pubkey in hex characters: a compressed P-256 point is 33
+// bytes, an uncompressed one with the key type and curve label in front 67.
+const (
+	MIN_PEER_PUBKEY_LEN = 2 * 33
+	MAX_PEER_PUBKEY_LEN = 2 * 67
+)
+
+// RemainderPolicy decides what executeSplit does with the ong left over by
+// integer truncation when a pool is divided among peers
+type RemainderPolicy uint8
+
+const (
+	// the remainder stays in the governance contract
+	SplitRemainderKeep RemainderPolicy = iota
+	// the remainder of each pool is paid to the peer with the largest stake
+	SplitRemainderToTopPeer
+	// the remainder is recorded under SPLIT_FEE_REMAINDER and added to the
+	// consensus pool of the next split
+	SplitRemainderCarry
+)
+
+// SPLIT_REMAINDER_POLICY is the remainder policy of executeSplit
+var SPLIT_REMAINDER_POLICY = SplitRemainderKeep
+
+// SPLIT_PAYOUT_HEIGHT is the first block height whose fee split divides the
+// pools exactly with splitAmounts and applies SPLIT_REMAINDER_POLICY. Lower
+// heights keep the legacy balance*A/100*S/sumS payouts, which wrap on large
+// balances. Disabled until a fork height is scheduled.
+var SPLIT_PAYOUT_HEIGHT uint32 = math.MaxUint32
+
+// PEER_POOL_VIEW_HEIGHT is the first block height which stores PeerPoolMap
+// in version 1, which records its view so a map read under the wrong view key
+// is detected. Disabled until a fork height is scheduled.
+var PEER_POOL_VIEW_HEIGHT uint32 = math.MaxUint32
+
+// GLOBAL_PARAM_HISTORY_HEIGHT is the first block height from which every
+// global param update is also recorded in a change log keyed by height, see
+// GetGlobalParamAtHeight. Disabled until a fork height is scheduled.
+var GLOBAL_PARAM_HISTORY_HEIGHT uint32 = math.MaxUint32
+
+// INDEX_TIE_BREAK_HEIGHT is the first block height whose commitDpos, split
+// and pos table break stake ties by Index ascending, before it ties fall to
+// the larger PeerPubkey. Disabled until a fork height is scheduled.
+var INDEX_TIE_BREAK_HEIGHT uint32 = math.MaxUint32
+
+// POS_TABLE_CHECK_HEIGHT is the first block height whose pos table rejects a
+// top K stake sum which overflows or is 0. Lower heights build the table as
+// GenesisChainConfig does. Disabled until a fork height is scheduled.
+var POS_TABLE_CHECK_HEIGHT uint32 = math.MaxUint32
+
+// CONFIG_CHECK_HEIGHT is the first block height whose initConfig and
+// updateConfig require K >= 3*C+1 and check the configuration they write
+// with Configuration.Validate. Disabled until a fork height is scheduled.
+var CONFIG_CHECK_HEIGHT uint32 = math.MaxUint32
+
+// POS_TABLE_HEIGHT is the first block height whose commitDpos stores the pos
+// table of the new view, see GetPosTable. Disabled until a fork height is
+// scheduled.
+var POS_TABLE_HEIGHT uint32 = math.MaxUint32
+
+// MAX_CANDIDATE_NUM_HEIGHT is the first block height whose commitDpos builds
+// the pos table of the new view only for at most GlobalParam2.MaxCandidateNum
+// candidate and consensus peers. Disabled until a fork height is scheduled.
+var MAX_CANDIDATE_NUM_HEIGHT uint32 = math.MaxUint32
+
+// PEER_PUBKEY_CHECK_HEIGHT is the first block height whose registerCandidate
+// and initConfig only accept ECDSA peer pubkeys on PEER_PUBKEY_CURVE whose
+// encoding is within [MIN_PEER_PUBKEY_LEN, MAX_PEER_PUBKEY_LEN], lower heights
+// accept any VRF-capable key. Disabled until a fork height is scheduled.
+var PEER_PUBKEY_CHECK_HEIGHT uint32 = math.MaxUint32
+
+// SPLIT_FEE_HEIGHT is the first block height whose registerCandidate adds the
+// collected CandidateFee to the split fee recorded under SPLIT_FEE. Disabled
+// until a fork height is scheduled.
+var SPLIT_FEE_HEIGHT uint32 = math.MaxUint32
+
+// UNIQUE_PEER_INDEX_HEIGHT is the first block height whose approveCandidate
+// rejects an Index another peer already holds and whose pos table rejects
+// peers sharing an Index. Disabled until a fork height is scheduled.
+var UNIQUE_PEER_INDEX_HEIGHT uint32 = math.MaxUint32
+
+// VIEW_CHANGE_EVENT_HEIGHT is the first block height whose commitDpos
+// notifies VIEW_CHANGE_EVENT, so replayed blocks keep their original
+// notifications. Disabled until a fork height is scheduled.
+var VIEW_CHANGE_EVENT_HEIGHT uint32 = math.MaxUint32
+
+// STAKE_OVERFLOW_HEIGHT is the first block height whose voteForPeer rejects a
+// vote which overflows the TotalPos of a peer and whose commitDpos rejects a
+// peer with InitPos+TotalPos overflowing, lower heights let them wrap.
+// Disabled until a fork height is scheduled.
+var STAKE_OVERFLOW_HEIGHT uint32 = math.MaxUint32
+
+// DUPLICATE_PEER_HEIGHT is the first block height whose registerCandidate
+// rejects a peer pubkey which only differs from a registered one in encoding,
+// see FindDuplicatePeer. Lower heights only reject the exact same pubkey
+// string. Disabled until a fork height is scheduled.
+var DUPLICATE_PEER_HEIGHT uint32 = math.MaxUint32
+
 // candidate fee must >= 1 ONG
 var MinCandidateFee = uint64(math.Pow(10, constants.ONG_DECIMALS))
 
+// Xi and Yi are the points of the default split curve
 var Xi = []uint32{
 	0, 100000, 200000, 300000, 400000, 500000, 600000, 700000, 800000, 900000, 1000000, 1100000, 1200000, 1300000, 1400000,
 	1500000, 1600000, 1700000, 1800000, 1900000, 2000000, 2100000, 2200000, 2300000, 2400000, 2500000, 2600000, 2700000,
@@ -100,32 +233,42 @@ var Xi = []uint32{
 	9300000, 9400000, 9500000, 9600000, 9700000, 9800000, 9900000, 10000000,
 }
 
+var Yi = []uint32{
+	0, 95123, 180968, 258213, 327493, 389401, 444491, 493282, 536257, 573866, 606531, 634645, 658574, 678660, 695220, 708550,
+	718927, 726606, 731826, 734808, 735759, 734870, 732317, 728265, 722867, 716262, 708583, 699949, 690472, 680254, 669391,
+	657969, 646069, 633765, 621124, 608209, 595076, 581778, 568361, 554869, 541342, 527814, 514317, 500882, 487534, 474297,
+	461191, 448236, 435447, 422839, 410425, 398217, 386223, 374452, 362910, 351604, 340537, 329713, 319135, 308805, 298723,
+	288890, 279306, 269969, 260879, 252033, 243429, 235066, 226939, 219045, 211382, 203945, 196731, 189736, 182955, 176384,
+	170018, 163854, 157887, 152113, 146526, 141122, 135896, 130845, 125963, 121246, 116690, 112290, 108041, 103940, 99981,
+	96162, 92477, 88923, 85496, 82192, 79006, 75936, 72977, 70126, 67380,
+}
+
 func InitGovernance() {
 	native.Contracts[utils.GovernanceContractAddress] = RegisterGovernanceContract
 }
 
 func RegisterGovernanceContract(native *native.NativeService) {
-	native.Register(REGISTER_CANDIDATE, RegisterCandidate)
-	native.Register(REGISTER_CANDIDATE_TRANSFER_FROM, RegisterCandidateTransferFrom)
-	native.Register(UNREGISTER_CANDIDATE, UnRegisterCandidate)
-	native.Register(VOTE_FOR_PEER, VoteForPeer)
-	native.Register(VOTE_FOR_PEER_TRANSFER_FROM, VoteForPeerTransferFrom)
-	native.Register(UNVOTE_FOR_PEER, UnVoteForPeer)
-	native.Register(WITHDRAW, Withdraw)
-	native.Register(QUIT_NODE, QuitNode)
-	native.Register(WITHDRAW_ONG, WithdrawOng)
-
-	native.Register(INIT_CONFIG, InitConfig)
-	native.Register(APPROVE_CANDIDATE, ApproveCandidate)
-	native.Register(REJECT_CANDIDATE, RejectCandidate)
-	native.Register(BLACK_NODE, BlackNode)
-	native.Register(WHITE_NODE, WhiteNode)
-	native.Register(COMMIT_DPOS, CommitDpos)
-	native.Register(UPDATE_CONFIG, UpdateConfig)
-	native.Register(UPDATE_GLOBAL_PARAM, UpdateGlobalParam)
-	native.Register(UPDATE_SPLIT_CURVE, UpdateSplitCurve)
-	native.Register(CALL_SPLIT, CallSplit)
-	native.Register(TRANSFER_PENALTY, TransferPenalty)
+	native.Register(REGISTER_CANDIDATE, withExecutionCache(RegisterCandidate))
+	native.Register(REGISTER_CANDIDATE_TRANSFER_FROM, withExecutionCache(RegisterCandidateTransferFrom))
+	native.Register(UNREGISTER_CANDIDATE, withExecutionCache(UnRegisterCandidate))
+	native.Register(VOTE_FOR_PEER, withExecutionCache(VoteForPeer))
+	native.Register(VOTE_FOR_PEER_TRANSFER_FROM, withExecutionCache(VoteForPeerTransferFrom))
+	native.Register(UNVOTE_FOR_PEER, withExecutionCache(UnVoteForPeer))
+	native.Register(WITHDRAW, withExecutionCache(Withdraw))
+	native.Register(QUIT_NODE, withExecutionCache(QuitNode))
+	native.Register(WITHDRAW_ONG, withExecutionCache(WithdrawOng))
+
+	native.Register(INIT_CONFIG, withExecutionCache(InitConfig))
+	native.Register(APPROVE_CANDIDATE, withExecutionCache(ApproveCandidate))
+	native.Register(REJECT_CANDIDATE, withExecutionCache(RejectCandidate))
+	native.Register(BLACK_NODE, withExecutionCache(BlackNode))
+	native.Register(WHITE_NODE, withExecutionCache(WhiteNode))
+	native.Register(COMMIT_DPOS, withExecutionCache(CommitDpos))
+	native.Register(UPDATE_CONFIG, withExecutionCache(UpdateConfig))
+	native.Register(UPDATE_GLOBAL_PARAM, withExecutionCache(UpdateGlobalParam))
+	native.Register(UPDATE_SPLIT_CURVE, withExecutionCache(UpdateSplitCurve))
+	native.Register(CALL_SPLIT, withExecutionCache(CallSplit))
+	native.Register(TRANSFER_PENALTY, withExecutionCache(TransferPenalty))
 }
 
 func InitConfig(native *native.NativeService) ([]byte, error) {
@@ -140,7 +283,7 @@ func InitConfig(native *native.NativeService) ([]byte, error) {
 	contract := native.ContextRef.CurrentContext().ContractAddress
 
 	// check if initConfig is already execute
-	governanceViewBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GOVERNANCE_VIEW)))
+	governanceViewBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, governanceViewKey(contract))
 	if err != nil {
 		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getGovernanceView, get governanceViewBytes error!")
 	}
@@ -149,7 +292,7 @@ func InitConfig(native *native.NativeService) ([]byte, error) {
 	}
 
 	//check the configuration
-	err = CheckVBFTConfig(configuration)
+	err = CheckVBFTConfig(configuration, native.Height)
 	if err != nil {
 		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "checkVBFTConfig failed!")
 	}
@@ -185,6 +328,10 @@ func InitConfig(native *native.NativeService) ([]byte, error) {
 			return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "common.AddressFromBase58, address format error!")
 		}
 
+		if _, ok := FindDuplicatePeer(peerPoolMap, peer.PeerPubkey); ok {
+			return utils.BYTE_FALSE, errors.NewErr("initConfig, peerPubkey is duplicated in config!")
+		}
+
 		peerPoolItem := new(PeerPoolItem)
 		peerPoolItem.Index = peer.Index
 		peerPoolItem.PeerPubkey = peer.PeerPubkey
@@ -249,6 +396,11 @@ func InitConfig(native *native.NativeService) ([]byte, error) {
 		PeerHandshakeTimeout: configuration.PeerHandshakeTimeout,
 		MaxBlockChangeView:   configuration.MaxBlockChangeView,
 	}
+	if native.Height >= CONFIG_CHECK_HEIGHT {
+		if err := config.Validate(); err != nil {
+			return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "initConfig, invalid config!")
+		}
+	}
 	err = putConfig(native, contract, config)
 	if err != nil {
 		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "putConfig, put config error!")
@@ -256,15 +408,7 @@ func InitConfig(native *native.NativeService) ([]byte, error) {
 
 	//init splitCurve
 	splitCurve := &SplitCurve{
-		Yi: []uint32{
-			0, 95123, 180968, 258213, 327493, 389401, 444491, 493282, 536257, 573866, 606531, 634645, 658574, 678660, 695220, 708550,
-			718927, 726606, 731826, 734808, 735759, 734870, 732317, 728265, 722867, 716262, 708583, 699949, 690472, 680254, 669391,
-			657969, 646069, 633765, 621124, 608209, 595076, 581778, 568361, 554869, 541342, 527814, 514317, 500882, 487534, 474297,
-			461191, 448236, 435447, 422839, 410425, 398217, 386223, 374452, 362910, 351604, 340537, 329713, 319135, 308805, 298723,
-			288890, 279306, 269969, 260879, 252033, 243429, 235066, 226939, 219045, 211382, 203945, 196731, 189736, 182955, 176384,
-			170018, 163854, 157887, 152113, 146526, 141122, 135896, 130845, 125963, 121246, 116690, 112290, 108041, 103940, 99981,
-			96162, 92477, 88923, 85496, 82192, 79006, 75936, 72977, 70126, 67380,
-		},
+		Yi: Yi,
 	}
 	err = putSplitCurve(native, contract, splitCurve)
 	if err != nil {
@@ -460,6 +604,11 @@ func ApproveCandidate(native *native.NativeService) ([]byte, error) {
 		}
 		native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_INDEX), peerPubkeyPrefix), &cstates.StorageItem{Value: indexBytes})
 	}
+	if native.Height >= UNIQUE_PEER_INDEX_HEIGHT {
+		if err := checkPeerIndexFree(peerPoolMap, peerPoolItem.Index, peerPoolItem.PeerPubkey); err != nil {
+			return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "approveCandidate, peer index is duplicated!")
+		}
+	}
 	peerPoolMap.PeerPoolMap[params.PeerPubkey] = peerPoolItem
 	err = putPeerPoolMap(native, contract, view, peerPoolMap)
 	if err != nil {
@@ -603,9 +752,9 @@ func BlackNode(native *native.NativeService) ([]byte, error) {
 	//commitDpos
 	if commit {
 		// get config
-		config, err := getConfig(native, contract)
+		config, err := GetConfiguration(native, contract)
 		if err != nil {
-			return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfig, get config error!")
+			return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
 		}
 		err = executeCommitDpos(native, contract, config)
 		if err != nil {
@@ -682,9 +831,9 @@ func QuitNode(native *native.NativeService) ([]byte, error) {
 	}
 
 	//get config
-	config, err := getConfig(native, contract)
+	config, err := GetConfiguration(native, contract)
 	if err != nil {
-		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfig, get config error!")
+		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
 	}
 
 	peerPoolItem, ok := peerPoolMap.PeerPoolMap[params.PeerPubkey]
@@ -881,7 +1030,7 @@ func Withdraw(native *native.NativeService) ([]byte, error) {
 	}
 
 	//ont transfer
-	err = appCallTransferOnt(native, utils.GovernanceContractAddress, address, total)
+	err = appCallTransferOnt(native, utils.GovernanceContractAddress, address, OntAmount(total))
 	if err != nil {
 		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, ont transfer error!")
 	}
@@ -899,9 +1048,9 @@ func CommitDpos(native *native.NativeService) ([]byte, error) {
 	contract := native.ContextRef.CurrentContext().ContractAddress
 
 	// get config
-	config, err := getConfig(native, contract)
+	config, err := GetConfiguration(native, contract)
 	if err != nil {
-		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfig, get config error!")
+		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
 	}
 
 	//get governace view
@@ -978,6 +1127,11 @@ func UpdateConfig(native *native.NativeService) ([]byte, error) {
 	}
 
 	//check the configuration
+	if native.Height >= CONFIG_CHECK_HEIGHT {
+		if err := configuration.Validate(); err != nil {
+			return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "updateConfig, invalid config!")
+		}
+	}
 	if configuration.C == 0 {
 		return utils.BYTE_FALSE, errors.NewErr("updateConfig. C can not be 0 in config!")
 	}
@@ -1029,9 +1183,9 @@ func UpdateGlobalParam(native *native.NativeService) ([]byte, error) {
 	contract := native.ContextRef.CurrentContext().ContractAddress
 
 	// get config
-	config, err := getConfig(native, contract)
+	config, err := GetConfiguration(native, contract)
 	if err != nil {
-		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfig, get config error!")
+		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
 	}
 
 	globalParam := new(GlobalParam)
@@ -1186,7 +1340,7 @@ func WithdrawOng(native *native.NativeService) ([]byte, error) {
 	timeOffset := native.Time - constants.GENESIS_BLOCK_TIMESTAMP
 
 	amount := utils.CalcUnbindOng(totalStake.Stake, preTimeOffset, timeOffset)
-	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, totalStake.Address, amount)
+	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, totalStake.Address, OngAmount(amount))
 	if err != nil {
 		return utils.BYTE_FALSE, errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, transfer from ong error!")
 	}
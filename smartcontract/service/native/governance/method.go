@@ -29,6 +29,7 @@ import (
 	scommon "github.com/ontio/ontology/core/store/common"
 	"github.com/ontio/ontology/errors"
 	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/ont"
 	"github.com/ontio/ontology/smartcontract/service/native/utils"
 )
 
@@ -58,7 +59,7 @@ func registerCandidate(native *native.NativeService, flag string) error {
 	}
 
 	//check peerPubkey
-	if err := validatePeerPubKeyFormat(params.PeerPubkey); err != nil {
+	if err := validatePeerPubKeyFormat(params.PeerPubkey, native.Height); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "invalid peer pubkey")
 	}
 
@@ -82,7 +83,12 @@ func registerCandidate(native *native.NativeService, flag string) error {
 	}
 
 	//check if exist in PeerPool
-	_, ok := peerPoolMap.PeerPoolMap[params.PeerPubkey]
+	var ok bool
+	if native.Height < DUPLICATE_PEER_HEIGHT {
+		_, ok = peerPoolMap.PeerPoolMap[params.PeerPubkey]
+	} else {
+		_, ok = FindDuplicatePeer(peerPoolMap, params.PeerPubkey)
+	}
 	if ok {
 		return errors.NewErr("registerCandidate, peerPubkey is already in peerPoolMap!")
 	}
@@ -108,29 +114,35 @@ func registerCandidate(native *native.NativeService, flag string) error {
 	switch flag {
 	case "transfer":
 		//ont transfer
-		err = appCallTransferOnt(native, params.Address, utils.GovernanceContractAddress, uint64(params.InitPos))
+		err = appCallTransferOnt(native, params.Address, utils.GovernanceContractAddress, OntAmount(params.InitPos))
 		if err != nil {
 			return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, ont transfer error!")
 		}
 
 		//ong transfer
-		err = appCallTransferOng(native, params.Address, utils.GovernanceContractAddress, globalParam.CandidateFee)
+		err = appCallTransferOng(native, params.Address, utils.GovernanceContractAddress, OngAmount(globalParam.CandidateFee))
 		if err != nil {
 			return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOng, ong transfer error!")
 		}
 	case "transferFrom":
 		//ont transfer from
-		err = appCallTransferFromOnt(native, utils.GovernanceContractAddress, params.Address, utils.GovernanceContractAddress, uint64(params.InitPos))
+		err = appCallTransferFromOnt(native, utils.GovernanceContractAddress, params.Address, utils.GovernanceContractAddress, OntAmount(params.InitPos))
 		if err != nil {
 			return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOnt, ont transfer error!")
 		}
 
 		//ong transfer from
-		err = appCallTransferFromOng(native, utils.GovernanceContractAddress, params.Address, utils.GovernanceContractAddress, globalParam.CandidateFee)
+		err = appCallTransferFromOng(native, utils.GovernanceContractAddress, params.Address, utils.GovernanceContractAddress, OngAmount(globalParam.CandidateFee))
 		if err != nil {
 			return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, ong transfer error!")
 		}
 	}
+	if native.Height >= SPLIT_FEE_HEIGHT {
+		err = addSplitFee(native, contract, globalParam.CandidateFee)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "addSplitFee, add candidate fee error!")
+		}
+	}
 
 	//update total stake
 	err = depositTotalStake(native, contract, params.Address, uint64(params.InitPos))
@@ -194,7 +206,11 @@ func voteForPeer(native *native.NativeService, flag string) error {
 		}
 		voteInfo.NewPos = voteInfo.NewPos + uint64(pos)
 		total = total + uint64(pos)
-		peerPoolItem.TotalPos = peerPoolItem.TotalPos + uint64(pos)
+		if native.Height < STAKE_OVERFLOW_HEIGHT {
+			peerPoolItem.TotalPos = peerPoolItem.TotalPos + uint64(pos)
+		} else if err := peerPoolItem.AddTotalPos(uint64(pos)); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "voteForPeer, add totalPos error!")
+		}
 		if peerPoolItem.TotalPos > uint64(globalParam.PosLimit)*peerPoolItem.InitPos {
 			return errors.NewErr("voteForPeer, pos of this peer is full!")
 		}
@@ -213,13 +229,13 @@ func voteForPeer(native *native.NativeService, flag string) error {
 	switch flag {
 	case "transfer":
 		//ont transfer
-		err = appCallTransferOnt(native, params.Address, utils.GovernanceContractAddress, total)
+		err = appCallTransferOnt(native, params.Address, utils.GovernanceContractAddress, OntAmount(total))
 		if err != nil {
 			return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, ont transfer error!")
 		}
 	case "transferFrom":
 		//ont transfer from
-		err = appCallTransferFromOnt(native, utils.GovernanceContractAddress, params.Address, utils.GovernanceContractAddress, total)
+		err = appCallTransferFromOnt(native, utils.GovernanceContractAddress, params.Address, utils.GovernanceContractAddress, OntAmount(total))
 		if err != nil {
 			return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOnt, ont transfer error!")
 		}
@@ -286,7 +302,7 @@ func normalQuit(native *native.NativeService, contract common.Address, peerPoolI
 
 func blackQuit(native *native.NativeService, contract common.Address, peerPoolItem *PeerPoolItem) error {
 	// ont transfer to trigger unboundong
-	err := appCallTransferOnt(native, utils.GovernanceContractAddress, utils.GovernanceContractAddress, peerPoolItem.InitPos)
+	err := appCallTransferOnt(native, utils.GovernanceContractAddress, utils.GovernanceContractAddress, OntAmount(peerPoolItem.InitPos))
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, ont transfer error!")
 	}
@@ -526,7 +542,7 @@ func depositTotalStake(native *native.NativeService, contract common.Address, ad
 	timeOffset := native.Time - constants.GENESIS_BLOCK_TIMESTAMP
 
 	amount := utils.CalcUnbindOng(preStake, preTimeOffset, timeOffset)
-	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, totalStake.Address, amount)
+	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, totalStake.Address, OngAmount(amount))
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, transfer from ong error!")
 	}
@@ -555,7 +571,7 @@ func withdrawTotalStake(native *native.NativeService, contract common.Address, a
 	timeOffset := native.Time - constants.GENESIS_BLOCK_TIMESTAMP
 
 	amount := utils.CalcUnbindOng(preStake, preTimeOffset, timeOffset)
-	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, totalStake.Address, amount)
+	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, totalStake.Address, OngAmount(amount))
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, transfer from ong error!")
 	}
@@ -611,12 +627,12 @@ func withdrawPenaltyStake(native *native.NativeService, contract common.Address,
 	amount := utils.CalcUnbindOng(preStake, preTimeOffset, timeOffset)
 
 	//ont transfer
-	err = appCallTransferOnt(native, utils.GovernanceContractAddress, address, preStake)
+	err = appCallTransferOnt(native, utils.GovernanceContractAddress, address, OntAmount(preStake))
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, ont transfer error!")
 	}
 	//ong approve
-	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, address, amount+preAmount)
+	err = appCallTransferFromOng(native, utils.GovernanceContractAddress, utils.OntContractAddress, address, OngAmount(amount+preAmount))
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, transfer from ong error!")
 	}
@@ -658,49 +674,27 @@ func executeCommitDpos(native *native.NativeService, contract common.Address, co
 		return errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
 	}
 
-	var peers []*PeerStakeInfo
-	for _, peerPoolItem := range peerPoolMap.PeerPoolMap {
-		if peerPoolItem.Status == QuitingStatus {
-			err = normalQuit(native, contract, peerPoolItem)
-			if err != nil {
+	nextPeerPoolMap, peers, err := computeViewTransition(peerPoolMap, config, native.Height)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "computeViewTransition, compute next peerPoolMap error!")
+	}
+
+	err = peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		switch peerPoolItem.Status {
+		case QuitingStatus:
+			if err := normalQuit(native, contract, peerPoolItem); err != nil {
 				return errors.NewDetailErr(err, errors.ErrNoCode, "normalQuit, normalQuit error!")
 			}
-			delete(peerPoolMap.PeerPoolMap, peerPoolItem.PeerPubkey)
-		}
-		if peerPoolItem.Status == BlackStatus {
-			err = blackQuit(native, contract, peerPoolItem)
-			if err != nil {
+		case BlackStatus:
+			if err := blackQuit(native, contract, peerPoolItem); err != nil {
 				return errors.NewDetailErr(err, errors.ErrNoCode, "blackQuit, blackQuit error!")
 			}
-			delete(peerPoolMap.PeerPoolMap, peerPoolItem.PeerPubkey)
-		}
-		if peerPoolItem.Status == QuitConsensusStatus {
-			peerPoolItem.Status = QuitingStatus
-			peerPoolMap.PeerPoolMap[peerPoolItem.PeerPubkey] = peerPoolItem
-		}
-
-		if peerPoolItem.Status == CandidateStatus || peerPoolItem.Status == ConsensusStatus {
-			stake := peerPoolItem.TotalPos + peerPoolItem.InitPos
-			peers = append(peers, &PeerStakeInfo{
-				Index:      peerPoolItem.Index,
-				PeerPubkey: peerPoolItem.PeerPubkey,
-				Stake:      stake,
-			})
-		}
-	}
-	if len(peers) < int(config.K) {
-		return errors.NewErr("commitDpos, num of peers is less than K!")
-	}
-
-	// sort peers by stake
-	sort.SliceStable(peers, func(i, j int) bool {
-		if peers[i].Stake > peers[j].Stake {
-			return true
-		} else if peers[i].Stake == peers[j].Stake {
-			return peers[i].PeerPubkey > peers[j].PeerPubkey
 		}
-		return false
+		return nil
 	})
+	if err != nil {
+		return err
+	}
 
 	// consensus peers
 	for i := 0; i < int(config.K); i++ {
@@ -720,15 +714,13 @@ func executeCommitDpos(native *native.NativeService, contract common.Address, co
 				return errors.NewDetailErr(err, errors.ErrNoCode, "unConsensusToConsensus, unConsensusToConsensus error!")
 			}
 		}
-		peerPoolItem.Status = ConsensusStatus
-		peerPoolMap.PeerPoolMap[peers[i].PeerPubkey] = peerPoolItem
 	}
 
 	//non consensus peers
 	for i := int(config.K); i < len(peers); i++ {
 		peerPoolItem, ok := peerPoolMap.PeerPoolMap[peers[i].PeerPubkey]
 		if !ok {
-			return errors.NewErr("voteForPeer, peerPubkey is not in peerPoolMap!")
+			return errors.NewErr("commitDpos, peerPubkey is not in peerPoolMap!")
 		}
 
 		if peerPoolItem.Status == ConsensusStatus {
@@ -742,124 +734,296 @@ func executeCommitDpos(native *native.NativeService, contract common.Address, co
 				return errors.NewDetailErr(err, errors.ErrNoCode, "unConsensusToUnConsensus, unConsensusToUnConsensus error!")
 			}
 		}
-		peerPoolItem.Status = CandidateStatus
-		peerPoolMap.PeerPoolMap[peers[i].PeerPubkey] = peerPoolItem
 	}
-	err = putPeerPoolMap(native, contract, newView, peerPoolMap)
+	err = storePosTable(native, contract, newView, config, peers)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "storePosTable, store pos table error!")
+	}
+
+	// a view stored per item passes its format on to the next view
+	_, migrated, err := getPeerPoolIndexes(native, contract, view)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
+	}
+	if migrated {
+		err = putPeerPoolItems(native, contract, newView, nextPeerPoolMap, nil)
+	} else {
+		err = putPeerPoolMap(native, contract, newView, nextPeerPoolMap)
+	}
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "putPeerPoolMap, put peerPoolMap error!")
 	}
 	oldView := view - 1
-	oldViewBytes, err := GetUint32Bytes(oldView)
+	err = deletePeerPoolMap(native, contract, oldView)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "GetUint32Bytes, get oldViewBytes error!")
+		return errors.NewDetailErr(err, errors.ErrNoCode, "deletePeerPoolMap, delete old peerPoolMap error!")
 	}
-	native.CloneCache.Delete(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL), oldViewBytes))
 
 	//update view
-	governanceView = &GovernanceView{
-		View:   newView,
-		Height: native.Height,
-		TxHash: native.Tx.Hash(),
-	}
-	err = putGovernanceView(native, contract, governanceView)
+	txHash := native.Tx.Hash()
+	newView, err = IncrementGovernanceView(native, contract, txHash, native.Height)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "putGovernanceView, put governanceView error!")
+		return errors.NewDetailErr(err, errors.ErrNoCode, "IncrementGovernanceView, increment governanceView error!")
+	}
+	if native.Height >= VIEW_CHANGE_EVENT_HEIGHT {
+		pushGovernanceEvent(native, contract, VIEW_CHANGE_EVENT, newView, native.Height, txHash.ToHexString())
 	}
 
 	return nil
 }
 
+// ComputeSplitPlan returns the payouts the fee split of the peer pool of view
+// would make with the current ong balance, no transfer is done
+func ComputeSplitPlan(native *native.NativeService, contract common.Address, view uint32) ([]*Payout, error) {
+	peerPoolMap, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
+	}
+	plan, _, err := calcSplitPlan(native, contract, peerPoolMap)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
 func executeSplit(native *native.NativeService, contract common.Address, peerPoolMap *PeerPoolMap) error {
-	balance, err := getOngBalance(native, utils.GovernanceContractAddress)
+	plan, remainder, err := calcSplitPlan(native, contract, peerPoolMap)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, getOngBalance error!")
+		return err
+	}
+	if plan == nil {
+		return nil
 	}
+	// consecutive payouts of the same reason go in one transfer
+	for i := 0; i < len(plan); {
+		var sts []*ont.State
+		reason := plan[i].Reason
+		for ; i < len(plan) && plan[i].Reason == reason; i++ {
+			sts = append(sts, &ont.State{
+				From:  utils.GovernanceContractAddress,
+				To:    plan[i].Address,
+				Value: plan[i].Amount,
+			})
+		}
+		if err := appCallTransferOngMulti(native, sts); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, ong transfer error!")
+		}
+	}
+
+	if native.Height >= SPLIT_PAYOUT_HEIGHT && SPLIT_REMAINDER_POLICY == SplitRemainderCarry {
+		if err := putSplitFeeRemainder(native, contract, remainder); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "putSplitFeeRemainder, put split fee remainder error!")
+		}
+	}
+	return nil
+}
+
+// calcSplitPlan returns the payouts of the fee split and the remainder left
+// undistributed, the plan is nil if no split is due
+func calcSplitPlan(native *native.NativeService, contract common.Address, peerPoolMap *PeerPoolMap) ([]*Payout, uint64, error) {
+	ongBalance, err := getOngBalance(native, utils.GovernanceContractAddress)
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, getOngBalance error!")
+	}
+	balance := ongBalance.Uint64()
 	//get globalParam
 	globalParam, err := getGlobalParam(native, contract)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam, getGlobalParam error!")
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam, getGlobalParam error!")
 	}
 
 	peersCandidate := []*CandidateSplitInfo{}
 
-	for _, peerPoolItem := range peerPoolMap.PeerPoolMap {
+	err = peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
 		if peerPoolItem.Status == CandidateStatus || peerPoolItem.Status == ConsensusStatus {
-			stake := peerPoolItem.TotalPos + peerPoolItem.InitPos
+			// the legacy split ranks by the wrapping sum
+			stake := peerPoolItem.InitPos + peerPoolItem.TotalPos
+			if native.Height >= SPLIT_PAYOUT_HEIGHT {
+				var err error
+				if stake, err = peerPoolItem.EffectiveStake(); err != nil {
+					return errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, effective stake error!")
+				}
+			}
 			peersCandidate = append(peersCandidate, &CandidateSplitInfo{
+				Index:      index,
 				PeerPubkey: peerPoolItem.PeerPubkey,
 				InitPos:    peerPoolItem.InitPos,
 				Address:    peerPoolItem.Address,
 				Stake:      stake,
 			})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// get config
-	config, err := getConfig(native, contract)
+	config, err := GetConfiguration(native, contract)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "getConfig, get config error!")
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
 	}
 
 	// sort peers by stake
 	sort.SliceStable(peersCandidate, func(i, j int) bool {
-		if peersCandidate[i].Stake > peersCandidate[j].Stake {
-			return true
-		} else if peersCandidate[i].Stake == peersCandidate[j].Stake {
-			return peersCandidate[i].PeerPubkey > peersCandidate[j].PeerPubkey
-		}
-		return false
+		return stakeOrderLess(native.Height, peersCandidate[i].stakeInfo(), peersCandidate[j].stakeInfo())
 	})
 
 	// cal s of each consensus node
 	var sum uint64
 	for i := 0; i < int(config.K); i++ {
-		sum += peersCandidate[i].Stake
+		if sum, err = addSplitStake(native.Height, sum, peersCandidate[i].Stake); err != nil {
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, stake sum of consensus peers error!")
+		}
 	}
 	// if sum = 0, means consensus peer in config, do not split
 	if sum < uint64(config.K) {
-		return nil
+		return nil, 0, nil
 	}
 	avg := sum / uint64(config.K)
+	curve, err := getSplitCurve(native, contract)
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitCurve, get splitCurve error!")
+	}
 	var sumS uint64
 	for i := 0; i < int(config.K); i++ {
-		peersCandidate[i].S, err = splitCurve(native, contract, peersCandidate[i].Stake, avg, uint64(globalParam.Yita))
+		peersCandidate[i].S, err = splitCurve(curve, peersCandidate[i].Stake, avg, uint64(globalParam.Yita))
 		if err != nil {
-			return errors.NewDetailErr(err, errors.ErrNoCode, "splitCurve, calculate splitCurve error!")
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "splitCurve, calculate splitCurve error!")
+		}
+		if sumS, err = addSplitStake(native.Height, sumS, peersCandidate[i].S); err != nil {
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, sum of s error!")
 		}
-		sumS += peersCandidate[i].S
 	}
 	if sumS == 0 {
-		return errors.NewErr("executeSplit, sumS is 0!")
+		return nil, 0, errors.NewErr("executeSplit, sumS is 0!")
+	}
+	if native.Height < SPLIT_PAYOUT_HEIGHT {
+		return legacySplitPlan(peersCandidate, config.K, sumS, balance, globalParam), 0, nil
 	}
 
-	//fee split of consensus peer
-	for i := int(config.K) - 1; i >= 0; i-- {
-		nodeAmount := balance * uint64(globalParam.A) / 100 * peersCandidate[i].S / sumS
-		address := peersCandidate[i].Address
-		err = appCallTransferOng(native, utils.GovernanceContractAddress, address, nodeAmount)
+	// the carried remainder is already part of balance, it is taken out of
+	// the shared pools and added to the consensus pool as a whole
+	var carried uint64
+	if SPLIT_REMAINDER_POLICY == SplitRemainderCarry {
+		carried, err = getSplitFeeRemainder(native, contract)
 		if err != nil {
-			return errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, ong transfer error!")
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitFeeRemainder, get split fee remainder error!")
 		}
+		if carried > balance {
+			carried = balance
+		}
+		balance -= carried
+	}
+
+	consensusPool, err := mulChecked(balance, uint64(globalParam.A))
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, consensus pool error!")
+	}
+	consensusPool /= 100
+	candidatePool, err := mulChecked(balance, uint64(globalParam.B))
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, candidate pool error!")
+	}
+	candidatePool /= 100
+	if SPLIT_REMAINDER_POLICY != SplitRemainderKeep {
+		// what truncating the two pools separately loses goes with the consensus pool
+		sharedPool, err := mulChecked(balance, uint64(globalParam.A)+uint64(globalParam.B))
+		if err != nil {
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, shared pool error!")
+		}
+		consensusPool += sharedPool/100 - consensusPool - candidatePool
+	}
+	consensusPool, err = addChecked(consensusPool, carried)
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, consensus pool error!")
+	}
+
+	//fee split of consensus peer
+	weights := make([]uint64, 0, config.K)
+	for i := 0; i < int(config.K); i++ {
+		weights = append(weights, peersCandidate[i].S)
+	}
+	amounts, remainder, err := splitAmounts(consensusPool, weights, SPLIT_REMAINDER_POLICY)
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "splitAmounts, split consensus pool error!")
+	}
+	plan := make([]*Payout, 0, len(peersCandidate))
+	for i := int(config.K) - 1; i >= 0; i-- {
+		plan = append(plan, &Payout{
+			Address: peersCandidate[i].Address,
+			Amount:  amounts[i],
+			Reason:  ConsensusFeePayout,
+		})
 	}
 
 	//fee split of candidate peer
 	// cal s of each candidate node
 	sum = 0
 	for i := int(config.K); i < len(peersCandidate); i++ {
-		sum += peersCandidate[i].Stake
-	}
-	if sum == 0 {
-		return nil
+		if sum, err = addChecked(sum, peersCandidate[i].Stake); err != nil {
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, stake sum of candidate peers error!")
+		}
 	}
-	for i := int(config.K); i < len(peersCandidate); i++ {
-		nodeAmount := balance * uint64(globalParam.B) / 100 * peersCandidate[i].Stake / sum
-		address := peersCandidate[i].Address
-		err = appCallTransferOng(native, utils.GovernanceContractAddress, address, nodeAmount)
+	if sum != 0 {
+		weights = weights[:0]
+		for i := int(config.K); i < len(peersCandidate); i++ {
+			weights = append(weights, peersCandidate[i].Stake)
+		}
+		amounts, candidateRemainder, err := splitAmounts(candidatePool, weights, SPLIT_REMAINDER_POLICY)
 		if err != nil {
-			return errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, ong transfer error!")
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "splitAmounts, split candidate pool error!")
+		}
+		if remainder, err = addChecked(remainder, candidateRemainder); err != nil {
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "executeSplit, split remainder error!")
+		}
+		for i := int(config.K); i < len(peersCandidate); i++ {
+			plan = append(plan, &Payout{
+				Address: peersCandidate[i].Address,
+				Amount:  amounts[i-int(config.K)],
+				Reason:  CandidateFeePayout,
+			})
 		}
 	}
+	return plan, remainder, nil
+}
 
-	return nil
+// addSplitStake returns a+b, an overflow is an error from SPLIT_PAYOUT_HEIGHT
+// on and wraps before it as the legacy split did
+func addSplitStake(height uint32, a, b uint64) (uint64, error) {
+	if height < SPLIT_PAYOUT_HEIGHT {
+		return a + b, nil
+	}
+	return addChecked(a, b)
+}
+
+// legacySplitPlan is the split plan before SPLIT_PAYOUT_HEIGHT: every payout
+// is computed on its own with wrapping uint64 math and the truncated rest
+// stays in the governance contract. peersCandidate is sorted by stake and
+// its first K entries have S set, summing up to sumS.
+func legacySplitPlan(peersCandidate []*CandidateSplitInfo, k uint32, sumS, balance uint64, globalParam *GlobalParam) []*Payout {
+	plan := make([]*Payout, 0, len(peersCandidate))
+	for i := int(k) - 1; i >= 0; i-- {
+		plan = append(plan, &Payout{
+			Address: peersCandidate[i].Address,
+			Amount:  balance * uint64(globalParam.A) / 100 * peersCandidate[i].S / sumS,
+			Reason:  ConsensusFeePayout,
+		})
+	}
+
+	var sum uint64
+	for i := int(k); i < len(peersCandidate); i++ {
+		sum += peersCandidate[i].Stake
+	}
+	if sum == 0 {
+		return plan
+	}
+	for i := int(k); i < len(peersCandidate); i++ {
+		plan = append(plan, &Payout{
+			Address: peersCandidate[i].Address,
+			Amount:  balance * uint64(globalParam.B) / 100 * peersCandidate[i].Stake / sum,
+			Reason:  CandidateFeePayout,
+		})
+	}
+	return plan
 }
@@ -19,12 +19,15 @@
 package governance
 
 import (
+	"fmt"
 	"io"
+	"math/big"
 
 	"github.com/ontio/ontology/common"
 	"github.com/ontio/ontology/common/serialization"
 	"github.com/ontio/ontology/errors"
 	"github.com/ontio/ontology/smartcontract/service/native/utils"
+	"github.com/ontio/ontology/vm/neovm/types"
 	"math"
 )
 
@@ -399,18 +402,104 @@ func (this *WithdrawParam) Deserialize(r io.Reader) error {
 	return nil
 }
 
+// HashAlgo selects the hash shuffleHash uses to shuffle the pos table
+type HashAlgo uint8
+
+const (
+	// HashAlgoFNV64a keeps the legacy behavior, fnv64a switching to sha256
+	// at SHA256_SHUFFLE_HEIGHT
+	HashAlgoFNV64a HashAlgo = iota
+	// HashAlgoSHA256_64 is sha256 truncated to 8 bytes at every height
+	HashAlgoSHA256_64
+	// HashAlgoKeccak64 is legacy keccak256 truncated to 8 bytes
+	HashAlgoKeccak64
+)
+
+func (this HashAlgo) valid() bool {
+	return this <= HashAlgoKeccak64
+}
+
+// Configuration is the vbft configuration governance runs with. The json
+// field names follow config.VBFTConfig, the optional fields added after the
+// first release are left out of the json while unset.
 type Configuration struct {
-	N                    uint32
-	C                    uint32
-	K                    uint32
-	L                    uint32
-	BlockMsgDelay        uint32
-	HashMsgDelay         uint32
-	PeerHandshakeTimeout uint32
-	MaxBlockChangeView   uint32
+	N                    uint32 `json:"n"`
+	C                    uint32 `json:"c"`
+	K                    uint32 `json:"k"`
+	L                    uint32 `json:"l"`
+	BlockMsgDelay        uint32 `json:"block_msg_delay"`
+	HashMsgDelay         uint32 `json:"hash_msg_delay"`
+	PeerHandshakeTimeout uint32 `json:"peer_handshake_timeout"`
+	MaxBlockChangeView   uint32 `json:"max_block_change_view"`
+	// MaxStakeRatio caps the stake a peer is ranked with in the pos table at
+	// this share of the top K stake sum, in basis points. 0 disables the cap.
+	MaxStakeRatio uint32 `json:"max_stake_ratio,omitempty"`
+	// HashAlgo is the hash used to shuffle the pos table
+	HashAlgo HashAlgo `json:"hash_algo,omitempty"`
+}
+
+// Validate checks the invariants the dpos table calculation relies on.
+// The returned error names the offending field.
+func (this *Configuration) Validate() error {
+	if this.K == 0 {
+		return errors.NewErr("configuration, K can not be 0!")
+	}
+	if this.C == 0 {
+		return errors.NewErr("configuration, C can not be 0!")
+	}
+	// vbft tolerates C faulty peers only when K >= 3*C+1
+	if uint64(this.K) < 3*uint64(this.C)+1 {
+		return fmt.Errorf("configuration, K(%d) can not be less than 3*C+1, C is %d!", this.K, this.C)
+	}
+	if this.N < this.K {
+		return fmt.Errorf("configuration, N(%d) can not be less than K(%d)!", this.N, this.K)
+	}
+	if uint64(this.L) < 16*uint64(this.K) {
+		return fmt.Errorf("configuration, L(%d) can not be less than 16*K, K is %d!", this.L, this.K)
+	}
+	if this.L%this.K != 0 {
+		return fmt.Errorf("configuration, L(%d) must be times of K(%d)!", this.L, this.K)
+	}
+	if this.BlockMsgDelay == 0 {
+		return errors.NewErr("configuration, BlockMsgDelay can not be 0!")
+	}
+	if this.HashMsgDelay == 0 {
+		return errors.NewErr("configuration, HashMsgDelay can not be 0!")
+	}
+	if this.PeerHandshakeTimeout == 0 {
+		return errors.NewErr("configuration, PeerHandshakeTimeout can not be 0!")
+	}
+	if this.MaxBlockChangeView == 0 {
+		return errors.NewErr("configuration, MaxBlockChangeView can not be 0!")
+	}
+	if this.MaxStakeRatio > 10000 {
+		return fmt.Errorf("configuration, MaxStakeRatio(%d) can not be larger than 10000!", this.MaxStakeRatio)
+	}
+	if !this.HashAlgo.valid() {
+		return fmt.Errorf("configuration, unknown HashAlgo(%d)!", this.HashAlgo)
+	}
+	return nil
 }
 
+// configurationVersionMarker starts a versioned Configuration, legacy
+// configurations start with N which is never larger than math.MaxUint32
+const configurationVersionMarker uint64 = math.MaxInt64
+
+// CONFIGURATION_VERSION is the current Configuration encoding version, version
+// 1 adds MaxStakeRatio and HashAlgo. It is only written when one of them is
+// set, so configurations without them keep the legacy encoding.
+const CONFIGURATION_VERSION uint8 = 1
+
 func (this *Configuration) Serialize(w io.Writer) error {
+	versioned := this.MaxStakeRatio != 0 || this.HashAlgo != HashAlgoFNV64a
+	if versioned {
+		if err := utils.WriteVarUint(w, configurationVersionMarker); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize configuration marker error!")
+		}
+		if err := serialization.WriteByte(w, CONFIGURATION_VERSION); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteByte, serialize configuration version error!")
+		}
+	}
 	if err := utils.WriteVarUint(w, uint64(this.N)); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize n error!")
 	}
@@ -435,6 +524,14 @@ func (this *Configuration) Serialize(w io.Writer) error {
 	if err := utils.WriteVarUint(w, uint64(this.MaxBlockChangeView)); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize max_block_change_view error!")
 	}
+	if versioned {
+		if err := utils.WriteVarUint(w, uint64(this.MaxStakeRatio)); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize max_stake_ratio error!")
+		}
+		if err := utils.WriteVarUint(w, uint64(this.HashAlgo)); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize hash_algo error!")
+		}
+	}
 	return nil
 }
 
@@ -443,6 +540,22 @@ func (this *Configuration) Deserialize(r io.Reader) error {
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize n error!")
 	}
+	// legacy configurations end after maxBlockChangeView, bytes following
+	// them (e.g. in an updateConfig input) are not read as optional fields
+	versioned := n == configurationVersionMarker
+	if versioned {
+		version, err := serialization.ReadByte(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadByte, deserialize configuration version error!")
+		}
+		if version == 0 || version > CONFIGURATION_VERSION {
+			return fmt.Errorf("deserialize configuration, unknown version %d!", version)
+		}
+		n, err = utils.ReadVarUint(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize n error!")
+		}
+	}
 	c, err := utils.ReadVarUint(r)
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize c error!")
@@ -471,6 +584,17 @@ func (this *Configuration) Deserialize(r io.Reader) error {
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize maxBlockChangeView error!")
 	}
+	var maxStakeRatio, hashAlgo uint64
+	if versioned {
+		maxStakeRatio, err = utils.ReadVarUint(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize maxStakeRatio error!")
+		}
+		hashAlgo, err = utils.ReadVarUint(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize hashAlgo error!")
+		}
+	}
 	if n > math.MaxUint32 {
 		return errors.NewErr("n larger than max of uint32!")
 	}
@@ -495,6 +619,12 @@ func (this *Configuration) Deserialize(r io.Reader) error {
 	if maxBlockChangeView > math.MaxUint32 {
 		return errors.NewErr("maxBlockChangeView larger than max of uint32!")
 	}
+	if maxStakeRatio > math.MaxUint32 {
+		return errors.NewErr("maxStakeRatio larger than max of uint32!")
+	}
+	if hashAlgo > math.MaxUint8 {
+		return errors.NewErr("hashAlgo larger than max of uint8!")
+	}
 	this.N = uint32(n)
 	this.C = uint32(c)
 	this.K = uint32(k)
@@ -503,9 +633,37 @@ func (this *Configuration) Deserialize(r io.Reader) error {
 	this.HashMsgDelay = uint32(hashMsgDelay)
 	this.PeerHandshakeTimeout = uint32(peerHandshakeTimeout)
 	this.MaxBlockChangeView = uint32(maxBlockChangeView)
+	this.MaxStakeRatio = uint32(maxStakeRatio)
+	this.HashAlgo = HashAlgo(hashAlgo)
+	return nil
+}
+
+// BasisPoints is a rate in units of 1/10000, valid rates are 0 to 10000
+type BasisPoints uint32
+
+// MAX_BASIS_POINTS is the rate of the whole amount
+const MAX_BASIS_POINTS BasisPoints = 10000
+
+// Validate checks that the rate is at most MAX_BASIS_POINTS
+func (this BasisPoints) Validate() error {
+	if this > MAX_BASIS_POINTS {
+		return fmt.Errorf("basis points %d can not be larger than %d!", this, MAX_BASIS_POINTS)
+	}
 	return nil
 }
 
+// Apply returns the share of amount at this rate, rounded down
+func (this BasisPoints) Apply(amount uint64) (uint64, error) {
+	if err := this.Validate(); err != nil {
+		return 0, err
+	}
+	share := new(big.Int).SetUint64(amount)
+	share.Mul(share, big.NewInt(int64(this)))
+	share.Quo(share, big.NewInt(int64(MAX_BASIS_POINTS)))
+	// share <= amount
+	return share.Uint64(), nil
+}
+
 type GlobalParam struct {
 	CandidateFee uint64 //unit: 10^-9 ong
 	MinInitStake uint32
@@ -517,6 +675,14 @@ type GlobalParam struct {
 	Penalty      uint32
 }
 
+// PenaltyRate returns Penalty, which is stored in percent, as basis points
+func (this *GlobalParam) PenaltyRate() (BasisPoints, error) {
+	if this.Penalty > 100 {
+		return 0, fmt.Errorf("penaltyRate, penalty %d%% can not be larger than 100%%!", this.Penalty)
+	}
+	return BasisPoints(this.Penalty * 100), nil
+}
+
 func (this *GlobalParam) Serialize(w io.Writer) error {
 	if err := utils.WriteVarUint(w, this.CandidateFee); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize candidateFee error!")
@@ -610,10 +776,126 @@ func (this *GlobalParam) Deserialize(r io.Reader) error {
 	return nil
 }
 
+// GlobalParam2 holds the global params added after GlobalParam, it is stored
+// under its own key so GlobalParam keeps its original encoding. Chains which
+// never stored it read the zero value, see the defaults of each field.
+type GlobalParam2 struct {
+	MinAuthorizePos      uint32 //default 0, no minimum on a single vote
+	CandidateFeeSplitNum uint32 //default 0, fee is split among all candidates as before
+	PeerCommission       uint32 //unit: basis points, default 0, peers keep no commission
+	MaxCandidateNum      uint32 //default 0, no cap on the peers a pos table is built for
+}
+
+func (this *GlobalParam2) Serialize(w io.Writer) error {
+	if err := utils.WriteVarUint(w, uint64(this.MinAuthorizePos)); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize minAuthorizePos error!")
+	}
+	if err := utils.WriteVarUint(w, uint64(this.CandidateFeeSplitNum)); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize candidateFeeSplitNum error!")
+	}
+	if err := utils.WriteVarUint(w, uint64(this.PeerCommission)); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize peerCommission error!")
+	}
+	// only written when set, so params stored before it keep their encoding
+	if this.MaxCandidateNum != 0 {
+		if err := utils.WriteVarUint(w, uint64(this.MaxCandidateNum)); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize maxCandidateNum error!")
+		}
+	}
+	return nil
+}
+
+func (this *GlobalParam2) Deserialize(r io.Reader) error {
+	minAuthorizePos, err := utils.ReadVarUint(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize minAuthorizePos error!")
+	}
+	candidateFeeSplitNum, err := utils.ReadVarUint(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize candidateFeeSplitNum error!")
+	}
+	peerCommission, err := utils.ReadVarUint(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize peerCommission error!")
+	}
+	maxCandidateNum, err := readOptionalVarUint(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "readOptionalVarUint, deserialize maxCandidateNum error!")
+	}
+	if minAuthorizePos > math.MaxUint32 {
+		return errors.NewErr("minAuthorizePos larger than max of uint32!")
+	}
+	if candidateFeeSplitNum > math.MaxUint32 {
+		return errors.NewErr("candidateFeeSplitNum larger than max of uint32!")
+	}
+	if peerCommission > math.MaxUint32 {
+		return errors.NewErr("peerCommission larger than max of uint32!")
+	}
+	if maxCandidateNum > math.MaxUint32 {
+		return errors.NewErr("maxCandidateNum larger than max of uint32!")
+	}
+	this.MinAuthorizePos = uint32(minAuthorizePos)
+	this.CandidateFeeSplitNum = uint32(candidateFeeSplitNum)
+	this.PeerCommission = uint32(peerCommission)
+	this.MaxCandidateNum = uint32(maxCandidateNum)
+	return nil
+}
+
+// readOptionalVarUint reads a var uint appended to a format after its first
+// release, data written before ends right there and reads as 0
+func readOptionalVarUint(r io.Reader) (uint64, error) {
+	value, err := serialization.ReadVarBytes(r)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadVarBytes, read value error!")
+	}
+	v := types.BigIntFromBytes(value)
+	if v.Sign() < 0 || !v.IsUint64() {
+		return 0, errors.NewErr("readOptionalVarUint, value is not a uint64!")
+	}
+	return v.Uint64(), nil
+}
+
+// SplitCurve is the stake to reward curve of fee split, a polyline through the
+// points (Xi[i], Yi[i]). Serialize only covers Yi, Xi is stored under its own key.
 type SplitCurve struct {
+	Xi []uint32
 	Yi []uint32
 }
 
+func serializeUint32Slice(w io.Writer, s []uint32) error {
+	if err := utils.WriteVarUint(w, uint64(len(s))); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize slice length error!")
+	}
+	for _, v := range s {
+		if err := utils.WriteVarUint(w, uint64(v)); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "utils.WriteVarUint, serialize slice item error!")
+		}
+	}
+	return nil
+}
+
+func deserializeUint32Slice(r io.Reader) ([]uint32, error) {
+	n, err := utils.ReadVarUint(r)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize slice length error!")
+	}
+	s := make([]uint32, 0)
+	for i := 0; uint64(i) < n; i++ {
+		v, err := utils.ReadVarUint(r)
+		if err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "utils.ReadVarUint, deserialize slice item error!")
+		}
+		if v > math.MaxUint32 {
+			return nil, errors.NewErr("slice item larger than max of uint32!")
+		}
+		s = append(s, uint32(v))
+	}
+	return s, nil
+}
+
 func (this *SplitCurve) Serialize(w io.Writer) error {
 	if len(this.Yi) != 101 {
 		return errors.NewErr("length of split curve != 101!")
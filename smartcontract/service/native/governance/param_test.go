@@ -0,0 +1,238 @@
+/*
+ * Copyright (C) 2018 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package governance
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+func TestConfigurationValidate(t *testing.T) {
+	if err := testConfiguration().Validate(); err != nil {
+		t.Fatalf("valid configuration rejected: %s", err)
+	}
+
+	cases := []struct {
+		field  string
+		modify func(c *Configuration)
+	}{
+		{"K", func(c *Configuration) { c.K = 0 }},
+		{"C", func(c *Configuration) { c.C = 0 }},
+		{"K", func(c *Configuration) { c.C = 4 }},
+		{"K", func(c *Configuration) { c.K, c.N, c.L = 6, 7, 96 }},
+		{"N", func(c *Configuration) { c.N = 6 }},
+		{"L", func(c *Configuration) { c.L = 7 }},
+		{"L", func(c *Configuration) { c.L = 14 }},
+		{"L", func(c *Configuration) { c.L = 113 }},
+		{"BlockMsgDelay", func(c *Configuration) { c.BlockMsgDelay = 0 }},
+		{"HashMsgDelay", func(c *Configuration) { c.HashMsgDelay = 0 }},
+		{"PeerHandshakeTimeout", func(c *Configuration) { c.PeerHandshakeTimeout = 0 }},
+		{"MaxBlockChangeView", func(c *Configuration) { c.MaxBlockChangeView = 0 }},
+		{"MaxStakeRatio", func(c *Configuration) { c.MaxStakeRatio = 10001 }},
+		{"HashAlgo", func(c *Configuration) { c.HashAlgo = HashAlgoKeccak64 + 1 }},
+	}
+	for _, c := range cases {
+		config := testConfiguration()
+		c.modify(config)
+		err := config.Validate()
+		if err == nil {
+			t.Errorf("invalid %s accepted: %+v", c.field, config)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.field) {
+			t.Errorf("error %q does not name field %s", err, c.field)
+		}
+	}
+}
+
+func TestConfigurationFaultTolerance(t *testing.T) {
+	// K = 3*C+1 is the smallest consensus set tolerating C faulty peers
+	config := testConfiguration()
+	config.C, config.K, config.N, config.L = 3, 10, 10, 160
+	if err := config.Validate(); err != nil {
+		t.Errorf("K = 3*C+1 rejected: %s", err)
+	}
+	config.K, config.L = 9, 144
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("K = 3*C accepted")
+	}
+	if !strings.Contains(err.Error(), "3*C+1") {
+		t.Errorf("error %q does not name the bound", err)
+	}
+}
+
+func TestConfigurationMaxStakeRatioSerialization(t *testing.T) {
+	config := testConfiguration()
+	bf := new(bytes.Buffer)
+	if err := config.Serialize(bf); err != nil {
+		t.Fatalf("serialize failed: %s", err)
+	}
+	legacy := bf.Bytes()
+
+	// configurations stored before MaxStakeRatio decode with the cap disabled
+	decoded := new(Configuration)
+	if err := decoded.Deserialize(bytes.NewBuffer(legacy)); err != nil {
+		t.Fatalf("deserialize failed: %s", err)
+	}
+	if *decoded != *config {
+		t.Errorf("decoded %+v, want %+v", decoded, config)
+	}
+
+	// bytes following a legacy configuration, as an updateConfig input may
+	// carry, are not read as MaxStakeRatio
+	trailing := append(append([]byte(nil), legacy...), 1, 0x10, 1, 1)
+	decoded = new(Configuration)
+	if err := decoded.Deserialize(bytes.NewBuffer(trailing)); err != nil {
+		t.Fatalf("deserialize failed: %s", err)
+	}
+	if *decoded != *config {
+		t.Errorf("decoded %+v, want %+v", decoded, config)
+	}
+
+	config.MaxStakeRatio = 2500
+	bf = new(bytes.Buffer)
+	if err := config.Serialize(bf); err != nil {
+		t.Fatalf("serialize failed: %s", err)
+	}
+	if bytes.HasPrefix(bf.Bytes(), legacy) {
+		t.Errorf("MaxStakeRatio is written without a version marker")
+	}
+	decoded = new(Configuration)
+	if err := decoded.Deserialize(bf); err != nil {
+		t.Fatalf("deserialize failed: %s", err)
+	}
+	if *decoded != *config {
+		t.Errorf("decoded %+v, want %+v", decoded, config)
+	}
+}
+
+func TestConfigurationHashAlgoSerialization(t *testing.T) {
+	config := testConfiguration()
+	bf := new(bytes.Buffer)
+	if err := config.Serialize(bf); err != nil {
+		t.Fatalf("serialize failed: %s", err)
+	}
+	legacy := bf.Bytes()
+
+	for _, algo := range []HashAlgo{HashAlgoSHA256_64, HashAlgoKeccak64} {
+		config.HashAlgo = algo
+		bf = new(bytes.Buffer)
+		if err := config.Serialize(bf); err != nil {
+			t.Fatalf("serialize failed: %s", err)
+		}
+		if bytes.HasPrefix(bf.Bytes(), legacy) {
+			t.Errorf("HashAlgo %d is written without a version marker", algo)
+		}
+		decoded := new(Configuration)
+		if err := decoded.Deserialize(bf); err != nil {
+			t.Fatalf("deserialize failed: %s", err)
+		}
+		if *decoded != *config {
+			t.Errorf("decoded %+v, want %+v", decoded, config)
+		}
+	}
+}
+
+func TestConfigurationJSON(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	config := testConfiguration()
+	if err := putConfig(native, contract, config); err != nil {
+		t.Fatalf("putConfig failed: %s", err)
+	}
+	data, err := GetConfigurationJSON(native, contract)
+	if err != nil {
+		t.Fatalf("GetConfigurationJSON failed: %s", err)
+	}
+	want := `{"n":7,"c":2,"k":7,"l":112,"block_msg_delay":10000,"hash_msg_delay":10000,` +
+		`"peer_handshake_timeout":10,"max_block_change_view":1000}`
+	if string(data) != want {
+		t.Errorf("json %s, want %s", data, want)
+	}
+
+	config.MaxStakeRatio = 2500
+	config.HashAlgo = HashAlgoKeccak64
+	data, err = json.Marshal(config)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if !strings.Contains(string(data), `"max_stake_ratio":2500,"hash_algo":2`) {
+		t.Errorf("optional fields missing from %s", data)
+	}
+	decoded := new(Configuration)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	if *decoded != *config {
+		t.Errorf("decoded %+v, want %+v", decoded, config)
+	}
+}
+
+func TestBasisPointsApply(t *testing.T) {
+	vectors := []struct {
+		rate   BasisPoints
+		amount uint64
+		share  uint64
+	}{
+		{0, 1000, 0},
+		{0, math.MaxUint64, 0},
+		{10000, 1000, 1000},
+		{10000, math.MaxUint64, math.MaxUint64},
+		{2500, 1000, 250},
+		{1, 9999, 0},
+		{1, 10000, 1},
+		{3333, 999, 332},
+		{5000, math.MaxUint64, math.MaxUint64 / 2},
+	}
+	for _, v := range vectors {
+		share, err := v.rate.Apply(v.amount)
+		if err != nil || share != v.share {
+			t.Errorf("BasisPoints(%d).Apply(%d) = %d, %v, want %d", v.rate, v.amount, share, err, v.share)
+		}
+	}
+	for _, rate := range []BasisPoints{10001, math.MaxUint32} {
+		if err := rate.Validate(); err == nil {
+			t.Errorf("BasisPoints(%d) should be invalid", rate)
+		}
+		if _, err := rate.Apply(1000); err == nil {
+			t.Errorf("BasisPoints(%d).Apply should fail", rate)
+		}
+	}
+}
+
+func TestGlobalParamPenaltyRate(t *testing.T) {
+	for _, v := range []struct {
+		penalty uint32
+		rate    BasisPoints
+	}{{0, 0}, {5, 500}, {100, 10000}} {
+		rate, err := (&GlobalParam{Penalty: v.penalty}).PenaltyRate()
+		if err != nil || rate != v.rate {
+			t.Errorf("PenaltyRate of %d%% = %d, %v, want %d", v.penalty, rate, err, v.rate)
+		}
+	}
+	if _, err := (&GlobalParam{Penalty: 101}).PenaltyRate(); err == nil {
+		t.Error("PenaltyRate should reject a penalty above 100%")
+	}
+}
@@ -19,16 +19,37 @@
 package governance
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"math"
 	"sort"
 
 	"github.com/ontio/ontology/common"
 	"github.com/ontio/ontology/common/serialization"
+	vbftconfig "github.com/ontio/ontology/consensus/vbft/config"
 	"github.com/ontio/ontology/errors"
 )
 
 type Status int
 
+var statusNames = map[Status]string{
+	RegisterCandidateStatus: "RegisterCandidate",
+	CandidateStatus:         "Candidate",
+	ConsensusStatus:         "Consensus",
+	QuitConsensusStatus:     "QuitConsensus",
+	QuitingStatus:           "Quiting",
+	BlackStatus:             "Black",
+}
+
+// String returns the name of the status, unknown values print as Status(n)
+func (this Status) String() string {
+	if name, ok := statusNames[this]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(this))
+}
+
 func (this *Status) Serialize(w io.Writer) error {
 	if err := serialization.WriteUint8(w, uint8(*this)); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint8, serialize status error!")
@@ -88,11 +109,38 @@ type PeerPoolList struct {
 	Peers []*PeerPoolItem
 }
 
+// peerPoolMapVersionMarker starts a versioned PeerPoolMap, legacy maps start
+// with their item count which never gets this large
+const peerPoolMapVersionMarker = math.MaxUint32
+
+// PEER_POOL_MAP_VERSION is the current PeerPoolMap encoding version, stored
+// from PEER_POOL_VIEW_HEIGHT on. Version 0 maps have no marker and no version
+// byte and are told apart by their leading item count.
+const PEER_POOL_MAP_VERSION uint8 = 1
+
 type PeerPoolMap struct {
 	PeerPoolMap map[string]*PeerPoolItem
+	// Version 0 is the legacy encoding, version 1 adds View
+	Version uint8
+	// View is the view the map is stored under, only kept by version 1
+	View uint32
 }
 
 func (this *PeerPoolMap) Serialize(w io.Writer) error {
+	if this.Version > PEER_POOL_MAP_VERSION {
+		return errors.NewErr("serialize PeerPoolMap, unknown version!")
+	}
+	if this.Version != 0 {
+		if err := serialization.WriteUint32(w, peerPoolMapVersionMarker); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize PeerPoolMap marker error!")
+		}
+		if err := serialization.WriteByte(w, this.Version); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteByte, serialize PeerPoolMap version error!")
+		}
+		if err := serialization.WriteUint32(w, this.View); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize PeerPoolMap view error!")
+		}
+	}
 	if err := serialization.WriteUint32(w, uint32(len(this.PeerPoolMap))); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize PeerPoolMap length error!")
 	}
@@ -116,6 +164,25 @@ func (this *PeerPoolMap) Deserialize(r io.Reader) error {
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize PeerPoolMap length error!")
 	}
+	var version uint8
+	var view uint32
+	if n == peerPoolMapVersionMarker {
+		version, err = serialization.ReadByte(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadByte, deserialize PeerPoolMap version error!")
+		}
+		if version == 0 || version > PEER_POOL_MAP_VERSION {
+			return fmt.Errorf("deserialize PeerPoolMap, unknown version %d!", version)
+		}
+		view, err = serialization.ReadUint32(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize PeerPoolMap view error!")
+		}
+		n, err = serialization.ReadUint32(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize PeerPoolMap length error!")
+		}
+	}
 	peerPoolMap := make(map[string]*PeerPoolItem)
 	for i := 0; uint32(i) < n; i++ {
 		peerPoolItem := new(PeerPoolItem)
@@ -125,9 +192,112 @@ func (this *PeerPoolMap) Deserialize(r io.Reader) error {
 		peerPoolMap[peerPoolItem.PeerPubkey] = peerPoolItem
 	}
 	this.PeerPoolMap = peerPoolMap
+	this.Version = version
+	this.View = view
+	return nil
+}
+
+// PeersByStatus returns the items with the given status sorted by Index, so
+// callers never depend on map iteration order.
+func (this *PeerPoolMap) PeersByStatus(status Status) []*PeerPoolItem {
+	peers := make([]*PeerPoolItem, 0)
+	for _, v := range this.PeerPoolMap {
+		if v.Status == status {
+			peers = append(peers, v)
+		}
+	}
+	sortPeerPoolItems(peers)
+	return peers
+}
+
+// ForEachSorted calls fn on every item in Index order, ties broken by
+// PeerPubkey, and stops at the first error fn returns.
+func (this *PeerPoolMap) ForEachSorted(fn func(index uint32, item *PeerPoolItem) error) error {
+	peers := make([]*PeerPoolItem, 0, len(this.PeerPoolMap))
+	for _, v := range this.PeerPoolMap {
+		peers = append(peers, v)
+	}
+	sortPeerPoolItems(peers)
+	for _, v := range peers {
+		if err := fn(v.Index, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortPeerPoolItems(peers []*PeerPoolItem) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		if peers[i].Index != peers[j].Index {
+			return peers[i].Index < peers[j].Index
+		}
+		return peers[i].PeerPubkey < peers[j].PeerPubkey
+	})
+}
+
+// IndexOf returns the Index of the peer with pubkey, pubkeys are compared in
+// normalized form like FindDuplicatePeer does.
+func (this *PeerPoolMap) IndexOf(pubkey string) (uint32, bool) {
+	peerPoolItem, ok := FindDuplicatePeer(this, pubkey)
+	if !ok {
+		return 0, false
+	}
+	return peerPoolItem.Index, true
+}
+
+// TotalStake returns the sum of InitPos and TotalPos over all items. Peers
+// which are quitting or blacklisted are only counted if includeQuitting is set.
+func (this *PeerPoolMap) TotalStake(includeQuitting bool) (uint64, error) {
+	var sum uint64
+	for _, v := range this.PeerPoolMap {
+		if !includeQuitting && (v.Status == QuitConsensusStatus || v.Status == QuitingStatus || v.Status == BlackStatus) {
+			continue
+		}
+		for _, pos := range []uint64{v.InitPos, v.TotalPos} {
+			if sum+pos < sum {
+				return 0, errors.NewErr("totalStake, stake sum overflows uint64!")
+			}
+			sum += pos
+		}
+	}
+	return sum, nil
+}
+
+// RemovePeer deletes the peer with pubkey, compared like IndexOf does. A
+// consensus peer is only removed if allowConsensus is set and at least k
+// consensus peers remain, vbft can not make progress with fewer.
+func (this *PeerPoolMap) RemovePeer(pubkey string, k uint32, allowConsensus bool) error {
+	peerPoolItem, ok := FindDuplicatePeer(this, pubkey)
+	if !ok {
+		return errors.NewErr("removePeer, peer is not in peer pool!")
+	}
+	if peerPoolItem.Status == ConsensusStatus {
+		if !allowConsensus {
+			return errors.NewErr("removePeer, can not remove a consensus peer!")
+		}
+		if consensusNum := uint32(len(this.PeersByStatus(ConsensusStatus))); consensusNum-1 < k {
+			return fmt.Errorf("removePeer, %d consensus peers would remain, less than K(%d)!", consensusNum-1, k)
+		}
+	}
+	delete(this.PeerPoolMap, peerPoolItem.PeerPubkey)
 	return nil
 }
 
+// peerPoolItemVersionMarker starts a versioned PeerPoolItem, legacy items
+// start with their Index which never gets this large
+const peerPoolItemVersionMarker = math.MaxUint32
+
+// PEER_POOL_ITEM_VERSION is the current PeerPoolItem encoding version, it is
+// only written for items carrying metadata. Version 0 items have no marker
+// and no version byte and are told apart by their leading Index.
+const PEER_POOL_ITEM_VERSION uint8 = 1
+
+// Bounds of the peer metadata in bytes, the endpoint in hex characters
+const (
+	MAX_PEER_NAME_LEN     = 64
+	MAX_PEER_ENDPOINT_LEN = 256
+)
+
 type PeerPoolItem struct {
 	Index      uint32
 	PeerPubkey string
@@ -135,9 +305,94 @@ type PeerPoolItem struct {
 	Status     Status
 	InitPos    uint64
 	TotalPos   uint64
+	// Version 0 is the legacy encoding, version 1 adds Name and Endpoint
+	Version uint8
+	// Name is a human readable label of the peer, set by its operator
+	Name string
+	// Endpoint is the signed endpoint commitment of the peer, hex encoded
+	Endpoint string
+}
+
+// SetMetadata sets Name and Endpoint and moves the item to version 1
+func (this *PeerPoolItem) SetMetadata(name, endpoint string) error {
+	if len(name) > MAX_PEER_NAME_LEN {
+		return fmt.Errorf("setMetadata, name is longer than %d bytes!", MAX_PEER_NAME_LEN)
+	}
+	if len(endpoint) > MAX_PEER_ENDPOINT_LEN {
+		return fmt.Errorf("setMetadata, endpoint is longer than %d bytes!", MAX_PEER_ENDPOINT_LEN)
+	}
+	this.Name = name
+	this.Endpoint = endpoint
+	this.Version = PEER_POOL_ITEM_VERSION
+	return nil
+}
+
+// Metadata returns Name and Endpoint, both empty for a legacy item
+func (this *PeerPoolItem) Metadata() (string, string) {
+	return this.Name, this.Endpoint
+}
+
+// ErrStakeOverflow is returned when adding stake to a peer would overflow
+// uint64
+var ErrStakeOverflow = errors.NewErr("stake overflows uint64")
+
+// AddInitPos adds amount to InitPos, InitPos is left unchanged on overflow
+func (this *PeerPoolItem) AddInitPos(amount uint64) error {
+	if this.InitPos+amount < this.InitPos {
+		return ErrStakeOverflow
+	}
+	this.InitPos += amount
+	return nil
+}
+
+// AddTotalPos adds amount to TotalPos, TotalPos is left unchanged on overflow
+func (this *PeerPoolItem) AddTotalPos(amount uint64) error {
+	if this.TotalPos+amount < this.TotalPos {
+		return ErrStakeOverflow
+	}
+	this.TotalPos += amount
+	return nil
+}
+
+// EffectiveStake is the stake the peer is scheduled with: its own InitPos plus
+// the TotalPos authorized to it by delegators. Pending and withdrawing
+// authorizations are not part of TotalPos and do not count.
+func (this *PeerPoolItem) EffectiveStake() (uint64, error) {
+	if this.InitPos+this.TotalPos < this.InitPos {
+		return 0, ErrStakeOverflow
+	}
+	return this.InitPos + this.TotalPos, nil
+}
+
+// PeerStake is the stake the pos table of a view built at height ranks the
+// peer by: EffectiveStake from STAKE_OVERFLOW_HEIGHT on, the wrapping sum of
+// InitPos and TotalPos below it. vbft and commitDpos must agree on it.
+func PeerStake(peerPoolItem *PeerPoolItem, height uint32) (uint64, error) {
+	if height < STAKE_OVERFLOW_HEIGHT {
+		return peerPoolItem.InitPos + peerPoolItem.TotalPos, nil
+	}
+	return peerPoolItem.EffectiveStake()
 }
 
 func (this *PeerPoolItem) Serialize(w io.Writer) error {
+	if this.Version > PEER_POOL_ITEM_VERSION {
+		return errors.NewErr("serialize PeerPoolItem, unknown version!")
+	}
+	if this.Version == 0 {
+		if this.Index == peerPoolItemVersionMarker {
+			return errors.NewErr("serialize PeerPoolItem, index is reserved!")
+		}
+		if this.Name != "" || this.Endpoint != "" {
+			return errors.NewErr("serialize PeerPoolItem, metadata needs version 1!")
+		}
+	} else {
+		if err := serialization.WriteUint32(w, peerPoolItemVersionMarker); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize PeerPoolItem marker error!")
+		}
+		if err := serialization.WriteByte(w, this.Version); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteByte, serialize PeerPoolItem version error!")
+		}
+	}
 	if err := serialization.WriteUint32(w, this.Index); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize address error!")
 	}
@@ -156,6 +411,14 @@ func (this *PeerPoolItem) Serialize(w io.Writer) error {
 	if err := serialization.WriteUint64(w, this.TotalPos); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint64, serialize totalPos error!")
 	}
+	if this.Version != 0 {
+		if err := serialization.WriteString(w, this.Name); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteString, serialize name error!")
+		}
+		if err := serialization.WriteString(w, this.Endpoint); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteString, serialize endpoint error!")
+		}
+	}
 	return nil
 }
 
@@ -164,6 +427,20 @@ func (this *PeerPoolItem) Deserialize(r io.Reader) error {
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize index error!")
 	}
+	var version uint8
+	if index == peerPoolItemVersionMarker {
+		version, err = serialization.ReadByte(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadByte, deserialize PeerPoolItem version error!")
+		}
+		if version == 0 || version > PEER_POOL_ITEM_VERSION {
+			return fmt.Errorf("deserialize PeerPoolItem, unknown version %d!", version)
+		}
+		index, err = serialization.ReadUint32(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize index error!")
+		}
+	}
 	peerPubkey, err := serialization.ReadString(r)
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadString, deserialize peerPubkey error!")
@@ -186,12 +463,32 @@ func (this *PeerPoolItem) Deserialize(r io.Reader) error {
 	if err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint64, deserialize totalPos error!")
 	}
+	var name, endpoint string
+	if version != 0 {
+		name, err = serialization.ReadString(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadString, deserialize name error!")
+		}
+		if len(name) > MAX_PEER_NAME_LEN {
+			return fmt.Errorf("deserialize PeerPoolItem, name is longer than %d bytes!", MAX_PEER_NAME_LEN)
+		}
+		endpoint, err = serialization.ReadString(r)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadString, deserialize endpoint error!")
+		}
+		if len(endpoint) > MAX_PEER_ENDPOINT_LEN {
+			return fmt.Errorf("deserialize PeerPoolItem, endpoint is longer than %d bytes!", MAX_PEER_ENDPOINT_LEN)
+		}
+	}
 	this.Index = index
 	this.PeerPubkey = peerPubkey
 	this.Address = *address
 	this.Status = *status
 	this.InitPos = initPos
 	this.TotalPos = totalPos
+	this.Version = version
+	this.Name = name
+	this.Endpoint = endpoint
 	return nil
 }
 
@@ -280,9 +577,91 @@ func (this *VoteInfo) Deserialize(r io.Reader) error {
 }
 
 type PeerStakeInfo struct {
-	Index      uint32
-	PeerPubkey string
-	Stake      uint64
+	Index      uint32 `json:"index"`
+	PeerPubkey string `json:"peer_pubkey"`
+	Stake      uint64 `json:"stake"`
+}
+
+func (this *PeerStakeInfo) Serialize(w io.Writer) error {
+	if err := serialization.WriteUint32(w, this.Index); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize index error!")
+	}
+	if err := serialization.WriteString(w, this.PeerPubkey); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteString, serialize peerPubkey error!")
+	}
+	if err := serialization.WriteUint64(w, this.Stake); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint64, serialize stake error!")
+	}
+	return nil
+}
+
+func (this *PeerStakeInfo) Deserialize(r io.Reader) error {
+	index, err := serialization.ReadUint32(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize index error!")
+	}
+	peerPubkey, err := serialization.ReadString(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadString, deserialize peerPubkey error!")
+	}
+	stake, err := serialization.ReadUint64(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint64, deserialize stake error!")
+	}
+	this.Index = index
+	this.PeerPubkey = peerPubkey
+	this.Stake = stake
+	return nil
+}
+
+// SerializePeerStakeInfos encodes peers as a uint32 count followed by each
+// peer in order, nil entries are rejected
+func SerializePeerStakeInfos(peers []*PeerStakeInfo) ([]byte, error) {
+	bf := new(bytes.Buffer)
+	if err := serialization.WriteUint32(bf, uint32(len(peers))); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize peers length error!")
+	}
+	for i, peer := range peers {
+		if peer == nil {
+			return nil, fmt.Errorf("serializePeerStakeInfos, peer %d is nil!", i)
+		}
+		if err := peer.Serialize(bf); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialize peerStakeInfo error!")
+		}
+	}
+	return bf.Bytes(), nil
+}
+
+// DeserializePeerStakeInfos decodes the output of SerializePeerStakeInfos,
+// data must hold exactly the encoded peers
+func DeserializePeerStakeInfos(data []byte) ([]*PeerStakeInfo, error) {
+	r := bytes.NewBuffer(data)
+	n, err := serialization.ReadUint32(r)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize peers length error!")
+	}
+	peers := make([]*PeerStakeInfo, 0)
+	for i := uint32(0); i < n; i++ {
+		peer := new(PeerStakeInfo)
+		if err := peer.Deserialize(r); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize peerStakeInfo error!")
+		}
+		peers = append(peers, peer)
+	}
+	if r.Len() != 0 {
+		return nil, errors.NewErr("deserializePeerStakeInfos, trailing data after peers!")
+	}
+	return peers, nil
+}
+
+// DposTableSnapshot is the stake table and the resulting pos table of one view
+type DposTableSnapshot struct {
+	View       uint32                            `json:"view"`
+	Height     uint32                            `json:"height"`
+	TxHash     string                            `json:"tx_hash"`
+	Peers      []*PeerStakeInfo                  `json:"peers"`
+	ChainPeers map[uint32]*vbftconfig.PeerConfig `json:"chain_peers"`
+	PosTable   []uint32                          `json:"pos_table"`
 }
 
 type GovernanceView struct {
@@ -323,6 +702,26 @@ func (this *GovernanceView) Deserialize(r io.Reader) error {
 	return nil
 }
 
+// GetTxHash returns the hash of the tx which started the view, the anchor of
+// the pos table shuffle. A zero hash means the view was never anchored.
+func (this *GovernanceView) GetTxHash() (common.Uint256, error) {
+	if this.TxHash == (common.Uint256{}) {
+		return common.Uint256{}, errors.NewErr("governanceView, txHash is empty!")
+	}
+	return this.TxHash, nil
+}
+
+// GetHeight returns the block height the view started at
+func (this *GovernanceView) GetHeight() uint32 {
+	return this.Height
+}
+
+// IsStale reports whether the view started more than maxAge blocks before
+// currentHeight
+func (this *GovernanceView) IsStale(currentHeight uint32, maxAge uint32) bool {
+	return currentHeight > this.Height && currentHeight-this.Height > maxAge
+}
+
 type TotalStake struct {
 	Address    common.Address
 	Stake      uint64
@@ -419,6 +818,7 @@ func (this *PenaltyStake) Deserialize(r io.Reader) error {
 }
 
 type CandidateSplitInfo struct {
+	Index      uint32
 	PeerPubkey string
 	Address    common.Address
 	InitPos    uint64
@@ -426,9 +826,41 @@ type CandidateSplitInfo struct {
 	S          uint64
 }
 
+func (this *CandidateSplitInfo) stakeInfo() *PeerStakeInfo {
+	return &PeerStakeInfo{
+		Index:      this.Index,
+		PeerPubkey: this.PeerPubkey,
+		Stake:      this.Stake,
+	}
+}
+
 type SyncNodeSplitInfo struct {
 	PeerPubkey string
 	Address    common.Address
 	InitPos    uint64
 	S          uint64
 }
+
+type PayoutReason uint8
+
+const (
+	ConsensusFeePayout PayoutReason = iota
+	CandidateFeePayout
+)
+
+func (this PayoutReason) String() string {
+	switch this {
+	case ConsensusFeePayout:
+		return "ConsensusFee"
+	case CandidateFeePayout:
+		return "CandidateFee"
+	}
+	return fmt.Sprintf("PayoutReason(%d)", uint8(this))
+}
+
+// Payout is one ong transfer of a fee split plan
+type Payout struct {
+	Address common.Address
+	Amount  uint64
+	Reason  PayoutReason
+}
@@ -0,0 +1,611 @@
+/*
+ * Copyright (C) 2018 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package governance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ontio/ontology/common"
+	"github.com/ontio/ontology/common/serialization"
+	"github.com/ontio/ontology/errors"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+func TestPeerStakeInfoJSON(t *testing.T) {
+	peer := &PeerStakeInfo{Index: 3, PeerPubkey: "02abcd", Stake: 1 << 60}
+	data, err := json.Marshal(peer)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if string(data) != `{"index":3,"peer_pubkey":"02abcd","stake":1152921504606846976}` {
+		t.Errorf("unexpected json: %s", data)
+	}
+	decoded := new(PeerStakeInfo)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	if *decoded != *peer {
+		t.Errorf("expected %v, got %v", peer, decoded)
+	}
+}
+
+func TestDposTableSnapshotJSON(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	if err := putConfig(native, contract, testConfiguration()); err != nil {
+		t.Fatalf("putConfig failed: %s", err)
+	}
+	governanceView := &GovernanceView{View: 2, Height: 1000, TxHash: common.Uint256{9, 8, 7}}
+	if err := putGovernanceView(native, contract, governanceView); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	peerPoolMap := testPeerPoolMap(0, 70000, 60000, 50000, 40000, 30000, 20000, 10000, 5000)
+	for _, item := range peerPoolMap.PeerPoolMap {
+		if item.Index == 8 {
+			item.Status = QuitingStatus
+		}
+	}
+	if err := putPeerPoolMap(native, contract, 2, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+
+	snapshot, err := GetDposTableSnapshot(native, contract)
+	if err != nil {
+		t.Fatalf("GetDposTableSnapshot failed: %s", err)
+	}
+	if snapshot.View != 2 || snapshot.Height != 1000 || len(snapshot.Peers) != 7 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	chainPeers, posTable, err := CalDposTableWithSeed(governanceView.TxHash, 1000, testConfiguration(), snapshot.Peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(snapshot.ChainPeers, chainPeers) || !reflect.DeepEqual(snapshot.PosTable, posTable) {
+		t.Errorf("snapshot does not match the dpos table")
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	for _, field := range []string{`"view"`, `"height"`, `"tx_hash"`, `"peers"`, `"chain_peers"`, `"pos_table"`, `"peer_pubkey"`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("json has no field %s", field)
+		}
+	}
+	decoded := new(DposTableSnapshot)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, snapshot) {
+		t.Errorf("json round trip changed the snapshot")
+	}
+}
+
+func TestPeersByStatus(t *testing.T) {
+	items := []*PeerPoolItem{
+		{Index: 5, PeerPubkey: "05", Status: CandidateStatus},
+		{Index: 2, PeerPubkey: "02", Status: ConsensusStatus},
+		{Index: 3, PeerPubkey: "03", Status: CandidateStatus},
+		{Index: 1, PeerPubkey: "01", Status: CandidateStatus},
+		{Index: 4, PeerPubkey: "04", Status: QuitingStatus},
+	}
+	for round := 0; round < 10; round++ {
+		peerPoolMap := &PeerPoolMap{PeerPoolMap: make(map[string]*PeerPoolItem)}
+		for i := range items {
+			item := items[(i+round)%len(items)]
+			peerPoolMap.PeerPoolMap[item.PeerPubkey] = item
+		}
+		var indexes []uint32
+		for _, item := range peerPoolMap.PeersByStatus(CandidateStatus) {
+			indexes = append(indexes, item.Index)
+		}
+		if !reflect.DeepEqual(indexes, []uint32{1, 3, 5}) {
+			t.Fatalf("round %d: candidates %v, want [1 3 5]", round, indexes)
+		}
+		if peers := peerPoolMap.PeersByStatus(BlackStatus); len(peers) != 0 {
+			t.Fatalf("round %d: unexpected black peers %v", round, peers)
+		}
+	}
+}
+
+func TestPeerPoolMapTotalStake(t *testing.T) {
+	peerPoolMap := &PeerPoolMap{
+		PeerPoolMap: map[string]*PeerPoolItem{
+			"01": {Index: 1, Status: ConsensusStatus, InitPos: 100, TotalPos: 10},
+			"02": {Index: 2, Status: CandidateStatus, InitPos: 200, TotalPos: 20},
+			"03": {Index: 3, Status: RegisterCandidateStatus, InitPos: 300},
+			"04": {Index: 4, Status: QuitConsensusStatus, InitPos: 400, TotalPos: 40},
+			"05": {Index: 5, Status: QuitingStatus, InitPos: 500},
+			"06": {Index: 6, Status: BlackStatus, InitPos: 600, TotalPos: 60},
+		},
+	}
+	sum, err := peerPoolMap.TotalStake(false)
+	if err != nil || sum != 630 {
+		t.Errorf("TotalStake(false) = %d, %v, want 630", sum, err)
+	}
+	sum, err = peerPoolMap.TotalStake(true)
+	if err != nil || sum != 2230 {
+		t.Errorf("TotalStake(true) = %d, %v, want 2230", sum, err)
+	}
+
+	peerPoolMap.PeerPoolMap["07"] = &PeerPoolItem{Index: 7, Status: QuitingStatus, InitPos: math.MaxUint64}
+	if _, err := peerPoolMap.TotalStake(false); err != nil {
+		t.Errorf("TotalStake(false) should skip the quitting peer: %s", err)
+	}
+	if _, err := peerPoolMap.TotalStake(true); err == nil {
+		t.Error("TotalStake(true) should overflow")
+	}
+	peerPoolMap.PeerPoolMap["08"] = &PeerPoolItem{Index: 8, Status: ConsensusStatus, InitPos: 1, TotalPos: math.MaxUint64}
+	if _, err := peerPoolMap.TotalStake(false); err == nil {
+		t.Error("TotalStake(false) should overflow on a single item")
+	}
+}
+
+func TestPeerPoolMapRemovePeer(t *testing.T) {
+	peerPoolMap := testPeerPoolMap(1, 800, 700, 600, 500, 400, 300, 200, 100, 50)
+	peerPoolMap.PeerPoolMap[testPubkey(9)].Status = CandidateStatus
+
+	if err := peerPoolMap.RemovePeer(testPubkey(9), 7, false); err != nil {
+		t.Fatalf("removing a candidate failed: %s", err)
+	}
+	if _, ok := peerPoolMap.PeerPoolMap[testPubkey(9)]; ok {
+		t.Error("candidate is still in the peer pool")
+	}
+	if err := peerPoolMap.RemovePeer(testPubkey(9), 7, false); err == nil {
+		t.Error("removing a missing peer should fail")
+	}
+
+	if err := peerPoolMap.RemovePeer(testPubkey(1), 7, false); err == nil {
+		t.Error("removing a consensus peer should fail unless allowed")
+	}
+	if err := peerPoolMap.RemovePeer(testPubkey(1), 7, true); err != nil {
+		t.Fatalf("removing the eighth consensus peer failed: %s", err)
+	}
+	if err := peerPoolMap.RemovePeer(testPubkey(2), 7, true); err == nil {
+		t.Error("removing a consensus peer below K should fail")
+	}
+	if len(peerPoolMap.PeerPoolMap) != 7 {
+		t.Errorf("expected 7 peers left, got %d", len(peerPoolMap.PeerPoolMap))
+	}
+}
+
+func TestGovernanceViewAccessors(t *testing.T) {
+	governanceView := &GovernanceView{View: 3, Height: 1000}
+	if _, err := governanceView.GetTxHash(); err == nil {
+		t.Error("GetTxHash should fail on an empty tx hash")
+	}
+	governanceView.TxHash = common.Uint256{1}
+	if txHash, err := governanceView.GetTxHash(); err != nil || txHash != (common.Uint256{1}) {
+		t.Errorf("GetTxHash = %x, %v", txHash, err)
+	}
+	if governanceView.GetHeight() != 1000 {
+		t.Errorf("GetHeight = %d, want 1000", governanceView.GetHeight())
+	}
+
+	vectors := []struct {
+		current, maxAge uint32
+		stale           bool
+	}{
+		{900, 10, false},
+		{1000, 0, false},
+		{1001, 0, true},
+		{1010, 10, false},
+		{1011, 10, true},
+		{math.MaxUint32, math.MaxUint32, false},
+	}
+	for _, v := range vectors {
+		if stale := governanceView.IsStale(v.current, v.maxAge); stale != v.stale {
+			t.Errorf("IsStale(%d, %d) = %v, want %v", v.current, v.maxAge, stale, v.stale)
+		}
+	}
+}
+
+func randomPeerPoolMap(r *rand.Rand) *PeerPoolMap {
+	peerPoolMap := &PeerPoolMap{PeerPoolMap: make(map[string]*PeerPoolItem)}
+	if r.Intn(2) == 1 {
+		peerPoolMap.Version = 1
+		peerPoolMap.View = r.Uint32()
+	}
+	n := r.Intn(20)
+	for i := 0; i < n; i++ {
+		item := &PeerPoolItem{
+			Index:    r.Uint32(),
+			Status:   Status(r.Intn(256)),
+			InitPos:  uint64(r.Int63()) << 1,
+			TotalPos: uint64(r.Int63()),
+		}
+		pubkey := make([]byte, r.Intn(300))
+		r.Read(pubkey)
+		item.PeerPubkey = fmt.Sprintf("%x", pubkey)
+		r.Read(item.Address[:])
+		peerPoolMap.PeerPoolMap[item.PeerPubkey] = item
+	}
+	return peerPoolMap
+}
+
+func checkPeerPoolMapBlob(t *testing.T, data []byte) {
+	defer func() {
+		if e := recover(); e != nil {
+			t.Fatalf("Deserialize panicked on %x: %v", data, e)
+		}
+	}()
+	peerPoolMap := new(PeerPoolMap)
+	if err := peerPoolMap.Deserialize(bytes.NewBuffer(data)); err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := peerPoolMap.Serialize(buf); err != nil {
+		t.Fatalf("Serialize of decoded %x failed: %s", data, err)
+	}
+	decoded := new(PeerPoolMap)
+	if err := decoded.Deserialize(buf); err != nil {
+		t.Fatalf("Deserialize of re-encoded %x failed: %s", data, err)
+	}
+	if !reflect.DeepEqual(decoded, peerPoolMap) {
+		t.Fatalf("round trip of %x changed the map", data)
+	}
+}
+
+func TestPeerPoolMapSerializationRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		peerPoolMap := randomPeerPoolMap(r)
+		buf := new(bytes.Buffer)
+		if err := peerPoolMap.Serialize(buf); err != nil {
+			t.Fatalf("Serialize failed: %s", err)
+		}
+		decoded := new(PeerPoolMap)
+		if err := decoded.Deserialize(buf); err != nil {
+			t.Fatalf("Deserialize failed: %s", err)
+		}
+		if !reflect.DeepEqual(decoded, peerPoolMap) {
+			t.Fatalf("round %d: round trip changed the map", i)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("round %d: %d bytes left after Deserialize", i, buf.Len())
+		}
+	}
+}
+
+func TestPeerPoolMapVersionBytes(t *testing.T) {
+	item := []byte{0x02, 0x00, 0x00, 0x00, 0x02, 'a', 'b'}
+	item = append(item, make([]byte, 20)...)
+	item = append(item, byte(ConsensusStatus))
+	item = append(item, 0x10, 0x27, 0, 0, 0, 0, 0, 0, 0x05, 0, 0, 0, 0, 0, 0, 0)
+	want := &PeerPoolItem{Index: 2, PeerPubkey: "ab", Status: ConsensusStatus, InitPos: 10000, TotalPos: 5}
+
+	legacy := append([]byte{0x01, 0x00, 0x00, 0x00}, item...)
+	versioned := append([]byte{0xff, 0xff, 0xff, 0xff, PEER_POOL_MAP_VERSION, 0x07, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00}, item...)
+	vectors := []struct {
+		data    []byte
+		version uint8
+		view    uint32
+	}{
+		{legacy, 0, 0},
+		{versioned, PEER_POOL_MAP_VERSION, 7},
+	}
+	for _, v := range vectors {
+		peerPoolMap := new(PeerPoolMap)
+		if err := peerPoolMap.Deserialize(bytes.NewBuffer(v.data)); err != nil {
+			t.Fatalf("version %d: Deserialize failed: %s", v.version, err)
+		}
+		if peerPoolMap.Version != v.version || peerPoolMap.View != v.view {
+			t.Errorf("version %d: got version %d, view %d", v.version, peerPoolMap.Version, peerPoolMap.View)
+		}
+		if !reflect.DeepEqual(peerPoolMap.PeerPoolMap, map[string]*PeerPoolItem{"ab": want}) {
+			t.Errorf("version %d: unexpected items %v", v.version, peerPoolMap.PeerPoolMap)
+		}
+		buf := new(bytes.Buffer)
+		if err := peerPoolMap.Serialize(buf); err != nil {
+			t.Fatalf("version %d: Serialize failed: %s", v.version, err)
+		}
+		if !bytes.Equal(buf.Bytes(), v.data) {
+			t.Errorf("version %d: re-encoded %x, want %x", v.version, buf.Bytes(), v.data)
+		}
+	}
+
+	unknown := append([]byte(nil), versioned...)
+	unknown[4] = PEER_POOL_MAP_VERSION + 1
+	if err := new(PeerPoolMap).Deserialize(bytes.NewBuffer(unknown)); err == nil {
+		t.Error("Deserialize should reject an unknown version")
+	}
+	if err := (&PeerPoolMap{Version: PEER_POOL_MAP_VERSION + 1}).Serialize(new(bytes.Buffer)); err == nil {
+		t.Error("Serialize should reject an unknown version")
+	}
+}
+
+func TestPeerPoolItemMetadata(t *testing.T) {
+	item := []byte{0x02, 0x00, 0x00, 0x00, 0x02, 'a', 'b'}
+	item = append(item, make([]byte, 20)...)
+	item = append(item, byte(ConsensusStatus))
+	item = append(item, 0x10, 0x27, 0, 0, 0, 0, 0, 0, 0x05, 0, 0, 0, 0, 0, 0, 0)
+
+	legacy := new(PeerPoolItem)
+	if err := legacy.Deserialize(bytes.NewBuffer(item)); err != nil {
+		t.Fatalf("legacy: Deserialize failed: %s", err)
+	}
+	if name, endpoint := legacy.Metadata(); legacy.Version != 0 || name != "" || endpoint != "" {
+		t.Errorf("legacy: got version %d, name %q, endpoint %q", legacy.Version, name, endpoint)
+	}
+	if !bytes.Equal(serialization.ToArray(legacy), item) {
+		t.Errorf("legacy: re-encoded %x, want %x", serialization.ToArray(legacy), item)
+	}
+
+	versioned := append([]byte{0xff, 0xff, 0xff, 0xff, PEER_POOL_ITEM_VERSION}, item...)
+	versioned = append(versioned, 0x04, 'n', 'o', 'd', 'e', 0x06, '0', '1', '0', '2', '0', '3')
+	peerPoolItem := new(PeerPoolItem)
+	if err := peerPoolItem.Deserialize(bytes.NewBuffer(versioned)); err != nil {
+		t.Fatalf("versioned: Deserialize failed: %s", err)
+	}
+	want := &PeerPoolItem{Index: 2, PeerPubkey: "ab", Status: ConsensusStatus, InitPos: 10000, TotalPos: 5,
+		Version: PEER_POOL_ITEM_VERSION, Name: "node", Endpoint: "010203"}
+	if !reflect.DeepEqual(peerPoolItem, want) {
+		t.Errorf("versioned: got %+v", peerPoolItem)
+	}
+	if !bytes.Equal(serialization.ToArray(peerPoolItem), versioned) {
+		t.Errorf("versioned: re-encoded %x, want %x", serialization.ToArray(peerPoolItem), versioned)
+	}
+
+	// a map of legacy and versioned items still decodes item by item
+	peerPoolMap := new(PeerPoolMap)
+	mixed := append([]byte{0x02, 0x00, 0x00, 0x00}, versioned...)
+	mixed = append(mixed, 0x03, 0x00, 0x00, 0x00, 0x02, 'c', 'd')
+	mixed = append(mixed, item[7:]...)
+	if err := peerPoolMap.Deserialize(bytes.NewBuffer(mixed)); err != nil {
+		t.Fatalf("mixed: Deserialize failed: %s", err)
+	}
+	if len(peerPoolMap.PeerPoolMap) != 2 || peerPoolMap.PeerPoolMap["ab"].Name != "node" ||
+		peerPoolMap.PeerPoolMap["cd"].Version != 0 {
+		t.Errorf("mixed: unexpected items %v", peerPoolMap.PeerPoolMap)
+	}
+
+	if err := legacy.SetMetadata(strings.Repeat("x", MAX_PEER_NAME_LEN+1), ""); err == nil {
+		t.Error("SetMetadata should reject a long name")
+	}
+	if err := legacy.SetMetadata("x", strings.Repeat("0", MAX_PEER_ENDPOINT_LEN+1)); err == nil {
+		t.Error("SetMetadata should reject a long endpoint")
+	}
+	if legacy.Version != 0 {
+		t.Error("SetMetadata changed the item on error")
+	}
+	if err := legacy.SetMetadata("node", "010203"); err != nil {
+		t.Fatalf("SetMetadata failed: %s", err)
+	}
+	if !bytes.Equal(serialization.ToArray(legacy), versioned) {
+		t.Errorf("SetMetadata: encoded %x, want %x", serialization.ToArray(legacy), versioned)
+	}
+	if err := (&PeerPoolItem{Name: "node"}).Serialize(new(bytes.Buffer)); err == nil {
+		t.Error("Serialize should reject metadata on a legacy item")
+	}
+	if err := (&PeerPoolItem{Index: math.MaxUint32}).Serialize(new(bytes.Buffer)); err == nil {
+		t.Error("Serialize should reject the reserved index")
+	}
+}
+
+func TestPeerPoolMapDeserializeRandomBytes(t *testing.T) {
+	// seed corpus: a legacy blob and a versioned blob of a real peer pool
+	var corpus [][]byte
+	for _, version := range []uint8{0, 1} {
+		peerPoolMap := testPeerPoolMap(7, 1000, 2000, 3000, 4000, 5000, 6000, 7000)
+		peerPoolMap.Version = version
+		buf := new(bytes.Buffer)
+		if err := peerPoolMap.Serialize(buf); err != nil {
+			t.Fatalf("Serialize failed: %s", err)
+		}
+		corpus = append(corpus, buf.Bytes())
+	}
+	corpus = append(corpus,
+		nil,
+		[]byte{0xff, 0xff, 0xff, 0xff},
+		[]byte{0xff, 0xff, 0xff, 0xff, 0x02},
+		[]byte{0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	)
+
+	r := rand.New(rand.NewSource(1))
+	for _, seed := range corpus {
+		checkPeerPoolMapBlob(t, seed)
+		for i := 0; i < 500; i++ {
+			data := append([]byte(nil), seed...)
+			switch r.Intn(3) {
+			case 0:
+				if len(data) > 0 {
+					data = data[:r.Intn(len(data))]
+				}
+			case 1:
+				for j := r.Intn(4); j >= 0 && len(data) > 0; j-- {
+					data[r.Intn(len(data))] = byte(r.Intn(256))
+				}
+			case 2:
+				extra := make([]byte, r.Intn(64))
+				r.Read(extra)
+				data = append(data, extra...)
+			}
+			checkPeerPoolMapBlob(t, data)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, r.Intn(128))
+		r.Read(data)
+		checkPeerPoolMapBlob(t, data)
+	}
+}
+
+func TestPeerPoolItemAddPos(t *testing.T) {
+	item := &PeerPoolItem{InitPos: 100, TotalPos: 200}
+	if err := item.AddInitPos(50); err != nil || item.InitPos != 150 {
+		t.Fatalf("AddInitPos = %d, %v, want 150", item.InitPos, err)
+	}
+	if err := item.AddTotalPos(math.MaxUint64 - 200); err != nil || item.TotalPos != math.MaxUint64 {
+		t.Fatalf("AddTotalPos = %d, %v, want MaxUint64", item.TotalPos, err)
+	}
+
+	if err := item.AddInitPos(math.MaxUint64); errors.RootErr(err) != ErrStakeOverflow {
+		t.Errorf("AddInitPos past MaxUint64 returned %v, want ErrStakeOverflow", err)
+	}
+	if item.InitPos != 150 {
+		t.Errorf("InitPos changed to %d on overflow", item.InitPos)
+	}
+	if err := item.AddTotalPos(1); errors.RootErr(err) != ErrStakeOverflow {
+		t.Errorf("AddTotalPos past MaxUint64 returned %v, want ErrStakeOverflow", err)
+	}
+	if item.TotalPos != math.MaxUint64 {
+		t.Errorf("TotalPos changed to %d on overflow", item.TotalPos)
+	}
+	if err := item.AddTotalPos(0); err != nil {
+		t.Errorf("AddTotalPos(0) failed: %s", err)
+	}
+}
+
+func TestStatusString(t *testing.T) {
+	names := map[Status]string{
+		RegisterCandidateStatus: "RegisterCandidate",
+		CandidateStatus:         "Candidate",
+		ConsensusStatus:         "Consensus",
+		QuitConsensusStatus:     "QuitConsensus",
+		QuitingStatus:           "Quiting",
+		BlackStatus:             "Black",
+		Status(6):               "Status(6)",
+	}
+	for status, name := range names {
+		if status.String() != name {
+			t.Errorf("Status %d prints %q, want %q", int(status), status.String(), name)
+		}
+	}
+	// the encoding is unaffected
+	item := &PeerPoolItem{Status: ConsensusStatus}
+	if data, err := json.Marshal(item); err != nil || !strings.Contains(string(data), `"Status":2`) {
+		t.Errorf("json encoding changed: %s, %v", data, err)
+	}
+}
+
+func TestPeerPoolItemEffectiveStake(t *testing.T) {
+	self := &PeerPoolItem{InitPos: 10000}
+	if stake, err := self.EffectiveStake(); err != nil || stake != 10000 {
+		t.Errorf("self staked peer: got %d, %v, want 10000, nil", stake, err)
+	}
+	delegated := &PeerPoolItem{InitPos: 10000, TotalPos: 25000}
+	if stake, err := delegated.EffectiveStake(); err != nil || stake != 35000 {
+		t.Errorf("delegated peer: got %d, %v, want 35000, nil", stake, err)
+	}
+	overflow := &PeerPoolItem{InitPos: math.MaxUint64, TotalPos: 1}
+	if _, err := overflow.EffectiveStake(); errors.RootErr(err) != ErrStakeOverflow {
+		t.Errorf("expected ErrStakeOverflow, got %v", err)
+	}
+}
+
+func TestPeerStake(t *testing.T) {
+	delegated := &PeerPoolItem{InitPos: 10000, TotalPos: 25000}
+	overflow := &PeerPoolItem{InitPos: math.MaxUint64, TotalPos: 1}
+	if stake, err := PeerStake(delegated, 100); err != nil || stake != 35000 {
+		t.Errorf("delegated peer: got %d, %v, want 35000, nil", stake, err)
+	}
+	if stake, err := PeerStake(overflow, 100); err != nil || stake != 0 {
+		t.Errorf("overflow before STAKE_OVERFLOW_HEIGHT: got %d, %v, want 0, nil", stake, err)
+	}
+	defer func(height uint32) { STAKE_OVERFLOW_HEIGHT = height }(STAKE_OVERFLOW_HEIGHT)
+	STAKE_OVERFLOW_HEIGHT = 100
+	if stake, err := PeerStake(delegated, 100); err != nil || stake != 35000 {
+		t.Errorf("delegated peer: got %d, %v, want 35000, nil", stake, err)
+	}
+	if _, err := PeerStake(overflow, 100); errors.RootErr(err) != ErrStakeOverflow {
+		t.Errorf("expected ErrStakeOverflow, got %v", err)
+	}
+}
+
+func TestPeerPoolMapForEachSorted(t *testing.T) {
+	peerPoolMap := testPeerPoolMap(0, 500, 400, 300, 200, 100, 600, 700, 800)
+	for i := 0; i < 10; i++ {
+		var order []uint32
+		err := peerPoolMap.ForEachSorted(func(index uint32, item *PeerPoolItem) error {
+			if item.Index != index {
+				t.Errorf("callback got index %d for item %d", index, item.Index)
+			}
+			order = append(order, index)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ForEachSorted failed: %s", err)
+		}
+		if !reflect.DeepEqual(order, []uint32{1, 2, 3, 4, 5, 6, 7, 8}) {
+			t.Fatalf("callback order %v", order)
+		}
+	}
+
+	stop := errors.NewErr("stop")
+	var visited []uint32
+	err := peerPoolMap.ForEachSorted(func(index uint32, item *PeerPoolItem) error {
+		visited = append(visited, index)
+		if index == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("ForEachSorted returned %v, want the callback error", err)
+	}
+	if !reflect.DeepEqual(visited, []uint32{1, 2, 3}) {
+		t.Errorf("visited %v after the error, want [1 2 3]", visited)
+	}
+}
+
+func TestSerializePeerStakeInfos(t *testing.T) {
+	for _, peers := range [][]*PeerStakeInfo{
+		{},
+		testPeers(70000, 60000, 0, math.MaxUint64),
+		{{Index: math.MaxUint32, PeerPubkey: "", Stake: 1}},
+	} {
+		data, err := SerializePeerStakeInfos(peers)
+		if err != nil {
+			t.Fatalf("SerializePeerStakeInfos failed: %s", err)
+		}
+		decoded, err := DeserializePeerStakeInfos(data)
+		if err != nil {
+			t.Fatalf("DeserializePeerStakeInfos failed: %s", err)
+		}
+		if !reflect.DeepEqual(decoded, peers) {
+			t.Errorf("round trip of %d peers changed them", len(peers))
+		}
+	}
+	if data, err := SerializePeerStakeInfos(nil); err != nil || !bytes.Equal(data, []byte{0, 0, 0, 0}) {
+		t.Errorf("nil slice encoded as %x, %v", data, err)
+	}
+
+	data, err := SerializePeerStakeInfos(testPeers(100, 200))
+	if err != nil {
+		t.Fatalf("SerializePeerStakeInfos failed: %s", err)
+	}
+	if _, err := DeserializePeerStakeInfos(data[:len(data)-1]); err == nil {
+		t.Error("truncated data accepted")
+	}
+	if _, err := DeserializePeerStakeInfos(append(data, 0)); err == nil {
+		t.Error("trailing data accepted")
+	}
+	if _, err := SerializePeerStakeInfos([]*PeerStakeInfo{nil}); err == nil {
+		t.Error("nil peer accepted")
+	}
+}
@@ -20,8 +20,24 @@ package governance
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ontio/ontology-crypto/ec"
+	"github.com/ontio/ontology-crypto/keypair"
 	"github.com/ontio/ontology-crypto/vrf"
 	"github.com/ontio/ontology/common"
 	"github.com/ontio/ontology/common/config"
@@ -30,547 +46,3044 @@ import (
 	cstates "github.com/ontio/ontology/core/states"
 	scommon "github.com/ontio/ontology/core/store/common"
 	"github.com/ontio/ontology/errors"
+	"github.com/ontio/ontology/smartcontract/event"
 	"github.com/ontio/ontology/smartcontract/service/native"
 	"github.com/ontio/ontology/smartcontract/service/native/auth"
 	"github.com/ontio/ontology/smartcontract/service/native/ont"
 	"github.com/ontio/ontology/smartcontract/service/native/utils"
+	"github.com/ontio/ontology/smartcontract/storage"
 	"github.com/ontio/ontology/vm/neovm/types"
+	"golang.org/x/crypto/sha3"
 )
 
 func GetPeerPoolMap(native *native.NativeService, contract common.Address, view uint32) (*PeerPoolMap, error) {
+	peerPoolMap, err := loadPeerPoolMap(native, contract, view)
+	if err != nil {
+		return nil, err
+	}
+	if peerPoolMap == nil {
+		return nil, errors.NewErr("getPeerPoolMap, peerPoolMap is nil!")
+	}
+	return peerPoolMap, nil
+}
+
+// GetPeerPoolMapWithSize is GetPeerPoolMap which also returns the stored size
+// of the peer pool in bytes: the PeerPoolMap blob length, or for views stored
+// per item the total length of the item values.
+func GetPeerPoolMapWithSize(native *native.NativeService, contract common.Address, view uint32) (*PeerPoolMap, int, error) {
+	peerPoolMap, size, err := loadPeerPoolMapWithSize(native, contract, view)
+	if err != nil {
+		return nil, 0, err
+	}
+	if peerPoolMap == nil {
+		return nil, 0, errors.NewErr("getPeerPoolMap, peerPoolMap is nil!")
+	}
+	return peerPoolMap, size, nil
+}
+
+// ListStoredViews returns the views with peer pool data in storage in
+// ascending order, whether stored as one PeerPoolMap blob or per item. As it
+// scans with iteratePrefix, views written or deleted earlier in the same
+// transaction are seen as such. Keys under PEER_POOL which do not decode to
+// a view are skipped.
+func ListStoredViews(native *native.NativeService, contract common.Address) ([]uint32, error) {
+	prefix := utils.ConcatKey(contract, []byte(PEER_POOL))
+	seen := make(map[uint32]bool)
+	views := make([]uint32, 0)
+	err := iteratePrefix(native, prefix, func(key, value []byte) error {
+		suffix := key[len(prefix):]
+		// view for a blob, view and index for an item, anything else
+		// (e.g. PEER_POOL_INDEX keys sharing the prefix) is not a view
+		if len(suffix) != 4 && len(suffix) != 8 {
+			return nil
+		}
+		view, err := GetBytesUint32(suffix[:4])
+		if err != nil {
+			return nil
+		}
+		if !seen[view] {
+			seen[view] = true
+			views = append(views, view)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "iteratePrefix, find peerPool keys error!")
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i] < views[j] })
+	return views, nil
+}
+
+// iteratePrefix calls fn with every storage key starting with prefix and its
+// value, in key order, and stops at the first error fn returns. Writes not
+// yet committed from native.CloneCache shadow the store and deleted keys are
+// skipped. Store.Find releases its iterator before returning, so nothing is
+// left open when fn fails.
+func iteratePrefix(native *native.NativeService, prefix []byte, fn func(key, value []byte) error) error {
+	stateValues, err := native.CloneCache.Store.Find(scommon.ST_STORAGE, prefix)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Store.Find, find keys error!")
+	}
+	items := make(map[string][]byte)
+	for _, v := range stateValues {
+		if !strings.HasPrefix(v.Key, string(prefix)) {
+			continue
+		}
+		item, ok := v.Value.(*cstates.StorageItem)
+		if !ok {
+			return fmt.Errorf("iteratePrefix, value of key %x is not available!", v.Key)
+		}
+		items[v.Key] = item.Value
+	}
+	for _, v := range native.CloneCache.Memory {
+		if v.Prefix != scommon.ST_STORAGE || !strings.HasPrefix(v.Key, string(prefix)) {
+			continue
+		}
+		if v.State == scommon.Deleted {
+			delete(items, v.Key)
+			continue
+		}
+		item, ok := v.Value.(*cstates.StorageItem)
+		if !ok {
+			return fmt.Errorf("iteratePrefix, value of key %x is not available!", v.Key)
+		}
+		items[v.Key] = item.Value
+	}
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn([]byte(key), items[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPeerPoolMapRange returns the peer pool maps of views [startView, endView],
+// keyed by view. Views without a stored peer pool map are skipped. ctx is
+// checked before each view is read, ctx.Err() is returned once it is done.
+func GetPeerPoolMapRange(ctx context.Context, native *native.NativeService, contract common.Address,
+	startView, endView uint32) (map[uint32]*PeerPoolMap, error) {
+	if startView > endView {
+		return nil, errors.NewErr("getPeerPoolMapRange, startView is larger than endView!")
+	}
+	peerPoolMaps := make(map[uint32]*PeerPoolMap)
+	for view := startView; ; view++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		peerPoolMap, err := loadPeerPoolMap(native, contract, view)
+		if err != nil {
+			return nil, err
+		}
+		if peerPoolMap != nil {
+			peerPoolMaps[view] = peerPoolMap
+		}
+		if view == endView {
+			break
+		}
+	}
+	return peerPoolMaps, nil
+}
+
+// GetPeerPoolItemsPaged returns at most limit peer pool items of view starting
+// at offset, together with the total number of items. Items are ordered by
+// PeerPubkey descending, or by EffectiveStake descending if sortByStake is
+// set, ties broken by PeerPubkey descending. A stake which overflows fails
+// the sorted query.
+func GetPeerPoolItemsPaged(native *native.NativeService, contract common.Address, view uint32, offset, limit int,
+	sortByStake bool) ([]*PeerPoolItem, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, errors.NewErr("getPeerPoolItemsPaged, offset and limit must not be negative!")
+	}
+	peerPoolMap, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
+	}
+	items := make([]*PeerPoolItem, 0, len(peerPoolMap.PeerPoolMap))
+	stakes := make(map[string]uint64, len(peerPoolMap.PeerPoolMap))
+	for _, item := range peerPoolMap.PeerPoolMap {
+		items = append(items, item)
+		if sortByStake {
+			stake, err := item.EffectiveStake()
+			if err != nil {
+				return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolItemsPaged, stake of peer overflows!")
+			}
+			stakes[item.PeerPubkey] = stake
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if sortByStake {
+			si, sj := stakes[items[i].PeerPubkey], stakes[items[j].PeerPubkey]
+			if si != sj {
+				return si > sj
+			}
+		}
+		return items[i].PeerPubkey > items[j].PeerPubkey
+	})
+
+	total := len(items)
+	if offset >= total {
+		return []*PeerPoolItem{}, total, nil
+	}
+	end := total
+	if limit < total-offset {
+		end = offset + limit
+	}
+	return items[offset:end], total, nil
+}
+
+// loadPeerPoolMap returns nil, nil if no peer pool map is stored for view
+func loadPeerPoolMap(native *native.NativeService, contract common.Address, view uint32) (*PeerPoolMap, error) {
+	peerPoolMap, _, err := loadPeerPoolMapWithSize(native, contract, view)
+	return peerPoolMap, err
+}
+
+func loadPeerPoolMapWithSize(native *native.NativeService, contract common.Address, view uint32) (*PeerPoolMap, int, error) {
 	peerPoolMap := &PeerPoolMap{
 		PeerPoolMap: make(map[string]*PeerPoolItem),
 	}
-	viewBytes, err := GetUint32Bytes(view)
+	// migrating a view deletes its blob, so the index list is only read for
+	// views without one
+	key, err := peerPoolKey(contract, view)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, getUint32Bytes error!")
+		return nil, 0, err
 	}
-	peerPoolMapBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes))
+	peerPoolMapBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, key)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get all peerPoolMap error!")
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get all peerPoolMap error!")
 	}
 	if peerPoolMapBytes == nil {
-		return nil, errors.NewErr("getPeerPoolMap, peerPoolMap is nil!")
+		indexes, migrated, err := getPeerPoolIndexes(native, contract, view)
+		if err != nil {
+			return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
+		}
+		if !migrated {
+			return nil, 0, nil
+		}
+		size := 0
+		for _, index := range indexes {
+			peerPoolItem, err := loadPeerPoolItem(native, contract, view, index)
+			if err != nil {
+				return nil, 0, err
+			}
+			if peerPoolItem == nil {
+				return nil, 0, fmt.Errorf("getPeerPoolMap, peerPoolItem %d of view %d is missing", index, view)
+			}
+			peerPoolMap.PeerPoolMap[peerPoolItem.PeerPubkey] = peerPoolItem
+			// items are stored as their serialization, no need to read them again
+			size += len(serialization.ToArray(peerPoolItem))
+		}
+		return peerPoolMap, size, nil
 	}
 	peerPoolMapStore, ok := peerPoolMapBytes.(*cstates.StorageItem)
 	if !ok {
-		return nil, errors.NewErr("getPeerPoolMap, peerPoolMapBytes is not available!")
+		return nil, 0, errors.NewErr("getPeerPoolMap, peerPoolMapBytes is not available!")
 	}
 	if err := peerPoolMap.Deserialize(bytes.NewBuffer(peerPoolMapStore.Value)); err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize peerPoolMap error!")
+		return nil, 0, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize peerPoolMap error!")
 	}
-	return peerPoolMap, nil
+	if peerPoolMap.Version >= 1 && peerPoolMap.View != view {
+		return nil, 0, fmt.Errorf("getPeerPoolMap, peerPoolMap stored under view %d is of view %d!", view, peerPoolMap.View)
+	}
+	return peerPoolMap, len(peerPoolMapStore.Value), nil
 }
 
 func putPeerPoolMap(native *native.NativeService, contract common.Address, view uint32, peerPoolMap *PeerPoolMap) error {
+	oldIndexes, migrated, err := getPeerPoolIndexes(native, contract, view)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
+	}
+	if migrated {
+		return putPeerPoolItems(native, contract, view, peerPoolMap, oldIndexes)
+	}
+	if native.Height >= PEER_POOL_VIEW_HEIGHT {
+		peerPoolMap.Version = PEER_POOL_MAP_VERSION
+		peerPoolMap.View = view
+	}
 	bf := new(bytes.Buffer)
 	if err := peerPoolMap.Serialize(bf); err != nil {
 		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize peerPoolMap error!")
 	}
-	viewBytes, err := GetUint32Bytes(view)
+	key, err := peerPoolKey(contract, view)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
+		return err
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes), &cstates.StorageItem{Value: bf.Bytes()})
+	native.CloneCache.Add(scommon.ST_STORAGE, key, &cstates.StorageItem{Value: bf.Bytes()})
 	return nil
 }
 
-func GetGovernanceView(native *native.NativeService, contract common.Address) (*GovernanceView, error) {
-	governanceViewBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GOVERNANCE_VIEW)))
+// putPeerPoolItems stores peerPoolMap per item in view and deletes the items
+// of oldIndexes which are no longer in the map
+func putPeerPoolItems(native *native.NativeService, contract common.Address, view uint32, peerPoolMap *PeerPoolMap,
+	oldIndexes []uint32) error {
+	indexes := make([]uint32, 0, len(peerPoolMap.PeerPoolMap))
+	kept := make(map[uint32]bool, len(peerPoolMap.PeerPoolMap))
+	err := peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if err := storePeerPoolItem(native, contract, view, peerPoolItem); err != nil {
+			return err
+		}
+		indexes = append(indexes, index)
+		kept[index] = true
+		return nil
+	})
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGovernanceView, get governanceViewBytes error!")
+		return err
 	}
-	governanceView := new(GovernanceView)
-	if governanceViewBytes == nil {
-		return nil, errors.NewErr("getGovernanceView, get nil governanceViewBytes!")
-	} else {
-		governanceViewStore, ok := governanceViewBytes.(*cstates.StorageItem)
-		if !ok {
-			return nil, errors.NewErr("getGovernanceView, governanceViewBytes is not available!")
+	// drop items removed from the map
+	for _, index := range oldIndexes {
+		if kept[index] {
+			continue
 		}
-		if err := governanceView.Deserialize(bytes.NewBuffer(governanceViewStore.Value)); err != nil {
-			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize governanceView error!")
+		key, err := peerPoolItemKey(contract, view, index)
+		if err != nil {
+			return err
 		}
+		native.CloneCache.Delete(scommon.ST_STORAGE, key)
 	}
-	return governanceView, nil
+	return putPeerPoolIndexes(native, contract, view, indexes)
 }
 
-func putGovernanceView(native *native.NativeService, contract common.Address, governanceView *GovernanceView) error {
-	bf := new(bytes.Buffer)
-	if err := governanceView.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize governanceView error!")
+// deletePeerPoolMap deletes the peer pool of view, the PeerPoolMap blob or
+// for views stored per item the items and their index list
+func deletePeerPoolMap(native *native.NativeService, contract common.Address, view uint32) error {
+	indexes, migrated, err := getPeerPoolIndexes(native, contract, view)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
+	}
+	if migrated {
+		for _, index := range indexes {
+			key, err := peerPoolItemKey(contract, view, index)
+			if err != nil {
+				return err
+			}
+			native.CloneCache.Delete(scommon.ST_STORAGE, key)
+		}
+		viewBytes, err := GetUint32Bytes(view)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
+		}
+		native.CloneCache.Delete(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL_INDEX), viewBytes))
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GOVERNANCE_VIEW)), &cstates.StorageItem{Value: bf.Bytes()})
+	key, err := peerPoolKey(contract, view)
+	if err != nil {
+		return err
+	}
+	native.CloneCache.Delete(scommon.ST_STORAGE, key)
 	return nil
 }
 
-func GetView(native *native.NativeService, contract common.Address) (uint32, error) {
-	governanceView, err := GetGovernanceView(native, contract)
+// GetPeerPoolItem returns the peer pool item of view with the given index.
+// Views stored per item are read with a single lookup, views still stored as
+// one PeerPoolMap blob fall back to reading the whole map.
+func GetPeerPoolItem(native *native.NativeService, contract common.Address, view uint32, index uint32) (*PeerPoolItem, error) {
+	_, migrated, err := getPeerPoolIndexes(native, contract, view)
 	if err != nil {
-		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getView, getGovernanceView error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
 	}
-	return governanceView.View, nil
-}
-
-func appCallTransferOnt(native *native.NativeService, from common.Address, to common.Address, amount uint64) error {
-	err := appCallTransfer(native, utils.OntContractAddress, from, to, amount)
+	if migrated {
+		peerPoolItem, err := loadPeerPoolItem(native, contract, view, index)
+		if err != nil {
+			return nil, err
+		}
+		if peerPoolItem == nil {
+			return nil, errors.NewErr("getPeerPoolItem, peerPoolItem is nil!")
+		}
+		return peerPoolItem, nil
+	}
+	peerPoolMap, err := GetPeerPoolMap(native, contract, view)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, appCallTransfer error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
 	}
-	return nil
+	var found *PeerPoolItem
+	peerPoolMap.ForEachSorted(func(i uint32, peerPoolItem *PeerPoolItem) error {
+		if found == nil && i == index {
+			found = peerPoolItem
+		}
+		return nil
+	})
+	if found == nil {
+		return nil, errors.NewErr("getPeerPoolItem, peerPoolItem is nil!")
+	}
+	return found, nil
 }
 
-func appCallTransferOng(native *native.NativeService, from common.Address, to common.Address, amount uint64) error {
-	err := appCallTransfer(native, utils.OngContractAddress, from, to, amount)
+// PutPeerPoolItem stores peerPoolItem in view. Views stored per item only
+// write the changed item, views still stored as one blob rewrite the blob.
+func PutPeerPoolItem(native *native.NativeService, contract common.Address, view uint32, peerPoolItem *PeerPoolItem) error {
+	indexes, migrated, err := getPeerPoolIndexes(native, contract, view)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOng, appCallTransfer error!")
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
 	}
-	return nil
+	if migrated {
+		if err := storePeerPoolItem(native, contract, view, peerPoolItem); err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			if index == peerPoolItem.Index {
+				return nil
+			}
+		}
+		return putPeerPoolIndexes(native, contract, view, append(indexes, peerPoolItem.Index))
+	}
+	peerPoolMap, err := loadPeerPoolMap(native, contract, view)
+	if err != nil {
+		return err
+	}
+	if peerPoolMap == nil {
+		peerPoolMap = &PeerPoolMap{
+			PeerPoolMap: make(map[string]*PeerPoolItem),
+		}
+	}
+	peerPoolMap.PeerPoolMap[peerPoolItem.PeerPubkey] = peerPoolItem
+	return putPeerPoolMap(native, contract, view, peerPoolMap)
 }
 
-func appCallTransfer(native *native.NativeService, contract common.Address, from common.Address, to common.Address, amount uint64) error {
-	bf := new(bytes.Buffer)
-	var sts []*ont.State
-	sts = append(sts, &ont.State{
-		From:  from,
-		To:    to,
-		Value: amount,
+// MigratePeerPoolToItems converts the PeerPoolMap blob of view to per item
+// storage and returns the number of migrated items. The index list written
+// last marks the view as migrated, so calling it again is a no-op.
+func MigratePeerPoolToItems(native *native.NativeService, contract common.Address, view uint32) (int, error) {
+	_, migrated, err := getPeerPoolIndexes(native, contract, view)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get peer pool indexes error!")
+	}
+	if migrated {
+		return 0, nil
+	}
+	peerPoolMap, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
+	}
+	indexes := make([]uint32, 0, len(peerPoolMap.PeerPoolMap))
+	err = peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if err := storePeerPoolItem(native, contract, view, peerPoolItem); err != nil {
+			return err
+		}
+		indexes = append(indexes, index)
+		return nil
 	})
-	transfers := &ont.Transfers{
-		States: sts,
+	if err != nil {
+		return 0, err
 	}
-	err := transfers.Serialize(bf)
+	if err := putPeerPoolIndexes(native, contract, view, indexes); err != nil {
+		return 0, err
+	}
+	key, err := peerPoolKey(contract, view)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransfer, transfers.Serialize error!")
+		return 0, err
 	}
+	native.CloneCache.Delete(scommon.ST_STORAGE, key)
+	return len(indexes), nil
+}
 
-	if _, err := native.NativeCall(contract, "transfer", bf.Bytes()); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransfer, appCall error!")
+// peerPoolKey is the key of the PeerPoolMap blob of view:
+// contract || PEER_POOL || view
+func peerPoolKey(contract common.Address, view uint32) ([]byte, error) {
+	viewBytes, err := GetUint32Bytes(view)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
 	}
-	return nil
+	return utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes), nil
 }
 
-func appCallTransferFromOnt(native *native.NativeService, sender common.Address, from common.Address, to common.Address, amount uint64) error {
-	err := appCallTransferFrom(native, utils.OntContractAddress, sender, from, to, amount)
+// posTableKey is the key of the pos table of view:
+// contract || POS_TABLE || view
+func posTableKey(contract common.Address, view uint32) ([]byte, error) {
+	viewBytes, err := GetUint32Bytes(view)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOnt, appCallTransferFrom error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
 	}
-	return nil
+	return utils.ConcatKey(contract, []byte(POS_TABLE), viewBytes), nil
 }
 
-func appCallTransferFromOng(native *native.NativeService, sender common.Address, from common.Address, to common.Address, amount uint64) error {
-	err := appCallTransferFrom(native, utils.OngContractAddress, sender, from, to, amount)
+// peerPoolItemKey is the key of a migrated peer pool item:
+// contract || PEER_POOL || view || index
+func peerPoolItemKey(contract common.Address, view uint32, index uint32) ([]byte, error) {
+	viewBytes, err := GetUint32Bytes(view)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, appCallTransferFrom error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
 	}
-	return nil
+	indexBytes, err := GetUint32Bytes(index)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get indexBytes error!")
+	}
+	return utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes, indexBytes), nil
 }
 
-func appCallTransferFrom(native *native.NativeService, contract common.Address, sender common.Address, from common.Address, to common.Address, amount uint64) error {
-	bf := new(bytes.Buffer)
-	params := &ont.TransferFrom{
-		Sender: sender,
-		From:   from,
-		To:     to,
-		Value:  amount,
+// loadPeerPoolItem returns nil, nil if no item is stored under the key of index
+func loadPeerPoolItem(native *native.NativeService, contract common.Address, view uint32, index uint32) (*PeerPoolItem, error) {
+	key, err := peerPoolItemKey(contract, view, index)
+	if err != nil {
+		return nil, err
 	}
-	err := params.Serialize(bf)
+	peerPoolItemBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, key)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFrom, params serialize error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolItem, get peerPoolItemBytes error!")
+	}
+	if peerPoolItemBytes == nil {
+		return nil, nil
+	}
+	peerPoolItemStore, ok := peerPoolItemBytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, errors.NewErr("getPeerPoolItem, peerPoolItemBytes is not available!")
+	}
+	peerPoolItem := new(PeerPoolItem)
+	if err := peerPoolItem.Deserialize(bytes.NewBuffer(peerPoolItemStore.Value)); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize peerPoolItem error!")
 	}
+	return peerPoolItem, nil
+}
 
-	if _, err := native.NativeCall(contract, "transferFrom", bf.Bytes()); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFrom, appCall error!")
+func storePeerPoolItem(native *native.NativeService, contract common.Address, view uint32, peerPoolItem *PeerPoolItem) error {
+	bf := new(bytes.Buffer)
+	if err := peerPoolItem.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize peerPoolItem error!")
+	}
+	key, err := peerPoolItemKey(contract, view, peerPoolItem.Index)
+	if err != nil {
+		return err
 	}
+	native.CloneCache.Add(scommon.ST_STORAGE, key, &cstates.StorageItem{Value: bf.Bytes()})
 	return nil
 }
 
-func getOngBalance(native *native.NativeService, address common.Address) (uint64, error) {
-	bf := new(bytes.Buffer)
-	err := utils.WriteAddress(bf, address)
+// getPeerPoolIndexes returns the indexes of the items of a view stored per
+// item. The second result is false if the view is still stored as one blob.
+func getPeerPoolIndexes(native *native.NativeService, contract common.Address, view uint32) ([]uint32, bool, error) {
+	viewBytes, err := GetUint32Bytes(view)
+	if err != nil {
+		return nil, false, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
+	}
+	indexesBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL_INDEX), viewBytes))
 	if err != nil {
-		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getOngBalance, utils.WriteAddress error!")
+		return nil, false, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolIndexes, get indexesBytes error!")
 	}
+	if indexesBytes == nil {
+		return nil, false, nil
+	}
+	indexesStore, ok := indexesBytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, false, errors.NewErr("getPeerPoolIndexes, indexesBytes is not available!")
+	}
+	indexes, err := deserializeUint32Slice(bytes.NewBuffer(indexesStore.Value))
+	if err != nil {
+		return nil, false, errors.NewDetailErr(err, errors.ErrNoCode, "deserializeUint32Slice, deserialize indexes error!")
+	}
+	return indexes, true, nil
+}
+
+// DecodePeerPoolIndexes decodes the index list stored under
+// PEER_POOL_INDEX || view of a view stored per item
+func DecodePeerPoolIndexes(data []byte) ([]uint32, error) {
+	return deserializeUint32Slice(bytes.NewBuffer(data))
+}
 
-	value, err := native.NativeCall(utils.OngContractAddress, "balanceOf", bf.Bytes())
+func putPeerPoolIndexes(native *native.NativeService, contract common.Address, view uint32, indexes []uint32) error {
+	sorted := make([]uint32, len(indexes))
+	copy(sorted, indexes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	bf := new(bytes.Buffer)
+	if err := serializeUint32Slice(bf, sorted); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serializeUint32Slice, serialize indexes error!")
+	}
+	viewBytes, err := GetUint32Bytes(view)
 	if err != nil {
-		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getOngBalance, appCall error!")
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get viewBytes error!")
 	}
-	balance := types.BigIntFromBytes(value.([]byte)).Uint64()
-	return balance, nil
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL_INDEX), viewBytes), &cstates.StorageItem{Value: bf.Bytes()})
+	return nil
 }
 
-func splitCurve(native *native.NativeService, contract common.Address, pos uint64, avg uint64, yita uint64) (uint64, error) {
-	if avg == 0 {
-		return 0, errors.NewErr("splitCurve, avg stake is 0!")
+// GetPosTable returns the shuffled pos table stored for view. Tables are only
+// stored from POS_TABLE_HEIGHT on, earlier views have none.
+func GetPosTable(native *native.NativeService, contract common.Address, view uint32) ([]uint32, error) {
+	key, err := posTableKey(contract, view)
+	if err != nil {
+		return nil, err
 	}
-	xi := PRECISE * yita * 2 * pos / (avg * 10)
-	index := xi / (PRECISE / 10)
-	if index > uint64(len(Xi)-2) {
-		index = uint64(len(Xi) - 2)
+	posTableBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, key)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get posTableBytes error!")
+	}
+	if posTableBytes == nil {
+		return nil, fmt.Errorf("getPosTable, no pos table is stored for view %d!", view)
+	}
+	posTableStore, ok := posTableBytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, errors.NewErr("getPosTable, posTableBytes is not available!")
 	}
-	splitCurve, err := getSplitCurve(native, contract)
+	posTable, err := deserializeUint32Slice(bytes.NewBuffer(posTableStore.Value))
 	if err != nil {
-		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitCurve, get splitCurve error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserializeUint32Slice, deserialize posTable error!")
 	}
-	Yi := splitCurve.Yi
-	s := ((uint64(Yi[index+1])-uint64(Yi[index]))*xi + uint64(Yi[index])*uint64(Xi[index+1]) - uint64(Yi[index+1])*uint64(Xi[index])) / (uint64(Xi[index+1]) - uint64(Xi[index]))
-	return s, nil
+	return posTable, nil
 }
 
-func GetUint32Bytes(num uint32) ([]byte, error) {
+func putPosTable(native *native.NativeService, contract common.Address, view uint32, posTable []uint32) error {
 	bf := new(bytes.Buffer)
-	if err := serialization.WriteUint32(bf, num); err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize uint32 error!")
+	if err := serializeUint32Slice(bf, posTable); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serializeUint32Slice, serialize posTable error!")
 	}
-	return bf.Bytes(), nil
+	key, err := posTableKey(contract, view)
+	if err != nil {
+		return err
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, key, &cstates.StorageItem{Value: bf.Bytes()})
+	return nil
 }
 
-func GetBytesUint32(b []byte) (uint32, error) {
-	num, err := serialization.ReadUint32(bytes.NewBuffer(b))
+// storePosTable computes the pos table of view from its candidate and
+// consensus peers, seeded with the tx and height committing the view as vbft
+// seeds it. From MAX_CANDIDATE_NUM_HEIGHT on it fails for more peers than
+// GlobalParam2.MaxCandidateNum, from POS_TABLE_HEIGHT on it stores the table
+// under view.
+func storePosTable(native *native.NativeService, contract common.Address, view uint32, config *Configuration,
+	peers []*PeerStakeInfo) error {
+	if native.Height < POS_TABLE_HEIGHT && native.Height < MAX_CANDIDATE_NUM_HEIGHT {
+		return nil
+	}
+	var maxCandidateNum uint32
+	if native.Height >= MAX_CANDIDATE_NUM_HEIGHT {
+		globalParam2, err := GetGlobalParam2(native, contract)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam2, get globalParam2 error!")
+		}
+		maxCandidateNum = globalParam2.MaxCandidateNum
+	}
+	_, _, posTable, err := calDposTable(native.Tx.Hash(), native.Height, config, peers, maxCandidateNum)
 	if err != nil {
-		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize uint32 error!")
+		return errors.NewDetailErr(err, errors.ErrNoCode, "calDposTable, calculate dpos table error!")
 	}
-	return num, nil
+	if native.Height < POS_TABLE_HEIGHT {
+		return nil
+	}
+	return putPosTable(native, contract, view, posTable)
 }
 
-func getGlobalParam(native *native.NativeService, contract common.Address) (*GlobalParam, error) {
-	globalParamBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM)))
+var (
+	// ErrGovernanceViewNotFound is the root error of GetGovernanceView when
+	// governance is not initialized yet
+	ErrGovernanceViewNotFound = errors.NewErr("governance view not found")
+	// ErrGovernanceViewCorrupt is the root error of GetGovernanceView when the
+	// stored governance view can not be decoded
+	ErrGovernanceViewCorrupt = errors.NewErr("governance view corrupt")
+)
+
+// governanceViewKey is the key of the GovernanceView: contract || GOVERNANCE_VIEW
+func governanceViewKey(contract common.Address) []byte {
+	return utils.ConcatKey(contract, []byte(GOVERNANCE_VIEW))
+}
+
+// GetGovernanceView returns the current governance view. Use errors.RootErr to
+// tell ErrGovernanceViewNotFound and ErrGovernanceViewCorrupt from store errors.
+func GetGovernanceView(native *native.NativeService, contract common.Address) (*GovernanceView, error) {
+	cache := getExecutionCache(native)
+	if cache != nil {
+		if governanceView, ok := cache.views[contract]; ok {
+			return &governanceView, nil
+		}
+	}
+	governanceViewBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, governanceViewKey(contract))
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam, get globalParamBytes error!")
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGovernanceView, get governanceViewBytes error!")
 	}
-	globalParam := new(GlobalParam)
-	if globalParamBytes == nil {
-		return nil, errors.NewErr("getGlobalParam, get nil globalParamBytes!")
+	governanceView := new(GovernanceView)
+	if governanceViewBytes == nil {
+		return nil, errors.NewDetailErr(ErrGovernanceViewNotFound, errors.ErrNoCode, "getGovernanceView, get nil governanceViewBytes!")
 	} else {
-		globalParamStore, ok := globalParamBytes.(*cstates.StorageItem)
+		governanceViewStore, ok := governanceViewBytes.(*cstates.StorageItem)
 		if !ok {
-			return nil, errors.NewErr("getGlobalParam, globalParamBytes is not available!")
+			return nil, errors.NewDetailErr(ErrGovernanceViewCorrupt, errors.ErrNoCode, "getGovernanceView, governanceViewBytes is not available!")
 		}
-		if err := globalParam.Deserialize(bytes.NewBuffer(globalParamStore.Value)); err != nil {
-			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize globalParam error!")
+		if err := governanceView.Deserialize(bytes.NewBuffer(governanceViewStore.Value)); err != nil {
+			return nil, errors.NewDetailErr(ErrGovernanceViewCorrupt, errors.ErrNoCode,
+				"deserialize, deserialize governanceView error: "+err.Error())
 		}
 	}
-	return globalParam, nil
+	if cache != nil {
+		cache.views[contract] = *governanceView
+	}
+	return governanceView, nil
 }
 
-func putGlobalParam(native *native.NativeService, contract common.Address, globalParam *GlobalParam) error {
+// putGovernanceView stores governanceView, the view may only move forward:
+// once a view is stored, a view not greater than it is refused.
+func putGovernanceView(native *native.NativeService, contract common.Address, governanceView *GovernanceView) error {
+	current, initialized, err := GetViewOrZero(native, contract)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "putGovernanceView, get current view error!")
+	}
+	if initialized && governanceView.View <= current {
+		return fmt.Errorf("putGovernanceView, view %d is not greater than current view %d!", governanceView.View, current)
+	}
 	bf := new(bytes.Buffer)
-	if err := globalParam.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize globalParam error!")
+	if err := governanceView.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize governanceView error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, governanceViewKey(contract), &cstates.StorageItem{Value: bf.Bytes()})
+	if cache := getExecutionCache(native); cache != nil {
+		cache.views[contract] = *governanceView
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM)), &cstates.StorageItem{Value: bf.Bytes()})
 	return nil
 }
 
-func validatePeerPubKeyFormat(pubkey string) error {
-	pk, err := vbftconfig.Pubkey(pubkey)
+// IncrementGovernanceView bumps the stored view by one and records height and
+// txHash with it. Nothing is written when an error is returned.
+func IncrementGovernanceView(native *native.NativeService, contract common.Address, txHash common.Uint256,
+	height uint32) (uint32, error) {
+	governanceView, err := GetGovernanceView(native, contract)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "failed to parse pubkey")
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "incrementGovernanceView, get GovernanceView error!")
 	}
-	if !vrf.ValidatePublicKey(pk) {
-		return errors.NewErr("invalid for VRF")
+	if governanceView.View == math.MaxUint32 {
+		return 0, errors.NewErr("incrementGovernanceView, view overflows uint32!")
 	}
-	return nil
+	newView := governanceView.View + 1
+	err = putGovernanceView(native, contract, &GovernanceView{
+		View:   newView,
+		Height: height,
+		TxHash: txHash,
+	})
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "incrementGovernanceView, put governanceView error!")
+	}
+	return newView, nil
 }
 
-func CheckVBFTConfig(configuration *config.VBFTConfig) error {
-	if configuration.C == 0 {
-		return errors.NewErr("initConfig. C can not be 0 in config!")
-	}
-	if int(configuration.K) != len(configuration.Peers) {
-		return errors.NewErr("initConfig. K must equal to length of peer in config!")
+// pushGovernanceEvent notifies eventName followed by states, the same
+// [name, states...] layout the other native contracts notify in
+func pushGovernanceEvent(native *native.NativeService, contract common.Address, eventName string, states ...interface{}) {
+	if !config.DefConfig.Common.EnableEventLog {
+		return
+	}
+	native.Notifications = append(native.Notifications,
+		&event.NotifyEventInfo{
+			ContractAddress: contract,
+			States:          append([]interface{}{eventName}, states...),
+		})
+}
+
+// GetViewOrZero returns the current view and whether governance has been
+// initialized. A missing governance view is not an error, it yields (0, false, nil),
+// so that a chain at view 0 can be told from one without governance.
+func GetViewOrZero(native *native.NativeService, contract common.Address) (uint32, bool, error) {
+	governanceView, err := GetGovernanceView(native, contract)
+	if err != nil {
+		if errors.RootErr(err) == ErrGovernanceViewNotFound {
+			return 0, false, nil
+		}
+		return 0, false, errors.NewDetailErr(err, errors.ErrNoCode, "getViewOrZero, getGovernanceView error!")
+	}
+	return governanceView.View, true, nil
+}
+
+func GetView(native *native.NativeService, contract common.Address) (uint32, error) {
+	view, initialized, err := GetViewOrZero(native, contract)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getView, getViewOrZero error!")
+	}
+	if !initialized {
+		return 0, errors.NewDetailErr(ErrGovernanceViewNotFound, errors.ErrNoCode, "getView, governance is not initialized!")
+	}
+	return view, nil
+}
+
+// OntAmount is an amount of ont, OngAmount an amount of ong. They are distinct
+// types so that the compiler rejects passing one where the other is expected,
+// convert explicitly through Uint64 and the type conversions. Both are plain
+// uint64 on the wire.
+type OntAmount uint64
+
+type OngAmount uint64
+
+func (this OntAmount) Uint64() uint64 {
+	return uint64(this)
+}
+
+func (this OngAmount) Uint64() uint64 {
+	return uint64(this)
+}
+
+func appCallTransferOnt(native *native.NativeService, from common.Address, to common.Address, amount OntAmount) error {
+	err := appCallTransfer(native, utils.OntContractAddress, from, to, amount.Uint64())
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOnt, appCallTransfer error!")
+	}
+	return nil
+}
+
+func appCallTransferOng(native *native.NativeService, from common.Address, to common.Address, amount OngAmount) error {
+	if _, err := appCallTransferOngResult(native, from, to, amount); err != nil {
+		return err
+	}
+	return nil
+}
+
+// appCallTransferOngResult is appCallTransferOng returning the raw result of
+// the ong contract, utils.BYTE_TRUE on success
+func appCallTransferOngResult(native *native.NativeService, from common.Address, to common.Address, amount OngAmount) ([]byte, error) {
+	defer clearOngBalances(native)
+	result, err := appCallTransferMultiResult(native, utils.OngContractAddress, []*ont.State{{
+		From:  from,
+		To:    to,
+		Value: amount.Uint64(),
+	}})
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOng, appCallTransfer error!")
+	}
+	return result, nil
+}
+
+func appCallTransfer(native *native.NativeService, contract common.Address, from common.Address, to common.Address, amount uint64) error {
+	var sts []*ont.State
+	sts = append(sts, &ont.State{
+		From:  from,
+		To:    to,
+		Value: amount,
+	})
+	return appCallTransferMulti(native, contract, sts)
+}
+
+func appCallTransferOntMulti(native *native.NativeService, states []*ont.State) error {
+	err := appCallTransferMulti(native, utils.OntContractAddress, states)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOntMulti, appCallTransferMulti error!")
+	}
+	return nil
+}
+
+func appCallTransferOngMulti(native *native.NativeService, states []*ont.State) error {
+	defer clearOngBalances(native)
+	err := appCallTransferMulti(native, utils.OngContractAddress, states)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferOngMulti, appCallTransferMulti error!")
+	}
+	return nil
+}
+
+// appCallTransferMulti packs all states into one Transfers and transfers them
+// with a single call of contract
+func appCallTransferMulti(native *native.NativeService, contract common.Address, states []*ont.State) error {
+	_, err := appCallTransferMultiResult(native, contract, states)
+	return err
+}
+
+// appCallTransferMultiResult returns the raw result of the transfer call, nil
+// if there is nothing to transfer
+func appCallTransferMultiResult(native *native.NativeService, contract common.Address, states []*ont.State) ([]byte, error) {
+	if len(states) == 0 {
+		return nil, nil
+	}
+	for _, state := range states {
+		if state == nil {
+			return nil, errors.NewErr("appCallTransfer, transfer state is nil!")
+		}
+	}
+	bf := new(bytes.Buffer)
+	transfers := &ont.Transfers{
+		States: states,
+	}
+	err := transfers.Serialize(bf)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransfer, transfers.Serialize error!")
+	}
+
+	result, err := native.NativeCall(contract, "transfer", bf.Bytes())
+	if err != nil {
+		return nil, appCallError(err, "appCallTransfer", contract, "transfer")
+	}
+	if result == nil {
+		return nil, nil
+	}
+	value, ok := result.([]byte)
+	if !ok {
+		return nil, errors.NewErr("appCallTransfer, transfer result is not a byte array!")
+	}
+	return value, nil
+}
+
+func appCallTransferFromOnt(native *native.NativeService, sender common.Address, from common.Address, to common.Address, amount OntAmount) error {
+	err := appCallTransferFrom(native, utils.OntContractAddress, sender, from, to, amount.Uint64())
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOnt, appCallTransferFrom error!")
+	}
+	return nil
+}
+
+func appCallTransferFromOng(native *native.NativeService, sender common.Address, from common.Address, to common.Address, amount OngAmount) error {
+	defer clearOngBalances(native)
+	err := appCallTransferFrom(native, utils.OngContractAddress, sender, from, to, amount.Uint64())
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFromOng, appCallTransferFrom error!")
+	}
+	return nil
+}
+
+func appCallTransferFrom(native *native.NativeService, contract common.Address, sender common.Address, from common.Address, to common.Address, amount uint64) error {
+	bf := new(bytes.Buffer)
+	params := &ont.TransferFrom{
+		Sender: sender,
+		From:   from,
+		To:     to,
+		Value:  amount,
+	}
+	err := params.Serialize(bf)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallTransferFrom, params serialize error!")
+	}
+
+	if _, err := native.NativeCall(contract, "transferFrom", bf.Bytes()); err != nil {
+		return appCallError(err, "appCallTransferFrom", contract, "transferFrom")
+	}
+	return nil
+}
+
+func appCallApproveOnt(native *native.NativeService, from common.Address, to common.Address, amount OntAmount) error {
+	err := appCallApprove(native, utils.OntContractAddress, from, to, amount.Uint64())
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallApproveOnt, appCallApprove error!")
+	}
+	return nil
+}
+
+func appCallApproveOng(native *native.NativeService, from common.Address, to common.Address, amount OngAmount) error {
+	err := appCallApprove(native, utils.OngContractAddress, from, to, amount.Uint64())
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallApproveOng, appCallApprove error!")
+	}
+	return nil
+}
+
+// appCallIncreaseAllowanceOng raises the ong allowance of to on from by delta
+// instead of overwriting it like appCallApproveOng
+func appCallIncreaseAllowanceOng(native *native.NativeService, from common.Address, to common.Address, delta OngAmount) error {
+	allowance, err := getAllowance(native, utils.OngContractAddress, from, to)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallIncreaseAllowanceOng, getAllowance error!")
+	}
+	if allowance+delta.Uint64() < allowance {
+		return errors.NewErr("appCallIncreaseAllowanceOng, allowance overflow!")
+	}
+	err = appCallApprove(native, utils.OngContractAddress, from, to, allowance+delta.Uint64())
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallIncreaseAllowanceOng, appCallApprove error!")
+	}
+	return nil
+}
+
+func getAllowance(native *native.NativeService, contract common.Address, from common.Address, to common.Address) (uint64, error) {
+	bf := new(bytes.Buffer)
+	if err := utils.WriteAddress(bf, from); err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getAllowance, utils.WriteAddress error!")
+	}
+	if err := utils.WriteAddress(bf, to); err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getAllowance, utils.WriteAddress error!")
+	}
+
+	value, err := native.NativeCall(contract, ont.ALLOWANCE_NAME, bf.Bytes())
+	if err != nil {
+		return 0, appCallError(err, "getAllowance", contract, ont.ALLOWANCE_NAME)
+	}
+	return parseBalance(value)
+}
+
+func appCallApprove(native *native.NativeService, contract common.Address, from common.Address, to common.Address, amount uint64) error {
+	bf := new(bytes.Buffer)
+	params := &ont.State{
+		From:  from,
+		To:    to,
+		Value: amount,
+	}
+	err := params.Serialize(bf)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallApprove, params serialize error!")
+	}
+
+	if _, err := native.NativeCall(contract, "approve", bf.Bytes()); err != nil {
+		return appCallError(err, "appCallApprove", contract, "approve")
+	}
+	return nil
+}
+
+func getOngBalance(native *native.NativeService, address common.Address) (OngAmount, error) {
+	cache := getExecutionCache(native)
+	if cache != nil {
+		if balance, ok := cache.ongBalances[address]; ok {
+			return OngAmount(balance), nil
+		}
+	}
+	balance, err := getBalance(native, utils.OngContractAddress, address)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getOngBalance, getBalance error!")
+	}
+	if cache != nil {
+		cache.ongBalances[address] = balance
+	}
+	return OngAmount(balance), nil
+}
+
+// GetOngBalanceReadOnly reads the ong balance of address straight from the ong
+// contract storage, without a native call, for queries which must not have any
+// side effect. It relies on the layout of ont.GenBalanceKey: the balance is
+// stored under OngContractAddress || address as a uint64 serialized by
+// serialization.WriteUint64, a missing key is a zero balance.
+func GetOngBalanceReadOnly(native *native.NativeService, address common.Address) (OngAmount, error) {
+	balance, err := utils.GetStorageUInt64(native, ont.GenBalanceKey(utils.OngContractAddress, address))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getOngBalanceReadOnly, get balance error!")
+	}
+	return OngAmount(balance), nil
+}
+
+func getOntBalance(native *native.NativeService, address common.Address) (OntAmount, error) {
+	balance, err := getBalance(native, utils.OntContractAddress, address)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getOntBalance, getBalance error!")
+	}
+	return OntAmount(balance), nil
+}
+
+func getBalance(native *native.NativeService, contract common.Address, address common.Address) (uint64, error) {
+	bf := new(bytes.Buffer)
+	err := utils.WriteAddress(bf, address)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getBalance, utils.WriteAddress error!")
+	}
+
+	value, err := native.NativeCall(contract, "balanceOf", bf.Bytes())
+	if err != nil {
+		return 0, appCallError(err, "getBalance", contract, "balanceOf")
+	}
+	return parseBalance(value)
+}
+
+// appCallError wraps the error of a native call made by caller, naming the
+// called contract and method so a failed call can be told apart from the
+// other calls of a transaction
+func appCallError(err error, caller string, contract common.Address, method string) error {
+	return errors.NewDetailErr(err, errors.ErrNoCode,
+		fmt.Sprintf("%s, appCall %s of contract %s error!", caller, method, contract.ToHexString()))
+}
+
+// parseBalance decodes the result of balanceOf
+func parseBalance(value interface{}) (uint64, error) {
+	balanceBytes, ok := value.([]byte)
+	if !ok {
+		return 0, errors.NewErr("parseBalance, balanceOf result is not []byte!")
+	}
+	return types.BigIntFromBytes(balanceBytes).Uint64(), nil
+}
+
+// splitCurve returns the fee split weight of a peer with stake pos when the
+// average stake of the consensus peers is avg. The stake is mapped onto the
+// curve as xi = PRECISE * yita * 2 * pos / (10 * avg), exactly, so pos / avg
+// == 1 with the default yita of 5 lands on Xi = PRECISE, and the weight is the
+// curve linearly interpolated at xi.
+//
+// The valid domain: curve has at least two points, len(Yi) == len(Xi) and Xi
+// strictly increasing; avg > 0; pos and yita are any uint64. xi below Xi[0]
+// is an error. xi above the last point extrapolates the last segment, which
+// is an error once the line drops below 0 or the weight overflows uint64.
+// The segment index is clamped to [0, len(Xi)-2], so index+1 is always a
+// valid point of the curve.
+func splitCurve(curve *SplitCurve, pos uint64, avg uint64, yita uint64) (uint64, error) {
+	if avg == 0 {
+		return 0, errors.NewErr("splitCurve, avg stake is 0!")
+	}
+	Xi, Yi := curve.Xi, curve.Yi
+	if len(Xi) < 2 || len(Yi) != len(Xi) {
+		return 0, errors.NewErr("splitCurve, length of Yi is not equal to length of Xi!")
+	}
+	for i := 1; i < len(Xi); i++ {
+		if Xi[i] <= Xi[i-1] {
+			return 0, errors.NewErr("splitCurve, Xi is not increasing!")
+		}
+	}
+	// PRECISE * yita * 2 * pos does not fit in uint64 for large stakes,
+	// all intermediate products are computed with big.Int
+	xi := new(big.Int).SetUint64(PRECISE)
+	xi.Mul(xi, new(big.Int).SetUint64(yita))
+	xi.Mul(xi, big.NewInt(2))
+	xi.Mul(xi, new(big.Int).SetUint64(pos))
+	xi.Quo(xi, new(big.Int).Mul(new(big.Int).SetUint64(avg), big.NewInt(10)))
+
+	// the segment [Xi[index], Xi[index+1]] containing xi
+	index := sort.Search(len(Xi), func(i int) bool { return new(big.Int).SetUint64(uint64(Xi[i])).Cmp(xi) > 0 })
+	if index > 0 {
+		index--
+	}
+	if index > len(Xi)-2 {
+		index = len(Xi) - 2
+	}
+
+	// linear interpolation between (x0, y0) and (x1, y1):
+	// s = (y0*(x1-xi) + y1*(xi-x0)) / (x1-x0)
+	// xi may pass x1 on the last segment, the curve is extrapolated then
+	x0, x1 := new(big.Int).SetUint64(uint64(Xi[index])), new(big.Int).SetUint64(uint64(Xi[index+1]))
+	y0, y1 := new(big.Int).SetUint64(uint64(Yi[index])), new(big.Int).SetUint64(uint64(Yi[index+1]))
+	if xi.Cmp(x0) < 0 {
+		return 0, errors.NewErr("splitCurve, xi is out of the range of split curve!")
+	}
+	num := new(big.Int).Mul(y0, new(big.Int).Sub(x1, xi))
+	num.Add(num, new(big.Int).Mul(y1, new(big.Int).Sub(xi, x0)))
+	if num.Sign() < 0 {
+		return 0, errors.NewErr("splitCurve, xi is out of the range of split curve!")
+	}
+	num.Quo(num, new(big.Int).Sub(x1, x0))
+	if !num.IsUint64() {
+		return 0, errors.NewErr("splitCurve, result overflows uint64!")
+	}
+	return num.Uint64(), nil
+}
+
+func GetUint32Bytes(num uint32) ([]byte, error) {
+	bf := new(bytes.Buffer)
+	if err := serialization.WriteUint32(bf, num); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize uint32 error!")
+	}
+	return bf.Bytes(), nil
+}
+
+func GetBytesUint32(b []byte) (uint32, error) {
+	num, err := serialization.ReadUint32(bytes.NewBuffer(b))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint32, deserialize uint32 error!")
+	}
+	return num, nil
+}
+
+func GetUint64Bytes(num uint64) ([]byte, error) {
+	bf := new(bytes.Buffer)
+	if err := serialization.WriteUint64(bf, num); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint64, serialize uint64 error!")
+	}
+	return bf.Bytes(), nil
+}
+
+func GetBytesUint64(b []byte) (uint64, error) {
+	num, err := serialization.ReadUint64(bytes.NewBuffer(b))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadUint64, deserialize uint64 error!")
+	}
+	return num, nil
+}
+
+// mulChecked returns a*b, or an error if the product overflows uint64
+func mulChecked(a, b uint64) (uint64, error) {
+	if a != 0 && b > math.MaxUint64/a {
+		return 0, fmt.Errorf("mulChecked, %d*%d overflows uint64!", a, b)
+	}
+	return a * b, nil
+}
+
+// addChecked returns a+b, or an error if the sum overflows uint64
+func addChecked(a, b uint64) (uint64, error) {
+	if a+b < a {
+		return 0, fmt.Errorf("addChecked, %d+%d overflows uint64!", a, b)
+	}
+	return a + b, nil
+}
+
+// executionCache memoizes governance state decoded during one execution of a
+// governance method, it is dropped when the method returns
+type executionCache struct {
+	cloneCache   *storage.CloneCache
+	globalParams map[common.Address]GlobalParam
+	views        map[common.Address]GovernanceView
+	ongBalances  map[common.Address]uint64
+}
+
+var (
+	executionCachesLock sync.Mutex
+	executionCaches     = make(map[*native.NativeService]*executionCache)
+)
+
+// withExecutionCache wraps handler so that state read through native is cached
+// until handler returns, a nested call keeps the cache of the outer one
+func withExecutionCache(handler native.Handler) native.Handler {
+	return func(native *native.NativeService) ([]byte, error) {
+		executionCachesLock.Lock()
+		_, nested := executionCaches[native]
+		if !nested {
+			executionCaches[native] = &executionCache{
+				cloneCache:   native.CloneCache,
+				globalParams: make(map[common.Address]GlobalParam),
+				views:        make(map[common.Address]GovernanceView),
+				ongBalances:  make(map[common.Address]uint64),
+			}
+		}
+		executionCachesLock.Unlock()
+		if !nested {
+			defer func() {
+				executionCachesLock.Lock()
+				delete(executionCaches, native)
+				executionCachesLock.Unlock()
+			}()
+		}
+		return handler(native)
+	}
+}
+
+// getExecutionCache returns the cache of the running execution of native, nil
+// outside of an execution or once native works on another state
+func getExecutionCache(native *native.NativeService) *executionCache {
+	executionCachesLock.Lock()
+	defer executionCachesLock.Unlock()
+	cache, ok := executionCaches[native]
+	if !ok || cache.cloneCache != native.CloneCache {
+		return nil
+	}
+	return cache
+}
+
+// clearOngBalances drops the cached ong balances, every ong transfer must call
+// it since the balances of both sides change
+func clearOngBalances(native *native.NativeService) {
+	if cache := getExecutionCache(native); cache != nil {
+		cache.ongBalances = make(map[common.Address]uint64)
+	}
+}
+
+// globalParamKey is the key of the GlobalParam: contract || GLOBAL_PARAM
+func globalParamKey(contract common.Address) []byte {
+	return utils.ConcatKey(contract, []byte(GLOBAL_PARAM))
+}
+
+func getGlobalParam(native *native.NativeService, contract common.Address) (*GlobalParam, error) {
+	cache := getExecutionCache(native)
+	if cache != nil {
+		if globalParam, ok := cache.globalParams[contract]; ok {
+			return &globalParam, nil
+		}
+	}
+	globalParamBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, globalParamKey(contract))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam, get globalParamBytes error!")
+	}
+	globalParam := new(GlobalParam)
+	if globalParamBytes == nil {
+		return nil, errors.NewErr("getGlobalParam, get nil globalParamBytes!")
+	} else {
+		globalParamStore, ok := globalParamBytes.(*cstates.StorageItem)
+		if !ok {
+			return nil, errors.NewErr("getGlobalParam, globalParamBytes is not available!")
+		}
+		if err := globalParam.Deserialize(bytes.NewBuffer(globalParamStore.Value)); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize globalParam error!")
+		}
+	}
+	if cache != nil {
+		cache.globalParams[contract] = *globalParam
+	}
+	return globalParam, nil
+}
+
+func putGlobalParam(native *native.NativeService, contract common.Address, globalParam *GlobalParam) error {
+	bf := new(bytes.Buffer)
+	if err := globalParam.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize globalParam error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, globalParamKey(contract), &cstates.StorageItem{Value: bf.Bytes()})
+	if cache := getExecutionCache(native); cache != nil {
+		delete(cache.globalParams, contract)
+	}
+	if native.Height >= GLOBAL_PARAM_HISTORY_HEIGHT {
+		if err := putGlobalParamHistory(native, contract, native.Height, bf.Bytes()); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "putGlobalParamHistory, put globalParam history error!")
+		}
+	}
+	return nil
+}
+
+func getGlobalParamHistoryHeights(native *native.NativeService, contract common.Address) ([]uint32, error) {
+	heightsBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM_HISTORY)))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParamHistoryHeights, get heightsBytes error!")
+	}
+	if heightsBytes == nil {
+		return nil, nil
+	}
+	heightsStore, ok := heightsBytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, errors.NewErr("getGlobalParamHistoryHeights, heightsBytes is not available!")
+	}
+	heights, err := deserializeUint32Slice(bytes.NewBuffer(heightsStore.Value))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserializeUint32Slice, deserialize heights error!")
+	}
+	return heights, nil
+}
+
+// putGlobalParamHistory records the serialized global param set at height,
+// the heights with a record are kept in ascending order under
+// GLOBAL_PARAM_HISTORY
+func putGlobalParamHistory(native *native.NativeService, contract common.Address, height uint32, value []byte) error {
+	heights, err := getGlobalParamHistoryHeights(native, contract)
+	if err != nil {
+		return err
+	}
+	if len(heights) > 0 && heights[len(heights)-1] > height {
+		return fmt.Errorf("putGlobalParamHistory, height %d is lower than the last record %d!", height, heights[len(heights)-1])
+	}
+	if len(heights) == 0 || heights[len(heights)-1] != height {
+		heights = append(heights, height)
+		bf := new(bytes.Buffer)
+		if err := serializeUint32Slice(bf, heights); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serializeUint32Slice, serialize heights error!")
+		}
+		native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM_HISTORY)), &cstates.StorageItem{Value: bf.Bytes()})
+	}
+	heightBytes, err := GetUint32Bytes(height)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get heightBytes error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM_HISTORY), heightBytes), &cstates.StorageItem{Value: value})
+	return nil
+}
+
+// GetGlobalParamAtHeight returns the global param in effect at height, i.e.
+// the last one recorded at or before height. Only updates made from
+// GLOBAL_PARAM_HISTORY_HEIGHT on are recorded, heights before the first
+// record return an error.
+func GetGlobalParamAtHeight(native *native.NativeService, contract common.Address, height uint32) (*GlobalParam, error) {
+	heights, err := getGlobalParamHistoryHeights(native, contract)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(heights), func(i int) bool { return heights[i] > height })
+	if i == 0 {
+		return nil, fmt.Errorf("getGlobalParamAtHeight, no globalParam recorded at or before height %d!", height)
+	}
+	heightBytes, err := GetUint32Bytes(heights[i-1])
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getUint32Bytes, get heightBytes error!")
+	}
+	globalParamBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM_HISTORY), heightBytes))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParamAtHeight, get globalParamBytes error!")
+	}
+	if globalParamBytes == nil {
+		return nil, fmt.Errorf("getGlobalParamAtHeight, globalParam record of height %d is missing!", heights[i-1])
+	}
+	globalParamStore, ok := globalParamBytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, errors.NewErr("getGlobalParamAtHeight, globalParamBytes is not available!")
+	}
+	globalParam := new(GlobalParam)
+	if err := globalParam.Deserialize(bytes.NewBuffer(globalParamStore.Value)); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize globalParam error!")
+	}
+	return globalParam, nil
+}
+
+// GetGlobalParam2 returns the GlobalParam2 of contract. Chains upgraded from
+// before GlobalParam2 existed have no value stored, the zero value is returned
+// for them instead of an error.
+func GetGlobalParam2(native *native.NativeService, contract common.Address) (*GlobalParam2, error) {
+	globalParam2Bytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM2)))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam2, get globalParam2Bytes error!")
+	}
+	globalParam2 := new(GlobalParam2)
+	if globalParam2Bytes == nil {
+		return globalParam2, nil
+	}
+	globalParam2Store, ok := globalParam2Bytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, errors.NewErr("getGlobalParam2, globalParam2Bytes is not available!")
+	}
+	if err := globalParam2.Deserialize(bytes.NewBuffer(globalParam2Store.Value)); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize globalParam2 error!")
+	}
+	return globalParam2, nil
+}
+
+func putGlobalParam2(native *native.NativeService, contract common.Address, globalParam2 *GlobalParam2) error {
+	bf := new(bytes.Buffer)
+	if err := globalParam2.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize globalParam2 error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GLOBAL_PARAM2)), &cstates.StorageItem{Value: bf.Bytes()})
+	return nil
+}
+
+// normalizePeerPubkey returns the canonical hex form of pubkey, so that
+// different encodings of the same key compare equal. Strings which can not
+// be parsed as a pubkey fall back to lower case hex.
+func normalizePeerPubkey(pubkey string) string {
+	pk, err := vbftconfig.Pubkey(pubkey)
+	if err != nil {
+		return strings.ToLower(pubkey)
+	}
+	return vbftconfig.PubkeyID(pk)
+}
+
+// FindDuplicatePeer returns the item of peerPoolMap whose pubkey is the same
+// key as pubkey, regardless of hex case or serialization form.
+func FindDuplicatePeer(peerPoolMap *PeerPoolMap, pubkey string) (*PeerPoolItem, bool) {
+	if peerPoolMap == nil {
+		return nil, false
+	}
+	if item, ok := peerPoolMap.PeerPoolMap[pubkey]; ok {
+		return item, true
+	}
+	var found *PeerPoolItem
+	peerPoolMap.ForEachSorted(func(index uint32, item *PeerPoolItem) error {
+		if found == nil && EqualPubkey(item.PeerPubkey, pubkey) {
+			found = item
+		}
+		return nil
+	})
+	return found, found != nil
+}
+
+// EqualPubkey reports whether a and b are the same key, regardless of hex
+// case or serialization form. The key bytes are compared in constant time.
+func EqualPubkey(a, b string) bool {
+	a, b = normalizePeerPubkey(a), normalizePeerPubkey(b)
+	aBytes, errA := hex.DecodeString(a)
+	bBytes, errB := hex.DecodeString(b)
+	if errA != nil || errB != nil {
+		aBytes, bBytes = []byte(a), []byte(b)
+	}
+	return subtle.ConstantTimeCompare(aBytes, bBytes) == 1
+}
+
+// ErrPeerPubkeyLength is the root error of validatePeerPubKeyFormat for
+// pubkeys outside [MIN_PEER_PUBKEY_LEN, MAX_PEER_PUBKEY_LEN], from
+// PEER_PUBKEY_CHECK_HEIGHT they are rejected before parsing
+var ErrPeerPubkeyLength = errors.NewErr("peer pubkey length out of range")
+
+// validatePeerPubKeyFormat checks that pubkey is usable by a peer at height
+func validatePeerPubKeyFormat(pubkey string, height uint32) error {
+	if height >= PEER_PUBKEY_CHECK_HEIGHT && (len(pubkey) < MIN_PEER_PUBKEY_LEN || len(pubkey) > MAX_PEER_PUBKEY_LEN) {
+		return errors.NewDetailErr(ErrPeerPubkeyLength, errors.ErrNoCode,
+			fmt.Sprintf("validatePeerPubKeyFormat, pubkey length %d is out of range!", len(pubkey)))
+	}
+	pk, err := vbftconfig.Pubkey(pubkey)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "failed to parse pubkey")
+	}
+	if !vrf.ValidatePublicKey(pk) {
+		return errors.NewErr("invalid for VRF")
+	}
+	if height < PEER_PUBKEY_CHECK_HEIGHT {
+		return nil
+	}
+	// consensus peers must sign with the chain's default scheme, ECDSA over P-256,
+	// other VRF-capable curves are rejected
+	if keypair.GetKeyType(pk) != keypair.PK_ECDSA {
+		return errors.NewErr("validatePeerPubKeyFormat, pubkey type is not ECDSA!")
+	}
+	ecPk, ok := pk.(*ec.PublicKey)
+	if !ok {
+		return errors.NewErr("validatePeerPubKeyFormat, pubkey is not an ec public key!")
+	}
+	label, err := keypair.GetCurveLabel(ecPk.Curve)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "validatePeerPubKeyFormat, unknown pubkey curve")
+	}
+	if label != PEER_PUBKEY_CURVE {
+		return errors.NewErr("validatePeerPubKeyFormat, pubkey curve is not P-256!")
+	}
+	return nil
+}
+
+// FindUnderfundedPeers returns the candidate and consensus peers of m whose
+// InitPos fell under minInitPos, for example after a penalty, in Index order.
+// Peers already quitting or blacklisted are left out.
+func FindUnderfundedPeers(m *PeerPoolMap, minInitPos uint64) []*PeerPoolItem {
+	underfunded := make([]*PeerPoolItem, 0)
+	m.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if peerPoolItem.Status != CandidateStatus && peerPoolItem.Status != ConsensusStatus {
+			return nil
+		}
+		if peerPoolItem.InitPos < minInitPos {
+			underfunded = append(underfunded, peerPoolItem)
+		}
+		return nil
+	})
+	return underfunded
+}
+
+// ValidatePoolPubkeys runs validatePeerPubKeyFormat with the checks of
+// PEER_PUBKEY_CHECK_HEIGHT on every peer of m, keys may have been stored under
+// older, laxer checks. It returns the sorted
+// pubkeys that fail, the error is only set when m itself is unusable.
+func ValidatePoolPubkeys(m *PeerPoolMap) ([]string, error) {
+	if m == nil {
+		return nil, errors.NewErr("validatePoolPubkeys, peerPoolMap is nil!")
+	}
+	var invalid []string
+	for _, peerPoolItem := range m.PeerPoolMap {
+		if err := validatePeerPubKeyFormat(peerPoolItem.PeerPubkey, PEER_PUBKEY_CHECK_HEIGHT); err != nil {
+			invalid = append(invalid, peerPoolItem.PeerPubkey)
+		}
+	}
+	sort.Strings(invalid)
+	return invalid, nil
+}
+
+// CheckVBFTConfig checks the vbft config initConfig is run with at height
+func CheckVBFTConfig(configuration *config.VBFTConfig, height uint32) error {
+	if configuration.C == 0 {
+		return errors.NewErr("initConfig. C can not be 0 in config!")
+	}
+	if int(configuration.K) != len(configuration.Peers) {
+		return errors.NewErr("initConfig. K must equal to length of peer in config!")
 	}
 	if configuration.L < 16*configuration.K || configuration.L%configuration.K != 0 {
 		return errors.NewErr("initConfig. L can not be less than 16*K and K must be times of L in config!")
 	}
-	if configuration.K < 2*configuration.C+1 {
-		return errors.NewErr("initConfig. K can not be less than 2*C+1 in config!")
+	if configuration.K < 2*configuration.C+1 {
+		return errors.NewErr("initConfig. K can not be less than 2*C+1 in config!")
+	}
+	if height >= CONFIG_CHECK_HEIGHT && uint64(configuration.K) < 3*uint64(configuration.C)+1 {
+		return errors.NewErr("initConfig. K can not be less than 3*C+1 in config!")
+	}
+	if configuration.N < configuration.K || configuration.K < 7 {
+		return errors.NewErr("initConfig. config not match N >= K >= 7!")
+	}
+	if configuration.BlockMsgDelay < 5000 {
+		return errors.NewErr("initConfig. BlockMsgDelay must >= 5000!")
+	}
+	if configuration.HashMsgDelay < 5000 {
+		return errors.NewErr("initConfig. HashMsgDelay must >= 5000!")
+	}
+	if configuration.PeerHandshakeTimeout < 10 {
+		return errors.NewErr("initConfig. PeerHandshakeTimeout must >= 10!")
+	}
+	if configuration.MinInitStake < 10000 {
+		return errors.NewErr("initConfig. MinInitStake must >= 10000!")
+	}
+	if len(configuration.VrfProof) < 128 {
+		return errors.NewErr("initConfig. VrfProof must >= 128!")
+	}
+	if len(configuration.VrfValue) < 128 {
+		return errors.NewErr("initConfig. VrfValue must >= 128!")
+	}
+
+	indexMap := make(map[uint32]struct{})
+	peerPubkeyMap := make(map[string]struct{})
+	for _, peer := range configuration.Peers {
+		_, ok := indexMap[peer.Index]
+		if ok {
+			return errors.NewErr("initConfig, peer index is duplicated!")
+		}
+		indexMap[peer.Index] = struct{}{}
+
+		_, ok = peerPubkeyMap[peer.PeerPubkey]
+		if ok {
+			return errors.NewErr("initConfig, peerPubkey is duplicated!")
+		}
+		peerPubkeyMap[peer.PeerPubkey] = struct{}{}
+
+		if peer.Index <= 0 {
+			return errors.NewErr("initConfig, peer index in config must > 0!")
+		}
+		//check peerPubkey
+		if err := validatePeerPubKeyFormat(peer.PeerPubkey, height); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "invalid peer pubkey")
+		}
+		_, err := common.AddressFromBase58(peer.Address)
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "common.AddressFromBase58, address format error!")
+		}
+	}
+	return nil
+}
+
+// ErrConfigNotFound is the root error of GetConfiguration when no
+// configuration is stored
+var ErrConfigNotFound = errors.NewErr("configuration not found")
+
+// GetConfiguration returns the stored vbft configuration. Use errors.RootErr to
+// tell ErrConfigNotFound from other errors.
+func GetConfiguration(native *native.NativeService, contract common.Address) (*Configuration, error) {
+	config := new(Configuration)
+	configBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VBFT_CONFIG)))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get configBytes error!")
+	}
+	if configBytes == nil {
+		return nil, errors.NewDetailErr(ErrConfigNotFound, errors.ErrNoCode, "getConfiguration, configBytes is nil!")
+	}
+	configStore, ok := configBytes.(*cstates.StorageItem)
+	if !ok {
+		return nil, errors.NewErr("getConfiguration, configBytes is not available!")
+	}
+	if err := config.Deserialize(bytes.NewBuffer(configStore.Value)); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize config error!")
+	}
+	return config, nil
+}
+
+// GetConfigurationJSON returns the stored configuration encoded as json, for
+// rpc queries
+func GetConfigurationJSON(native *native.NativeService, contract common.Address) ([]byte, error) {
+	config, err := GetConfiguration(native, contract)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getConfigurationJSON, get configuration error!")
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getConfigurationJSON, marshal configuration error!")
+	}
+	return data, nil
+}
+
+func putConfig(native *native.NativeService, contract common.Address, config *Configuration) error {
+	bf := new(bytes.Buffer)
+	if err := config.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize config error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VBFT_CONFIG)), &cstates.StorageItem{Value: bf.Bytes()})
+	return nil
+}
+
+func getCandidateIndex(native *native.NativeService, contract common.Address) (uint32, error) {
+	candidateIndexBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(CANDIDITE_INDEX)))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get candidateIndex error!")
+	}
+	if candidateIndexBytes == nil {
+		return 0, errors.NewErr("approveCandidate, candidateIndex is not init!")
+	} else {
+		candidateIndexStore, ok := candidateIndexBytes.(*cstates.StorageItem)
+		if !ok {
+			return 0, errors.NewErr("getCandidateIndex, candidateIndexBytes is not available!")
+		}
+		candidateIndex, err := GetBytesUint32(candidateIndexStore.Value)
+		if err != nil {
+			return 0, errors.NewDetailErr(err, errors.ErrNoCode, "GetBytesUint32, get candidateIndex error!")
+		}
+		return candidateIndex, nil
+	}
+}
+
+func putCandidateIndex(native *native.NativeService, contract common.Address, candidateIndex uint32) error {
+	candidateIndexBytes, err := GetUint32Bytes(candidateIndex)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "GetUint32Bytes, get newCandidateIndexBytes error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(CANDIDITE_INDEX)),
+		&cstates.StorageItem{Value: candidateIndexBytes})
+	return nil
+}
+
+func getVoteInfo(native *native.NativeService, contract common.Address, peerPubkey string, address common.Address) (*VoteInfo, error) {
+	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	voteInfoBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VOTE_INFO_POOL),
+		peerPubkeyPrefix, address[:]))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "get voteInfoBytes error!")
+	}
+	voteInfo := &VoteInfo{
+		PeerPubkey: peerPubkey,
+		Address:    address,
+	}
+	if voteInfoBytes != nil {
+		voteInfoStore, ok := voteInfoBytes.(*cstates.StorageItem)
+		if !ok {
+			return nil, errors.NewErr("getVoteInfo, voteInfoBytes is not available!")
+		}
+		if err := voteInfo.Deserialize(bytes.NewBuffer(voteInfoStore.Value)); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+		}
+	}
+	return voteInfo, nil
+}
+
+func putVoteInfo(native *native.NativeService, contract common.Address, voteInfo *VoteInfo) error {
+	peerPubkeyPrefix, err := hex.DecodeString(voteInfo.PeerPubkey)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	bf := new(bytes.Buffer)
+	if err := voteInfo.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize voteInfo error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VOTE_INFO_POOL), peerPubkeyPrefix,
+		voteInfo.Address[:]), &cstates.StorageItem{Value: bf.Bytes()})
+	return nil
+}
+
+// GetDelegatedStake returns the stake delegated to peerPubkey by all its
+// voters: the sum of ConsensusPos, FreezePos and NewPos of their vote infos.
+// Stake being withdrawn is not counted.
+func GetDelegatedStake(native *native.NativeService, contract common.Address, peerPubkey string) (uint64, error) {
+	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	prefix := utils.ConcatKey(contract, []byte(VOTE_INFO_POOL), peerPubkeyPrefix)
+	var sum uint64
+	err = iteratePrefix(native, prefix, func(key, value []byte) error {
+		// skip the vote infos of a longer pubkey starting with peerPubkey
+		if len(key) != len(prefix)+common.ADDR_LEN {
+			return nil
+		}
+		voteInfo := new(VoteInfo)
+		if err := voteInfo.Deserialize(bytes.NewBuffer(value)); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+		}
+		for _, pos := range []uint64{voteInfo.ConsensusPos, voteInfo.FreezePos, voteInfo.NewPos} {
+			if sum, err = addChecked(sum, pos); err != nil {
+				return errors.NewDetailErr(err, errors.ErrNoCode, "getDelegatedStake, delegated stake error!")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+func getPenaltyStake(native *native.NativeService, contract common.Address, peerPubkey string) (*PenaltyStake, error) {
+	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	penaltyStakeBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PENALTY_STAKE),
+		peerPubkeyPrefix))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "get voteInfoBytes error!")
+	}
+	penaltyStake := &PenaltyStake{
+		PeerPubkey: peerPubkey,
+	}
+	if penaltyStakeBytes != nil {
+		penaltyStakeStore, ok := penaltyStakeBytes.(*cstates.StorageItem)
+		if !ok {
+			return nil, errors.NewErr("getPenaltyStake, penaltyStakeBytes is not available!")
+		}
+		if err := penaltyStake.Deserialize(bytes.NewBuffer(penaltyStakeStore.Value)); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+		}
+	}
+	return penaltyStake, nil
+}
+
+func putPenaltyStake(native *native.NativeService, contract common.Address, penaltyStake *PenaltyStake) error {
+	peerPubkeyPrefix, err := hex.DecodeString(penaltyStake.PeerPubkey)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	bf := new(bytes.Buffer)
+	if err := penaltyStake.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize voteInfo error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PENALTY_STAKE), peerPubkeyPrefix),
+		&cstates.StorageItem{Value: bf.Bytes()})
+	return nil
+}
+
+// GetPeerSlashCount returns the number of slashing events recorded for
+// peerPubkey, zero if none was recorded.
+func GetPeerSlashCount(native *native.NativeService, contract common.Address, peerPubkey string) (uint32, error) {
+	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	slashCountBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SLASH_COUNT),
+		peerPubkeyPrefix))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get slashCount error!")
+	}
+	if slashCountBytes == nil {
+		return 0, nil
+	}
+	slashCountStore, ok := slashCountBytes.(*cstates.StorageItem)
+	if !ok {
+		return 0, errors.NewErr("getPeerSlashCount, slashCountBytes is not available!")
+	}
+	slashCount, err := GetBytesUint32(slashCountStore.Value)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "GetBytesUint32, get slashCount error!")
+	}
+	return slashCount, nil
+}
+
+// IncrementPeerSlashCount records one more slashing event for peerPubkey and
+// returns the new count.
+func IncrementPeerSlashCount(native *native.NativeService, contract common.Address, peerPubkey string) (uint32, error) {
+	slashCount, err := GetPeerSlashCount(native, contract, peerPubkey)
+	if err != nil {
+		return 0, err
+	}
+	if slashCount == math.MaxUint32 {
+		return 0, errors.NewErr("incrementPeerSlashCount, slashCount overflows uint32!")
+	}
+	slashCount++
+	slashCountBytes, err := GetUint32Bytes(slashCount)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "GetUint32Bytes, get slashCountBytes error!")
+	}
+	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SLASH_COUNT), peerPubkeyPrefix),
+		&cstates.StorageItem{Value: slashCountBytes})
+	return slashCount, nil
+}
+
+// lockupKey is the key of the lockup of the stake address has with peerPubkey:
+// contract || LOCKUP || peerPubkey || address
+func lockupKey(contract common.Address, peerPubkey string, address common.Address) ([]byte, error) {
+	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+	}
+	return utils.ConcatKey(contract, []byte(LOCKUP), peerPubkeyPrefix, address[:]), nil
+}
+
+// getLockup returns the height the stake of address with peerPubkey unlocks
+// at, 0 if it has no lockup
+func getLockup(native *native.NativeService, contract common.Address, peerPubkey string,
+	address common.Address) (uint32, error) {
+	key, err := lockupKey(contract, peerPubkey, address)
+	if err != nil {
+		return 0, err
+	}
+	lockupBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, key)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get lockup error!")
+	}
+	if lockupBytes == nil {
+		return 0, nil
+	}
+	lockupStore, ok := lockupBytes.(*cstates.StorageItem)
+	if !ok {
+		return 0, errors.NewErr("getLockup, lockupBytes is not available!")
+	}
+	unlockHeight, err := GetBytesUint32(lockupStore.Value)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "GetBytesUint32, get unlockHeight error!")
+	}
+	return unlockHeight, nil
+}
+
+func putLockup(native *native.NativeService, contract common.Address, peerPubkey string, address common.Address,
+	unlockHeight uint32) error {
+	key, err := lockupKey(contract, peerPubkey, address)
+	if err != nil {
+		return err
+	}
+	unlockHeightBytes, err := GetUint32Bytes(unlockHeight)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "GetUint32Bytes, get unlockHeightBytes error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, key, &cstates.StorageItem{Value: unlockHeightBytes})
+	return nil
+}
+
+// CanWithdraw reports whether the stake address has with peerPubkey can be
+// withdrawn at currentHeight, and the height its lockup ends at. Stake without
+// a lockup record can always be withdrawn.
+func CanWithdraw(native *native.NativeService, contract common.Address, peerPubkey string, address common.Address,
+	currentHeight uint32) (bool, uint32, error) {
+	unlockHeight, err := getLockup(native, contract, peerPubkey, address)
+	if err != nil {
+		return false, 0, err
+	}
+	return currentHeight >= unlockHeight, unlockHeight, nil
+}
+
+func getTotalStake(native *native.NativeService, contract common.Address, address common.Address) (*TotalStake, error) {
+	totalStakeBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(TOTAL_STAKE),
+		address[:]))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "get voteInfoBytes error!")
+	}
+	totalStake := &TotalStake{
+		Address: address,
 	}
-	if configuration.N < configuration.K || configuration.K < 7 {
-		return errors.NewErr("initConfig. config not match N >= K >= 7!")
+	if totalStakeBytes != nil {
+		totalStakeStore, ok := totalStakeBytes.(*cstates.StorageItem)
+		if !ok {
+			return nil, errors.NewErr("getTotalStake, totalStakeStore is not available!")
+		}
+		if err := totalStake.Deserialize(bytes.NewBuffer(totalStakeStore.Value)); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+		}
 	}
-	if configuration.BlockMsgDelay < 5000 {
-		return errors.NewErr("initConfig. BlockMsgDelay must >= 5000!")
+	return totalStake, nil
+}
+
+func putTotalStake(native *native.NativeService, contract common.Address, totalStake *TotalStake) error {
+	bf := new(bytes.Buffer)
+	if err := totalStake.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize voteInfo error!")
 	}
-	if configuration.HashMsgDelay < 5000 {
-		return errors.NewErr("initConfig. HashMsgDelay must >= 5000!")
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(TOTAL_STAKE), totalStake.Address[:]),
+		&cstates.StorageItem{Value: bf.Bytes()})
+	return nil
+}
+
+// getSplitCurve returns the stored split curve, the default Xi and Yi are used
+// for the parts which are not stored
+func getSplitCurve(native *native.NativeService, contract common.Address) (*SplitCurve, error) {
+	splitCurveBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_CURVE)))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitCurve, get splitCurveBytes error!")
 	}
-	if configuration.PeerHandshakeTimeout < 10 {
-		return errors.NewErr("initConfig. PeerHandshakeTimeout must >= 10!")
+	splitCurve := &SplitCurve{
+		Xi: Xi,
+		Yi: Yi,
 	}
-	if configuration.MinInitStake < 10000 {
-		return errors.NewErr("initConfig. MinInitStake must >= 10000!")
+	if splitCurveBytes != nil {
+		splitCurveStore, ok := splitCurveBytes.(*cstates.StorageItem)
+		if !ok {
+			return nil, errors.NewErr("getSplitCurve, splitCurveBytes is not available!")
+		}
+		if err := splitCurve.Deserialize(bytes.NewBuffer(splitCurveStore.Value)); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize splitCurve error!")
+		}
 	}
-	if len(configuration.VrfProof) < 128 {
-		return errors.NewErr("initConfig. VrfProof must >= 128!")
+
+	xiBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_CURVE_XI)))
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitCurve, get xiBytes error!")
 	}
-	if len(configuration.VrfValue) < 128 {
-		return errors.NewErr("initConfig. VrfValue must >= 128!")
+	if xiBytes != nil {
+		xiStore, ok := xiBytes.(*cstates.StorageItem)
+		if !ok {
+			return nil, errors.NewErr("getSplitCurve, xiBytes is not available!")
+		}
+		splitCurve.Xi, err = deserializeUint32Slice(bytes.NewBuffer(xiStore.Value))
+		if err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize xi error!")
+		}
 	}
+	return splitCurve, nil
+}
 
-	indexMap := make(map[uint32]struct{})
-	peerPubkeyMap := make(map[string]struct{})
-	for _, peer := range configuration.Peers {
-		_, ok := indexMap[peer.Index]
-		if ok {
-			return errors.NewErr("initConfig, peer index is duplicated!")
+// putSplitCurve stores Yi of splitCurve, and Xi if it is set
+func putSplitCurve(native *native.NativeService, contract common.Address, splitCurve *SplitCurve) error {
+	if splitCurve.Xi != nil && len(splitCurve.Xi) != len(splitCurve.Yi) {
+		return errors.NewErr("putSplitCurve, length of Xi is not equal to length of Yi!")
+	}
+	bf := new(bytes.Buffer)
+	if err := splitCurve.Serialize(bf); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize splitCurve error!")
+	}
+	var xi *bytes.Buffer
+	if splitCurve.Xi != nil {
+		xi = new(bytes.Buffer)
+		if err := serializeUint32Slice(xi, splitCurve.Xi); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize xi error!")
 		}
-		indexMap[peer.Index] = struct{}{}
+	}
+	// nothing is written unless the whole curve is valid
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_CURVE)), &cstates.StorageItem{Value: bf.Bytes()})
+	if xi != nil {
+		native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_CURVE_XI)), &cstates.StorageItem{Value: xi.Bytes()})
+	}
+	return nil
+}
 
-		_, ok = peerPubkeyMap[peer.PeerPubkey]
-		if ok {
-			return errors.NewErr("initConfig, peerPubkey is duplicated!")
+// GetSplitFee returns the accumulated split fee, 0 if nothing is stored yet
+func GetSplitFee(native *native.NativeService, contract common.Address) (uint64, error) {
+	splitFeeBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_FEE)))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "GetSplitFee, get splitFeeBytes error!")
+	}
+	if splitFeeBytes == nil {
+		return 0, nil
+	}
+	splitFeeStore, ok := splitFeeBytes.(*cstates.StorageItem)
+	if !ok {
+		return 0, errors.NewErr("GetSplitFee, splitFeeBytes is not available!")
+	}
+	splitFee, err := GetBytesUint64(splitFeeStore.Value)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getBytesUint64, deserialize splitFee error!")
+	}
+	return splitFee, nil
+}
+
+// PutSplitFee overwrites the accumulated split fee with amount
+func PutSplitFee(native *native.NativeService, contract common.Address, splitFee uint64) error {
+	splitFeeBytes, err := GetUint64Bytes(splitFee)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getUint64Bytes, serialize splitFee error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_FEE)), &cstates.StorageItem{Value: splitFeeBytes})
+	return nil
+}
+
+// addSplitFee adds amount to the accumulated split fee
+func addSplitFee(native *native.NativeService, contract common.Address, amount uint64) error {
+	splitFee, err := GetSplitFee(native, contract)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "GetSplitFee, get splitFee error!")
+	}
+	if splitFee+amount < splitFee {
+		return errors.NewErr("addSplitFee, splitFee overflow!")
+	}
+	return PutSplitFee(native, contract, splitFee+amount)
+}
+
+// ReconcileSplitFee returns the split fee recorded under SPLIT_FEE and the
+// ong balance the contract actually holds, for audits to compare. The balance
+// is read with GetOngBalanceReadOnly, nothing is written.
+func ReconcileSplitFee(native *native.NativeService, contract common.Address) (uint64, uint64, error) {
+	recorded, err := GetSplitFee(native, contract)
+	if err != nil {
+		return 0, 0, errors.NewDetailErr(err, errors.ErrNoCode, "reconcileSplitFee, get splitFee error!")
+	}
+	actual, err := GetOngBalanceReadOnly(native, contract)
+	if err != nil {
+		return 0, 0, errors.NewDetailErr(err, errors.ErrNoCode, "reconcileSplitFee, get ong balance error!")
+	}
+	return recorded, actual.Uint64(), nil
+}
+
+// getSplitFeeRemainder returns the carried split remainder, 0 if nothing is stored
+func getSplitFeeRemainder(native *native.NativeService, contract common.Address) (uint64, error) {
+	remainderBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_FEE_REMAINDER)))
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitFeeRemainder, get remainderBytes error!")
+	}
+	if remainderBytes == nil {
+		return 0, nil
+	}
+	remainderStore, ok := remainderBytes.(*cstates.StorageItem)
+	if !ok {
+		return 0, errors.NewErr("getSplitFeeRemainder, remainderBytes is not available!")
+	}
+	remainder, err := GetBytesUint64(remainderStore.Value)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "getBytesUint64, deserialize remainder error!")
+	}
+	return remainder, nil
+}
+
+func putSplitFeeRemainder(native *native.NativeService, contract common.Address, remainder uint64) error {
+	remainderBytes, err := GetUint64Bytes(remainder)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "getUint64Bytes, serialize remainder error!")
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_FEE_REMAINDER)), &cstates.StorageItem{Value: remainderBytes})
+	return nil
+}
+
+// splitAmounts divides pool among weights, amount i is pool * weights[i] / sum
+// of weights. The ong left over by truncation is returned as remainder, or
+// added to the first amount under SplitRemainderToTopPeer. Callers order
+// weights by stake descending.
+func splitAmounts(pool uint64, weights []uint64, policy RemainderPolicy) ([]uint64, uint64, error) {
+	sum := new(big.Int)
+	for _, w := range weights {
+		sum.Add(sum, new(big.Int).SetUint64(w))
+	}
+	if sum.Sign() == 0 {
+		return nil, 0, errors.NewErr("splitAmounts, sum of weights is 0!")
+	}
+	amounts := make([]uint64, len(weights))
+	var distributed uint64
+	for i, w := range weights {
+		amount := new(big.Int).SetUint64(pool)
+		amount.Mul(amount, new(big.Int).SetUint64(w))
+		amount.Quo(amount, sum)
+		// amount <= pool, and the amounts never sum past pool
+		amounts[i] = amount.Uint64()
+		distributed += amounts[i]
+	}
+	remainder := pool - distributed
+	if policy == SplitRemainderToTopPeer && len(amounts) > 0 {
+		amounts[0] += remainder
+		remainder = 0
+	}
+	return amounts, remainder, nil
+}
+
+// SplitPeerReward splits total between a peer and its delegators, the peer
+// takes commission of it. The delegator share is rounded down, so the
+// rounding remainder goes to the peer and the two shares always add up to
+// total.
+func SplitPeerReward(total uint64, commission BasisPoints) (uint64, uint64, error) {
+	if err := commission.Validate(); err != nil {
+		return 0, 0, errors.NewDetailErr(err, errors.ErrNoCode, "splitPeerReward, invalid commission!")
+	}
+	delegatorShare, err := (MAX_BASIS_POINTS - commission).Apply(total)
+	if err != nil {
+		return 0, 0, errors.NewDetailErr(err, errors.ErrNoCode, "splitPeerReward, delegator share error!")
+	}
+	return total - delegatorShare, delegatorShare, nil
+}
+
+func appCallInitContractAdmin(native *native.NativeService, adminOntID []byte) error {
+	bf := new(bytes.Buffer)
+	params := &auth.InitContractAdminParam{
+		AdminOntID: adminOntID,
+	}
+	err := params.Serialize(bf)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallInitContractAdmin, param serialize error!")
+	}
+
+	if _, err := native.NativeCall(utils.AuthContractAddress, "initContractAdmin", bf.Bytes()); err != nil {
+		return appCallError(err, "appCallInitContractAdmin", utils.AuthContractAddress, "initContractAdmin")
+	}
+	return nil
+}
+
+func appCallVerifyToken(native *native.NativeService, contract common.Address, caller []byte, fn string, keyNo uint64) error {
+	bf := new(bytes.Buffer)
+	params := &auth.VerifyTokenParam{
+		ContractAddr: contract,
+		Caller:       caller,
+		Fn:           fn,
+		KeyNo:        keyNo,
+	}
+	err := params.Serialize(bf)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallVerifyToken, param serialize error!")
+	}
+
+	value, err := native.NativeCall(utils.AuthContractAddress, "verifyToken", bf.Bytes())
+	if err != nil {
+		return appCallError(err, "appCallVerifyToken", utils.AuthContractAddress, "verifyToken")
+	}
+	result, ok := value.([]byte)
+	if !ok {
+		return errors.NewErr("appCallVerifyToken, verifyToken result is not []byte!")
+	}
+	if !bytes.Equal(result, utils.BYTE_TRUE) {
+		return errors.NewErr("appCallVerifyToken, verifyToken failed!")
+	}
+	return nil
+}
+
+// shuffleHash returns the shuffle hash used for the pos table of height
+func shuffleHash(algo HashAlgo, txid common.Uint256, height uint32, id string, idx int) (uint64, error) {
+	var data []byte
+	var err error
+	if height >= BINARY_SHUFFLE_HEIGHT {
+		data, err = shuffleHashBinaryInput(txid, height, id, idx)
+	} else {
+		data, err = shuffleHashJSONInput(txid, height, id, idx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch algo {
+	case HashAlgoFNV64a:
+		if height >= SHA256_SHUFFLE_HEIGHT {
+			return shufflehashV2(data), nil
 		}
-		peerPubkeyMap[peer.PeerPubkey] = struct{}{}
+		return shufflehash(data), nil
+	case HashAlgoSHA256_64:
+		return shufflehashV2(data), nil
+	case HashAlgoKeccak64:
+		return shufflehashKeccak(data), nil
+	}
+	return 0, fmt.Errorf("shuffleHash, unknown hash algo %d!", algo)
+}
+
+// shuffleHashJSONInput is the legacy hash input, it depends on the field order
+// of encoding/json and is only kept to replay old blocks
+func shuffleHashJSONInput(txid common.Uint256, height uint32, id string, idx int) ([]byte, error) {
+	return json.Marshal(struct {
+		Txid   common.Uint256 `json:"txid"`
+		Height uint32         `json:"height"`
+		NodeID string         `json:"node_id"`
+		Index  int            `json:"index"`
+	}{txid, height, id, idx})
+}
+
+// shuffleHashBinaryInput serializes txid, height, id and idx explicitly
+func shuffleHashBinaryInput(txid common.Uint256, height uint32, id string, idx int) ([]byte, error) {
+	if idx < 0 {
+		return nil, errors.NewErr("shuffleHashBinaryInput, index is negative!")
+	}
+	bf := new(bytes.Buffer)
+	if err := serialization.WriteVarBytes(bf, txid[:]); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteVarBytes, serialize txid error!")
+	}
+	if err := serialization.WriteUint32(bf, height); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteUint32, serialize height error!")
+	}
+	if err := serialization.WriteVarBytes(bf, []byte(id)); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteVarBytes, serialize id error!")
+	}
+	if err := serialization.WriteVarUint(bf, uint64(idx)); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteVarUint, serialize index error!")
+	}
+	return bf.Bytes(), nil
+}
+
+// shufflehashV2 is sha256 of data truncated to the first 8 bytes, read little endian
+func shufflehashV2(data []byte) uint64 {
+	hash := sha256.Sum256(data)
+	return binary.LittleEndian.Uint64(hash[:8])
+}
+
+// shufflehashKeccak is legacy keccak256 of data truncated to the first 8 bytes, read little endian
+func shufflehashKeccak(data []byte) uint64 {
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(data)
+	return binary.LittleEndian.Uint64(hash.Sum(nil)[:8])
+}
+
+func shufflehash(data []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hash.Sum64()
+}
+
+// GOVERNANCE_SNAPSHOT_VERSION is the format version of ExportGovernanceSnapshot
+const GOVERNANCE_SNAPSHOT_VERSION byte = 1
+
+type serializable interface {
+	Serialize(w io.Writer) error
+}
+
+// writeSnapshotPart writes v length prefixed, Configuration may end with
+// optional fields and can not be followed by other data directly
+func writeSnapshotPart(w io.Writer, v serializable) error {
+	bf := new(bytes.Buffer)
+	if err := v.Serialize(bf); err != nil {
+		return err
+	}
+	return serialization.WriteVarBytes(w, bf.Bytes())
+}
+
+func readSnapshotPart(r io.Reader, v interface {
+	Deserialize(r io.Reader) error
+}) error {
+	data, err := serialization.ReadVarBytes(r)
+	if err != nil {
+		return err
+	}
+	return v.Deserialize(bytes.NewBuffer(data))
+}
+
+// ExportGovernanceSnapshot serializes the Configuration, GovernanceView,
+// GlobalParam and the PeerPoolMaps of the current and the prior view.
+func ExportGovernanceSnapshot(native *native.NativeService, contract common.Address) ([]byte, error) {
+	config, err := GetConfiguration(native, contract)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
+	}
+	governanceView, err := GetGovernanceView(native, contract)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGovernanceView, get governanceView error!")
+	}
+	globalParam, err := getGlobalParam(native, contract)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGlobalParam, get globalParam error!")
+	}
+	peerPoolMap, err := GetPeerPoolMap(native, contract, governanceView.View)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
+	}
+	var priorPeerPoolMap *PeerPoolMap
+	if governanceView.View > 0 {
+		priorPeerPoolMap, err = loadPeerPoolMap(native, contract, governanceView.View-1)
+		if err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get prior peerPoolMap error!")
+		}
+	}
+
+	bf := new(bytes.Buffer)
+	if err := serialization.WriteByte(bf, GOVERNANCE_SNAPSHOT_VERSION); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteByte, serialize version error!")
+	}
+	for _, part := range []serializable{config, governanceView, globalParam, peerPoolMap} {
+		if err := writeSnapshotPart(bf, part); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "exportGovernanceSnapshot, serialize snapshot error!")
+		}
+	}
+	if err := serialization.WriteBool(bf, priorPeerPoolMap != nil); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "serialization.WriteBool, serialize prior flag error!")
+	}
+	if priorPeerPoolMap != nil {
+		if err := writeSnapshotPart(bf, priorPeerPoolMap); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "exportGovernanceSnapshot, serialize prior peerPoolMap error!")
+		}
+	}
+	return bf.Bytes(), nil
+}
+
+// ImportGovernanceSnapshot writes a snapshot made by ExportGovernanceSnapshot
+// to storage.
+func ImportGovernanceSnapshot(native *native.NativeService, contract common.Address, data []byte) error {
+	r := bytes.NewBuffer(data)
+	version, err := serialization.ReadByte(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadByte, deserialize version error!")
+	}
+	if version != GOVERNANCE_SNAPSHOT_VERSION {
+		return fmt.Errorf("importGovernanceSnapshot, unknown snapshot version %d!", version)
+	}
+	config := new(Configuration)
+	governanceView := new(GovernanceView)
+	globalParam := new(GlobalParam)
+	peerPoolMap := new(PeerPoolMap)
+	if err := readSnapshotPart(r, config); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "importGovernanceSnapshot, deserialize config error!")
+	}
+	if err := readSnapshotPart(r, governanceView); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "importGovernanceSnapshot, deserialize governanceView error!")
+	}
+	if err := readSnapshotPart(r, globalParam); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "importGovernanceSnapshot, deserialize globalParam error!")
+	}
+	if err := readSnapshotPart(r, peerPoolMap); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "importGovernanceSnapshot, deserialize peerPoolMap error!")
+	}
+	hasPrior, err := serialization.ReadBool(r)
+	if err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "serialization.ReadBool, deserialize prior flag error!")
+	}
+	var priorPeerPoolMap *PeerPoolMap
+	if hasPrior {
+		if governanceView.View == 0 {
+			return errors.NewErr("importGovernanceSnapshot, view 0 has no prior view!")
+		}
+		priorPeerPoolMap = new(PeerPoolMap)
+		if err := readSnapshotPart(r, priorPeerPoolMap); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "importGovernanceSnapshot, deserialize prior peerPoolMap error!")
+		}
+	}
+	if r.Len() != 0 {
+		return errors.NewErr("importGovernanceSnapshot, trailing data after snapshot!")
+	}
+	if err := config.Validate(); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "importGovernanceSnapshot, invalid config!")
+	}
+
+	if err := putConfig(native, contract, config); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "putConfig, put config error!")
+	}
+	if err := putGovernanceView(native, contract, governanceView); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "putGovernanceView, put governanceView error!")
+	}
+	if err := putGlobalParam(native, contract, globalParam); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "putGlobalParam, put globalParam error!")
+	}
+	if err := putPeerPoolMap(native, contract, governanceView.View, peerPoolMap); err != nil {
+		return errors.NewDetailErr(err, errors.ErrNoCode, "putPeerPoolMap, put peerPoolMap error!")
+	}
+	if priorPeerPoolMap != nil {
+		if err := putPeerPoolMap(native, contract, governanceView.View-1, priorPeerPoolMap); err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "putPeerPoolMap, put prior peerPoolMap error!")
+		}
+	}
+	return nil
+}
+
+// GetDposTableSnapshot builds the dpos table snapshot of the current view from
+// storage, the pos table is seeded with the tx hash and height recorded in the
+// governance view
+func GetDposTableSnapshot(native *native.NativeService, contract common.Address) (*DposTableSnapshot, error) {
+	governanceView, err := GetGovernanceView(native, contract)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getGovernanceView, get GovernanceView error!")
+	}
+	peerPoolMap, err := GetPeerPoolMap(native, contract, governanceView.View)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getPeerPoolMap, get peerPoolMap error!")
+	}
+	config, err := GetConfiguration(native, contract)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getConfiguration, get config error!")
+	}
 
-		if peer.Index <= 0 {
-			return errors.NewErr("initConfig, peer index in config must > 0!")
+	var peers []*PeerStakeInfo
+	err = peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if peerPoolItem.Status == CandidateStatus || peerPoolItem.Status == ConsensusStatus {
+			stake, err := PeerStake(peerPoolItem, governanceView.Height)
+			if err != nil {
+				return errors.NewDetailErr(err, errors.ErrNoCode, "getDposTableSnapshot, effective stake error!")
+			}
+			peers = append(peers, &PeerStakeInfo{
+				Index:      index,
+				PeerPubkey: peerPoolItem.PeerPubkey,
+				Stake:      stake,
+			})
 		}
-		//check peerPubkey
-		if err := validatePeerPubKeyFormat(peer.PeerPubkey); err != nil {
-			return errors.NewDetailErr(err, errors.ErrNoCode, "invalid peer pubkey")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return stakeOrderLess(governanceView.Height, peers[i], peers[j])
+	})
+
+	chainPeers, posTable, err := CalDposTableWithSeed(governanceView.TxHash, governanceView.Height, config, peers)
+	if err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "calDposTable, calculate dpos table error!")
+	}
+	return &DposTableSnapshot{
+		View:       governanceView.View,
+		Height:     governanceView.Height,
+		TxHash:     governanceView.TxHash.ToHexString(),
+		Peers:      peers,
+		ChainPeers: chainPeers,
+		PosTable:   posTable,
+	}, nil
+}
+
+// sortPeersByStake sorts peers by stake descending, ties are broken by Index
+// and then PeerPubkey ascending
+func sortPeersByStake(peers []*PeerStakeInfo) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		if peers[i].Stake != peers[j].Stake {
+			return peers[i].Stake > peers[j].Stake
 		}
-		_, err := common.AddressFromBase58(peer.Address)
-		if err != nil {
-			return errors.NewDetailErr(err, errors.ErrNoCode, "common.AddressFromBase58, address format error!")
+		if peers[i].Index != peers[j].Index {
+			return peers[i].Index < peers[j].Index
 		}
+		return peers[i].PeerPubkey < peers[j].PeerPubkey
+	})
+}
+
+// stakeOrderLess is the order the top K peers are selected in at block height:
+// stake descending, ties broken by Index and then PeerPubkey ascending. Before
+// INDEX_TIE_BREAK_HEIGHT ties are broken by PeerPubkey descending.
+func stakeOrderLess(height uint32, a, b *PeerStakeInfo) bool {
+	if a.Stake != b.Stake {
+		return a.Stake > b.Stake
 	}
-	return nil
+	if height < INDEX_TIE_BREAK_HEIGHT {
+		return a.PeerPubkey > b.PeerPubkey
+	}
+	if a.Index != b.Index {
+		return a.Index < b.Index
+	}
+	return a.PeerPubkey < b.PeerPubkey
 }
 
-func getConfig(native *native.NativeService, contract common.Address) (*Configuration, error) {
-	config := new(Configuration)
-	configBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VBFT_CONFIG)))
+// VrfShuffleSeed verifies that vrfValue and vrfProof are the VRF of msg
+// under peerPubkey and returns the shuffle seed derived from vrfValue
+func VrfShuffleSeed(peerPubkey string, msg, vrfValue, vrfProof []byte) (common.Uint256, error) {
+	pk, err := vbftconfig.Pubkey(peerPubkey)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get configBytes error!")
+		return common.Uint256{}, errors.NewDetailErr(err, errors.ErrNoCode, "vrfShuffleSeed, failed to parse pubkey!")
 	}
-	if configBytes == nil {
-		return nil, errors.NewErr("commitDpos, configBytes is nil!")
+	if !vrf.ValidatePublicKey(pk) {
+		return common.Uint256{}, errors.NewErr("vrfShuffleSeed, pubkey is invalid for VRF!")
 	}
-	configStore, ok := configBytes.(*cstates.StorageItem)
-	if !ok {
-		return nil, errors.NewErr("getConfig, configBytes is not available!")
+	ok, err := vrf.Verify(pk, msg, vrfValue, vrfProof)
+	if err != nil {
+		return common.Uint256{}, errors.NewDetailErr(err, errors.ErrNoCode, "vrfShuffleSeed, verify vrf error!")
 	}
-	if err := config.Deserialize(bytes.NewBuffer(configStore.Value)); err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize config error!")
+	if !ok {
+		return common.Uint256{}, errors.NewErr("vrfShuffleSeed, vrf proof is not valid!")
 	}
-	return config, nil
+	return common.Uint256(sha256.Sum256(vrfValue)), nil
 }
 
-func putConfig(native *native.NativeService, contract common.Address, config *Configuration) error {
-	bf := new(bytes.Buffer)
-	if err := config.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize config error!")
-	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VBFT_CONFIG)), &cstates.StorageItem{Value: bf.Bytes()})
-	return nil
+// IsEligibleProposer verifies that vrfValue and vrfProof are the VRF of msg
+// under pubkey and reports whether vrfValue selects slot of posTable. The
+// value selects slot v % len(posTable), v being its first two bytes read
+// little endian, the mapping vbft's calcParticipant uses for the first
+// proposer. A proof which does not verify is an error.
+func IsEligibleProposer(vrfProof, vrfValue []byte, pubkey string, msg []byte, posTable []uint32, slot int) (bool, error) {
+	if len(posTable) == 0 {
+		return false, errors.NewErr("isEligibleProposer, pos table is empty!")
+	}
+	if slot < 0 || slot >= len(posTable) {
+		return false, fmt.Errorf("isEligibleProposer, slot %d is out of the pos table of length %d!", slot, len(posTable))
+	}
+	if _, err := VrfShuffleSeed(pubkey, msg, vrfValue, vrfProof); err != nil {
+		return false, errors.NewDetailErr(err, errors.ErrNoCode, "isEligibleProposer, invalid vrf!")
+	}
+	if len(vrfValue) < 2 {
+		return false, errors.NewErr("isEligibleProposer, vrf value is too short!")
+	}
+	v := uint32(binary.LittleEndian.Uint16(vrfValue[:2]))
+	return int(v%uint32(len(posTable))) == slot, nil
 }
 
-func getCandidateIndex(native *native.NativeService, contract common.Address) (uint32, error) {
-	candidateIndexBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(CANDIDITE_INDEX)))
+// CalDposTableWithSeed computes the consensus peers and the shuffled pos table
+// of the top K peers, seeding the shuffle with (seed, height). peers may be in
+// any order. It does not touch any chain state, so it can be used offline to
+// predict the consensus rotation. GlobalParam2.MaxCandidateNum is not applied,
+// commitDpos enforces it when the view is committed.
+func CalDposTableWithSeed(seed common.Uint256, height uint32, config *Configuration,
+	peers []*PeerStakeInfo) (map[uint32]*vbftconfig.PeerConfig, []uint32, error) {
+	_, chainPeers, posTable, err := calDposTable(seed, height, config, peers, 0)
+	return chainPeers, posTable, err
+}
+
+// CalChainConfig returns the vbft chain config of the top K peers with the pos
+// table of CalDposTableWithSeed. vbft builds the chain config of every view
+// after genesis with it, at genesis height it matches GenesisChainConfig.
+func CalChainConfig(seed common.Uint256, height uint32, config *Configuration,
+	peers []*PeerStakeInfo) (*vbftconfig.ChainConfig, error) {
+	peers, chainPeers, posTable, err := calDposTable(seed, height, config, peers, 0)
 	if err != nil {
-		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "native.CloneCache.Get, get candidateIndex error!")
+		return nil, err
+	}
+	peerCfgs := make([]*vbftconfig.PeerConfig, 0, len(peers))
+	for _, peer := range peers {
+		peerCfgs = append(peerCfgs, chainPeers[peer.Index])
+	}
+	return &vbftconfig.ChainConfig{
+		Version:              1,
+		View:                 1,
+		N:                    config.K,
+		C:                    config.C,
+		BlockMsgDelay:        time.Duration(config.BlockMsgDelay) * time.Millisecond,
+		HashMsgDelay:         time.Duration(config.HashMsgDelay) * time.Millisecond,
+		PeerHandshakeTimeout: time.Duration(config.PeerHandshakeTimeout) * time.Second,
+		Peers:                peerCfgs,
+		PosTable:             posTable,
+		MaxBlockChangeView:   config.MaxBlockChangeView,
+	}, nil
+}
+
+// calDposTable returns the top K peers in stake order, their peer configs and
+// the shuffled pos table. From MAX_CANDIDATE_NUM_HEIGHT on more peers than a
+// non zero maxCandidateNum are rejected before any table is built.
+func calDposTable(seed common.Uint256, height uint32, config *Configuration, peers []*PeerStakeInfo,
+	maxCandidateNum uint32) ([]*PeerStakeInfo, map[uint32]*vbftconfig.PeerConfig, []uint32, error) {
+	if height >= MAX_CANDIDATE_NUM_HEIGHT && maxCandidateNum != 0 && uint64(len(peers)) > uint64(maxCandidateNum) {
+		return nil, nil, nil, fmt.Errorf("calDposTable, peer count %d exceeds MaxCandidateNum %d!", len(peers), maxCandidateNum)
+	}
+	peers, peerRanks, err := calPeerRanks(config, peers, height)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	if candidateIndexBytes == nil {
-		return 0, errors.NewErr("approveCandidate, candidateIndex is not init!")
-	} else {
-		candidateIndexStore, ok := candidateIndexBytes.(*cstates.StorageItem)
-		if !ok {
-			return 0, errors.NewErr("getCandidateIndex, candidateIndexBytes is not available!")
-		}
-		candidateIndex, err := GetBytesUint32(candidateIndexStore.Value)
-		if err != nil {
-			return 0, errors.NewDetailErr(err, errors.ErrNoCode, "GetBytesUint32, get candidateIndex error!")
+	peers = peers[:config.K]
+
+	chainPeers, err := BuildPeerConfigs(peers)
+	if err != nil {
+		return nil, nil, nil, errors.NewDetailErr(err, errors.ErrNoCode, "calDposTable, buildPeerConfigs error!")
+	}
+
+	// calculate pos table
+	posTable := make([]uint32, 0)
+	for i := 0; i < int(config.K); i++ {
+		for j := uint64(0); j < peerRanks[i]; j++ {
+			posTable = append(posTable, peers[i].Index)
 		}
-		return candidateIndex, nil
 	}
-}
 
-func putCandidateIndex(native *native.NativeService, contract common.Address, candidateIndex uint32) error {
-	candidateIndexBytes, err := GetUint32Bytes(candidateIndex)
+	// shuffle
+	posTable, err = ShufflePeersWithHashAlgo(config.HashAlgo, seed, height, posTable, chainPeers)
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "GetUint32Bytes, get newCandidateIndexBytes error!")
+		return nil, nil, nil, errors.NewDetailErr(err, errors.ErrNoCode, "calDposTable, shufflePeers error!")
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(CANDIDITE_INDEX)),
-		&cstates.StorageItem{Value: candidateIndexBytes})
-	return nil
+
+	return peers, chainPeers, posTable, nil
 }
 
-func getVoteInfo(native *native.NativeService, contract common.Address, peerPubkey string, address common.Address) (*VoteInfo, error) {
-	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+// dposTableFingerprint returns the hex sha256 of the chain peers, in Index
+// order, and the pos table CalDposTableWithSeed computes, or the error it
+// fails with. Golden fingerprints of fixed inputs pin the table across
+// releases, any change of the output is a consensus change.
+func dposTableFingerprint(config *Configuration, peers []*PeerStakeInfo, seed common.Uint256, height uint32) string {
+	chainPeers, posTable, err := CalDposTableWithSeed(seed, height, config, peers)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+		return "error: " + err.Error()
 	}
-	voteInfoBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VOTE_INFO_POOL),
-		peerPubkeyPrefix, address[:]))
-	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "get voteInfoBytes error!")
+	indexes := make([]uint32, 0, len(chainPeers))
+	for index := range chainPeers {
+		indexes = append(indexes, index)
 	}
-	voteInfo := &VoteInfo{
-		PeerPubkey: peerPubkey,
-		Address:    address,
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	bf := new(bytes.Buffer)
+	serialization.WriteUint32(bf, uint32(len(indexes)))
+	for _, index := range indexes {
+		serialization.WriteUint32(bf, index)
+		serialization.WriteString(bf, chainPeers[index].ID)
 	}
-	if voteInfoBytes != nil {
-		voteInfoStore, ok := voteInfoBytes.(*cstates.StorageItem)
-		if !ok {
-			return nil, errors.NewErr("getVoteInfo, voteInfoBytes is not available!")
+	serialization.WriteUint32(bf, uint32(len(posTable)))
+	for _, index := range posTable {
+		serialization.WriteUint32(bf, index)
+	}
+	sum := sha256.Sum256(bf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// BuildPeerConfigs returns the vbft peer configs of peers keyed by Index.
+// Every PeerPubkey must parse as a pubkey, the ID keeps the pubkey string as
+// given so it matches the ID the peers use on the chain.
+func BuildPeerConfigs(peers []*PeerStakeInfo) (map[uint32]*vbftconfig.PeerConfig, error) {
+	chainPeers := make(map[uint32]*vbftconfig.PeerConfig, len(peers))
+	for _, peer := range peers {
+		if _, err := vbftconfig.Pubkey(peer.PeerPubkey); err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode,
+				fmt.Sprintf("buildPeerConfigs, invalid pubkey %s of peer %d!", peer.PeerPubkey, peer.Index))
 		}
-		if err := voteInfo.Deserialize(bytes.NewBuffer(voteInfoStore.Value)); err != nil {
-			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+		chainPeers[peer.Index] = &vbftconfig.PeerConfig{
+			Index: peer.Index,
+			ID:    peer.PeerPubkey,
 		}
 	}
-	return voteInfo, nil
+	return chainPeers, nil
 }
 
-func putVoteInfo(native *native.NativeService, contract common.Address, voteInfo *VoteInfo) error {
-	peerPubkeyPrefix, err := hex.DecodeString(voteInfo.PeerPubkey)
-	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+// CheckTableStarvation returns the indexes of chainPeers which get no slot
+// in posTable, in ascending order. Such peers are consensus peers in name
+// only and never propose a block.
+func CheckTableStarvation(posTable []uint32, chainPeers map[uint32]*vbftconfig.PeerConfig) []uint32 {
+	slots := make(map[uint32]int, len(chainPeers))
+	for _, index := range posTable {
+		slots[index]++
+	}
+	starved := make([]uint32, 0)
+	for index := range chainPeers {
+		if slots[index] == 0 {
+			starved = append(starved, index)
+		}
 	}
-	bf := new(bytes.Buffer)
-	if err := voteInfo.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize voteInfo error!")
+	sort.Slice(starved, func(i, j int) bool { return starved[i] < starved[j] })
+	return starved
+}
+
+// PosTableGiniCoefficient returns the Gini coefficient of the slot counts of
+// the indexes in posTable: 0 when every index has the same number of slots,
+// approaching 1 as the slots concentrate on one index. Indexes without a slot
+// are not counted, an empty table yields 0. For display only, never feed the
+// float result back into consensus.
+func PosTableGiniCoefficient(posTable []uint32) float64 {
+	slots := make(map[uint32]uint64)
+	for _, index := range posTable {
+		slots[index]++
+	}
+	counts := make([]uint64, 0, len(slots))
+	for _, count := range slots {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	n := float64(len(counts))
+	if n == 0 {
+		return 0
+	}
+	// G = 2 * sum(i * x_i) / (n * sum(x_i)) - (n + 1) / n, x ascending, i from 1
+	var weighted float64
+	for i, count := range counts {
+		weighted += float64(i+1) * float64(count)
+	}
+	return 2*weighted/(n*float64(len(posTable))) - (n+1)/n
+}
+
+// RewardPerSlot returns the ONG each slot of posTable earns when splitFee is
+// shared evenly over the table, rounded down. The remainder of up to
+// len(posTable)-1 ONG is not attributed to any slot. For projections only,
+// executeSplit pays by stake, not by slot.
+func RewardPerSlot(splitFee uint64, posTable []uint32) (uint64, error) {
+	if len(posTable) == 0 {
+		return 0, errors.NewErr("rewardPerSlot, pos table is empty!")
+	}
+	return splitFee / uint64(len(posTable)), nil
+}
+
+// ExpectedBlocks returns how many of epochBlocks blocks peerIndex proposes
+// when proposers are taken from posTable in turn: its slot count times
+// epochBlocks over the table length, rounded down. The product is taken in
+// uint64 so it can not overflow, an empty table yields 0.
+func ExpectedBlocks(posTable []uint32, peerIndex uint32, epochBlocks uint32) uint32 {
+	if len(posTable) == 0 {
+		return 0
+	}
+	var slots uint64
+	for _, index := range posTable {
+		if index == peerIndex {
+			slots++
+		}
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(VOTE_INFO_POOL), peerPubkeyPrefix,
-		voteInfo.Address[:]), &cstates.StorageItem{Value: bf.Bytes()})
-	return nil
+	return uint32(slots * uint64(epochBlocks) / uint64(len(posTable)))
 }
 
-func getPenaltyStake(native *native.NativeService, contract common.Address, peerPubkey string) (*PenaltyStake, error) {
-	peerPubkeyPrefix, err := hex.DecodeString(peerPubkey)
+// DposTableStats returns the number of pos table slots each of the top K
+// peers gets at block height, keyed by Index, without shuffling or touching
+// chain state.
+func DposTableStats(config *Configuration, peers []*PeerStakeInfo, height uint32) (map[uint32]uint64, error) {
+	peers, peerRanks, err := calPeerRanks(config, peers, height)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+		return nil, err
 	}
-	penaltyStakeBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PENALTY_STAKE),
-		peerPubkeyPrefix))
+	stats := make(map[uint32]uint64, len(peerRanks))
+	for i, rank := range peerRanks {
+		stats[peers[i].Index] = rank
+	}
+	return stats, nil
+}
+
+// EstimateTableSize returns the length of the pos table calDposTable builds
+// for config and peers at block height, the sum of the ranks of the top K
+// peers, without building or shuffling the table.
+func EstimateTableSize(config *Configuration, peers []*PeerStakeInfo, height uint32) (uint64, error) {
+	_, peerRanks, err := calPeerRanks(config, peers, height)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "get voteInfoBytes error!")
+		return 0, err
 	}
-	penaltyStake := &PenaltyStake{
-		PeerPubkey: peerPubkey,
+	var length uint64
+	for _, rank := range peerRanks {
+		length += rank
 	}
-	if penaltyStakeBytes != nil {
-		penaltyStakeStore, ok := penaltyStakeBytes.(*cstates.StorageItem)
-		if !ok {
-			return nil, errors.NewErr("getPenaltyStake, penaltyStakeBytes is not available!")
+	return length, nil
+}
+
+// ComputeViewTransition returns the peer pool of the view after current:
+// quitting and blacklisted peers are dropped, peers quitting consensus move
+// to quitting, the top K candidate and consensus peers by stake become
+// consensus peers and the rest candidates. Stake ties are broken as at block
+// height, see stakeOrderLess. current is not modified and no storage is
+// written, callers persist the result.
+func ComputeViewTransition(current *PeerPoolMap, config *Configuration, height uint32) (*PeerPoolMap, error) {
+	next, _, err := computeViewTransition(current, config, height)
+	return next, err
+}
+
+// computeViewTransition is ComputeViewTransition, it also returns the
+// candidate and consensus peers of current in the order the top K are
+// selected in
+func computeViewTransition(current *PeerPoolMap, config *Configuration, height uint32) (*PeerPoolMap, []*PeerStakeInfo, error) {
+	next := &PeerPoolMap{
+		PeerPoolMap: make(map[string]*PeerPoolItem, len(current.PeerPoolMap)),
+		Version:     current.Version,
+	}
+	if current.Version >= 1 {
+		next.View = current.View + 1
+	}
+
+	var peers []*PeerStakeInfo
+	err := current.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if peerPoolItem.Status == QuitingStatus || peerPoolItem.Status == BlackStatus {
+			return nil
 		}
-		if err := penaltyStake.Deserialize(bytes.NewBuffer(penaltyStakeStore.Value)); err != nil {
-			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+		item := *peerPoolItem
+		if item.Status == QuitConsensusStatus {
+			item.Status = QuitingStatus
+		}
+		if item.Status == CandidateStatus || item.Status == ConsensusStatus {
+			stake, err := PeerStake(&item, height)
+			if err != nil {
+				return errors.NewDetailErr(err, errors.ErrNoCode, "commitDpos, effective stake error!")
+			}
+			peers = append(peers, &PeerStakeInfo{
+				Index:      index,
+				PeerPubkey: item.PeerPubkey,
+				Stake:      stake,
+			})
+		}
+		next.PeerPoolMap[item.PeerPubkey] = &item
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(peers) < int(config.K) {
+		return nil, nil, errors.NewErr("commitDpos, num of peers is less than K!")
+	}
+
+	// sort peers by stake
+	sort.SliceStable(peers, func(i, j int) bool {
+		return stakeOrderLess(height, peers[i], peers[j])
+	})
+
+	for i, peer := range peers {
+		if i < int(config.K) {
+			next.PeerPoolMap[peer.PeerPubkey].Status = ConsensusStatus
+		} else {
+			next.PeerPoolMap[peer.PeerPubkey].Status = CandidateStatus
 		}
 	}
-	return penaltyStake, nil
+	return next, peers, nil
 }
 
-func putPenaltyStake(native *native.NativeService, contract common.Address, penaltyStake *PenaltyStake) error {
-	peerPubkeyPrefix, err := hex.DecodeString(penaltyStake.PeerPubkey)
+// ApplyKChange returns a copy of current with the consensus set resized from
+// oldK to newK peers: the top newK candidate and consensus peers by stake, see
+// sortPeersByStake, become consensus peers and the rest candidates, so a
+// shrinking K demotes the smallest consensus peers. Peers in other states are
+// copied as they are. config must be valid with K set to newK. current is not
+// modified and no storage is written.
+func ApplyKChange(current *PeerPoolMap, oldK, newK uint32, config *Configuration) (*PeerPoolMap, error) {
+	newConfig := *config
+	newConfig.K = newK
+	if err := newConfig.Validate(); err != nil {
+		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "applyKChange, invalid config for new K!")
+	}
+	next := &PeerPoolMap{
+		PeerPoolMap: make(map[string]*PeerPoolItem, len(current.PeerPoolMap)),
+		Version:     current.Version,
+		View:        current.View,
+	}
+	var peers []*PeerStakeInfo
+	var consensusNum uint32
+	err := current.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		item := *peerPoolItem
+		next.PeerPoolMap[item.PeerPubkey] = &item
+		if item.Status != CandidateStatus && item.Status != ConsensusStatus {
+			return nil
+		}
+		if item.Status == ConsensusStatus {
+			consensusNum++
+		}
+		stake, err := item.EffectiveStake()
+		if err != nil {
+			return errors.NewDetailErr(err, errors.ErrNoCode, "applyKChange, effective stake error!")
+		}
+		peers = append(peers, &PeerStakeInfo{
+			Index:      index,
+			PeerPubkey: item.PeerPubkey,
+			Stake:      stake,
+		})
+		return nil
+	})
 	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "hex.DecodeString, peerPubkey format error!")
+		return nil, err
 	}
-	bf := new(bytes.Buffer)
-	if err := penaltyStake.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize voteInfo error!")
+	if consensusNum > oldK {
+		return nil, fmt.Errorf("applyKChange, %d consensus peers is more than old K(%d)!", consensusNum, oldK)
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PENALTY_STAKE), peerPubkeyPrefix),
-		&cstates.StorageItem{Value: bf.Bytes()})
-	return nil
+	if uint32(len(peers)) < newK {
+		return nil, fmt.Errorf("applyKChange, %d peers is less than new K(%d)!", len(peers), newK)
+	}
+	sortPeersByStake(peers)
+	for i, peer := range peers {
+		if i < int(newK) {
+			next.PeerPoolMap[peer.PeerPubkey].Status = ConsensusStatus
+		} else {
+			next.PeerPoolMap[peer.PeerPubkey].Status = CandidateStatus
+		}
+	}
+	return next, nil
 }
 
-func getTotalStake(native *native.NativeService, contract common.Address, address common.Address) (*TotalStake, error) {
-	totalStakeBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(TOTAL_STAKE),
-		address[:]))
+// MinConsensusStake returns the stake of the K-th largest candidate or
+// consensus peer of view, the stake a peer needs to enter the consensus set at
+// the next commitDpos. It returns 0 when there are fewer than K such peers.
+func MinConsensusStake(native *native.NativeService, contract common.Address, view uint32) (uint64, error) {
+	config, err := GetConfiguration(native, contract)
 	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "get voteInfoBytes error!")
-	}
-	totalStake := &TotalStake{
-		Address: address,
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "minConsensusStake, get configuration error!")
 	}
-	if totalStakeBytes != nil {
-		totalStakeStore, ok := totalStakeBytes.(*cstates.StorageItem)
-		if !ok {
-			return nil, errors.NewErr("getTotalStake, totalStakeStore is not available!")
-		}
-		if err := totalStake.Deserialize(bytes.NewBuffer(totalStakeStore.Value)); err != nil {
-			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize voteInfo error!")
+	peerPoolMap, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		return 0, errors.NewDetailErr(err, errors.ErrNoCode, "minConsensusStake, get peerPoolMap error!")
+	}
+	var stakes []uint64
+	err = peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if peerPoolItem.Status == CandidateStatus || peerPoolItem.Status == ConsensusStatus {
+			stake, err := peerPoolItem.EffectiveStake()
+			if err != nil {
+				return errors.NewDetailErr(err, errors.ErrNoCode, "minConsensusStake, effective stake error!")
+			}
+			stakes = append(stakes, stake)
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return totalStake, nil
+	if config.K == 0 || len(stakes) < int(config.K) {
+		return 0, nil
+	}
+	sort.Slice(stakes, func(i, j int) bool { return stakes[i] > stakes[j] })
+	return stakes[config.K-1], nil
 }
 
-func putTotalStake(native *native.NativeService, contract common.Address, totalStake *TotalStake) error {
-	bf := new(bytes.Buffer)
-	if err := totalStake.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize voteInfo error!")
+// PeerRank returns the 1-based position of pubkey among the candidate and
+// consensus peers of view ordered as commitDpos ranks them at the current
+// height, and the number of ranked peers. rank is 0 if pubkey is not one of
+// them.
+func PeerRank(native *native.NativeService, contract common.Address, view uint32, pubkey string) (int, int, error) {
+	peerPoolMap, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		return 0, 0, errors.NewDetailErr(err, errors.ErrNoCode, "peerRank, get peerPoolMap error!")
+	}
+	var peers []*PeerStakeInfo
+	err = peerPoolMap.ForEachSorted(func(index uint32, peerPoolItem *PeerPoolItem) error {
+		if peerPoolItem.Status == CandidateStatus || peerPoolItem.Status == ConsensusStatus {
+			stake, err := peerPoolItem.EffectiveStake()
+			if err != nil {
+				return errors.NewDetailErr(err, errors.ErrNoCode, "peerRank, effective stake error!")
+			}
+			peers = append(peers, &PeerStakeInfo{
+				Index:      index,
+				PeerPubkey: peerPoolItem.PeerPubkey,
+				Stake:      stake,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(TOTAL_STAKE), totalStake.Address[:]),
-		&cstates.StorageItem{Value: bf.Bytes()})
-	return nil
+	sort.SliceStable(peers, func(i, j int) bool {
+		return stakeOrderLess(native.Height, peers[i], peers[j])
+	})
+	for i, peer := range peers {
+		if EqualPubkey(peer.PeerPubkey, pubkey) {
+			return i + 1, len(peers), nil
+		}
+	}
+	return 0, len(peers), nil
 }
 
-func getSplitCurve(native *native.NativeService, contract common.Address) (*SplitCurve, error) {
-	splitCurveBytes, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_CURVE)))
-	if err != nil {
-		return nil, errors.NewDetailErr(err, errors.ErrNoCode, "getSplitCurve, get splitCurveBytes error!")
+// calPeerRanks returns a copy of peers sorted by stake as at block height and
+// the pos table slot counts of its first K entries
+func calPeerRanks(config *Configuration, peers []*PeerStakeInfo, height uint32) ([]*PeerStakeInfo, []uint64, error) {
+	// K divides L below
+	if config.K == 0 {
+		return nil, nil, errors.NewErr("calDposTable, K can not be 0!")
+	}
+	if uint32(len(peers)) < config.K {
+		return nil, nil, errors.NewErr("calDposTable, peer count is less than K!")
+	}
+	if height >= UNIQUE_PEER_INDEX_HEIGHT {
+		if err := checkUniquePeerIndex(peers); err != nil {
+			return nil, nil, err
+		}
 	}
-	splitCurve := new(SplitCurve)
-	if splitCurveBytes == nil {
-		return nil, errors.NewErr("getSplitCurve, get nil splitCurveBytes!")
-	} else {
-		splitCurveStore, ok := splitCurveBytes.(*cstates.StorageItem)
-		if !ok {
-			return nil, errors.NewErr("getSplitCurve, splitCurveBytes is not available!")
+	peers = append([]*PeerStakeInfo(nil), peers...)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return stakeOrderLess(height, peers[i], peers[j])
+	})
+	// get stake sum of top-k peers
+	var sum uint64
+	for i := 0; i < int(config.K); i++ {
+		if height < POS_TABLE_CHECK_HEIGHT {
+			sum += peers[i].Stake
+			continue
 		}
-		if err := splitCurve.Deserialize(bytes.NewBuffer(splitCurveStore.Value)); err != nil {
-			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "deserialize, deserialize splitCurve error!")
+		var err error
+		if sum, err = addChecked(sum, peers[i].Stake); err != nil {
+			return nil, nil, errors.NewDetailErr(err, errors.ErrNoCode,
+				fmt.Sprintf("calDposTable, stake sum of top K peers overflows at peer %d!", peers[i].Index))
+		}
+	}
+	// every top K peer would get the same single slot, only corrupt storage
+	// leads here
+	if sum == 0 && height >= POS_TABLE_CHECK_HEIGHT {
+		return nil, nil, errors.NewErr("calDposTable, stake sum of top K peers is 0!")
+	}
+	// ranks use the stakes capped at MaxStakeRatio of the sum, the slots a
+	// capped peer loses go to the others through the smaller sum
+	stakes := make([]uint64, config.K)
+	for i := 0; i < int(config.K); i++ {
+		stakes[i] = peers[i].Stake
+	}
+	if config.MaxStakeRatio != 0 {
+		limit := new(big.Int).SetUint64(sum)
+		limit.Mul(limit, new(big.Int).SetUint64(uint64(config.MaxStakeRatio)))
+		limit.Quo(limit, big.NewInt(10000))
+		sum = 0
+		for i := range stakes {
+			if stakes[i] > limit.Uint64() {
+				stakes[i] = limit.Uint64()
+			}
+			sum += stakes[i]
 		}
 	}
-	return splitCurve, nil
-}
 
-func putSplitCurve(native *native.NativeService, contract common.Address, splitCurve *SplitCurve) error {
-	bf := new(bytes.Buffer)
-	if err := splitCurve.Serialize(bf); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "serialize, serialize splitCurve error!")
+	// calculate peer ranks
+	scale := config.L/config.K - 1
+	if scale <= 0 {
+		return nil, nil, errors.NewErr("calDposTable, L is equal or less than K!")
 	}
-	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SPLIT_CURVE)), &cstates.StorageItem{Value: bf.Bytes()})
-	return nil
-}
 
-func appCallInitContractAdmin(native *native.NativeService, adminOntID []byte) error {
-	bf := new(bytes.Buffer)
-	params := &auth.InitContractAdminParam{
-		AdminOntID: adminOntID,
+	peerRanks := make([]uint64, 0)
+	for i := 0; i < int(config.K); i++ {
+		var s uint64 = 1
+		if sum > 0 && stakes[i] > 0 {
+			s = vbftconfig.CalcPeerRank(stakes[i], uint64(scale), uint64(config.K), sum)
+		}
+		peerRanks = append(peerRanks, s)
 	}
-	err := params.Serialize(bf)
-	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallInitContractAdmin, param serialize error!")
+	var length uint64
+	for _, rank := range peerRanks {
+		var err error
+		if length, err = addChecked(length, rank); err != nil {
+			return nil, nil, errors.NewDetailErr(err, errors.ErrNoCode, "calDposTable, pos table length overflows uint64!")
+		}
 	}
+	if err := checkPosTableLength(config, length); err != nil {
+		return nil, nil, err
+	}
+	return peers, peerRanks, nil
+}
 
-	if _, err := native.NativeCall(utils.AuthContractAddress, "initContractAdmin", bf.Bytes()); err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallInitContractAdmin, appCall error!")
+// checkUniquePeerIndex checks that no two peers share an Index, chainPeers
+// is keyed by Index and a duplicate would silently replace a peer.
+func checkUniquePeerIndex(peers []*PeerStakeInfo) error {
+	pubkeys := make(map[uint32]string, len(peers))
+	for _, peer := range peers {
+		if pubkey, ok := pubkeys[peer.Index]; ok {
+			return fmt.Errorf("calDposTable, index %d is shared by peer %s and %s!", peer.Index, pubkey, peer.PeerPubkey)
+		}
+		pubkeys[peer.Index] = peer.PeerPubkey
 	}
 	return nil
 }
 
-func appCallVerifyToken(native *native.NativeService, contract common.Address, caller []byte, fn string, keyNo uint64) error {
-	bf := new(bytes.Buffer)
-	params := &auth.VerifyTokenParam{
-		ContractAddr: contract,
-		Caller:       caller,
-		Fn:           fn,
-		KeyNo:        keyNo,
-	}
-	err := params.Serialize(bf)
-	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallVerifyToken, param serialize error!")
+// checkPeerIndexFree checks that no peer in peerPoolMap other than
+// peerPubkey holds index. Registered peers are skipped, they get their Index
+// on approval.
+func checkPeerIndexFree(peerPoolMap *PeerPoolMap, index uint32, peerPubkey string) error {
+	for _, item := range peerPoolMap.PeerPoolMap {
+		if item.Status == RegisterCandidateStatus || item.Index != index || EqualPubkey(item.PeerPubkey, peerPubkey) {
+			continue
+		}
+		return fmt.Errorf("checkPeerIndexFree, index %d is already held by peer %s!", index, item.PeerPubkey)
 	}
+	return nil
+}
 
-	ok, err := native.NativeCall(utils.AuthContractAddress, "verifyToken", bf.Bytes())
-	if err != nil {
-		return errors.NewDetailErr(err, errors.ErrNoCode, "appCallVerifyToken, appCall error!")
+// POS_TABLE_LENGTH_FACTOR bounds the pos table length to a multiple of
+// config.L. The ranks of a sane config never add up to more than L, the
+// bound only catches corrupt configs before the table bloats state.
+const POS_TABLE_LENGTH_FACTOR = 2
+
+// checkPosTableLength checks that a pos table of length slots gives every
+// top K peer at least one slot and stays within POS_TABLE_LENGTH_FACTOR*L
+func checkPosTableLength(config *Configuration, length uint64) error {
+	if length < uint64(config.K) {
+		return fmt.Errorf("calDposTable, pos table length %d is less than K(%d)!", length, config.K)
 	}
-	if !bytes.Equal(ok.([]byte), utils.BYTE_TRUE) {
-		return errors.NewErr("appCallVerifyToken, verifyToken failed!")
+	if length > POS_TABLE_LENGTH_FACTOR*uint64(config.L) {
+		return fmt.Errorf("calDposTable, pos table length %d is larger than %d*L(%d)!", length, POS_TABLE_LENGTH_FACTOR, config.L)
 	}
 	return nil
 }
+
+// ShufflePeers returns the shuffled copy of posTable that calDposTable produces
+// for seed and height, posTable itself is left untouched. Every index in
+// posTable must have an entry in chainPeers.
+func ShufflePeers(seed common.Uint256, height uint32, posTable []uint32,
+	chainPeers map[uint32]*vbftconfig.PeerConfig) ([]uint32, error) {
+	return ShufflePeersWithHashAlgo(HashAlgoFNV64a, seed, height, posTable, chainPeers)
+}
+
+// ShufflePeersWithHashAlgo is ShufflePeers hashing with algo
+func ShufflePeersWithHashAlgo(algo HashAlgo, seed common.Uint256, height uint32, posTable []uint32,
+	chainPeers map[uint32]*vbftconfig.PeerConfig) ([]uint32, error) {
+	shuffled := make([]uint32, len(posTable))
+	copy(shuffled, posTable)
+	for i := len(shuffled) - 1; i > 0; i-- {
+		peer, ok := chainPeers[shuffled[i]]
+		if !ok || peer == nil {
+			return nil, fmt.Errorf("shufflePeers, peer %d of pos table is not in chainPeers", shuffled[i])
+		}
+		h, err := shuffleHash(algo, seed, height, peer.ID, i)
+		if err != nil {
+			return nil, errors.NewDetailErr(err, errors.ErrNoCode, "shufflePeers, failed to calculate hash value!")
+		}
+		var j uint64
+		if height >= UNBIASED_SHUFFLE_HEIGHT {
+			j = h % uint64(i+1)
+		} else {
+			j = h % uint64(i)
+		}
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled, nil
+}
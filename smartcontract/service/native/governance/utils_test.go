@@ -0,0 +1,4055 @@
+/*
+ * Copyright (C) 2018 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package governance
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ontio/ontology-crypto/ec"
+	"github.com/ontio/ontology-crypto/keypair"
+	"github.com/ontio/ontology-crypto/vrf"
+	"github.com/ontio/ontology/common"
+	"github.com/ontio/ontology/common/config"
+	"github.com/ontio/ontology/common/log"
+	vbftconfig "github.com/ontio/ontology/consensus/vbft/config"
+	"github.com/ontio/ontology/core/states"
+	scommon "github.com/ontio/ontology/core/store/common"
+	"github.com/ontio/ontology/core/types"
+	"github.com/ontio/ontology/errors"
+	scontext "github.com/ontio/ontology/smartcontract/context"
+	"github.com/ontio/ontology/smartcontract/event"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/ong"
+	"github.com/ontio/ontology/smartcontract/service/native/ont"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+	"github.com/ontio/ontology/smartcontract/storage"
+	vmtypes "github.com/ontio/ontology/vm/neovm/types"
+)
+
+// mockStateStore is an in memory StateStore for testing storage helpers
+type mockStateStore map[string]*scommon.StateItem
+
+func (this mockStateStore) TryAdd(prefix scommon.DataEntryPrefix, key []byte, value states.StateValue) {
+	k := string(append([]byte{byte(prefix)}, key...))
+	this[k] = &scommon.StateItem{Key: string(key), Value: value, State: scommon.Changed}
+}
+
+func (this mockStateStore) TryGetOrAdd(prefix scommon.DataEntryPrefix, key []byte, value states.StateValue) error {
+	if item, _ := this.TryGet(prefix, key); item == nil {
+		this.TryAdd(prefix, key, value)
+	}
+	return nil
+}
+
+func (this mockStateStore) TryGet(prefix scommon.DataEntryPrefix, key []byte) (*scommon.StateItem, error) {
+	return this[string(append([]byte{byte(prefix)}, key...))], nil
+}
+
+func (this mockStateStore) TryDelete(prefix scommon.DataEntryPrefix, key []byte) {
+	delete(this, string(append([]byte{byte(prefix)}, key...)))
+}
+
+func (this mockStateStore) Find(prefix scommon.DataEntryPrefix, key []byte) ([]*scommon.StateItem, error) {
+	var items []*scommon.StateItem
+	p := string(append([]byte{byte(prefix)}, key...))
+	for k, v := range this {
+		if strings.HasPrefix(k, p) {
+			items = append(items, v.Copy())
+		}
+	}
+	return items, nil
+}
+
+// testContextRef is a minimal ContextRef for native calls between contracts
+type testContextRef struct {
+	contexts      []*scontext.Context
+	notifications []*event.NotifyEventInfo
+}
+
+func (this *testContextRef) PushContext(ctx *scontext.Context) {
+	this.contexts = append(this.contexts, ctx)
+}
+
+func (this *testContextRef) CurrentContext() *scontext.Context {
+	if len(this.contexts) < 1 {
+		return nil
+	}
+	return this.contexts[len(this.contexts)-1]
+}
+
+func (this *testContextRef) CallingContext() *scontext.Context {
+	if len(this.contexts) < 2 {
+		return nil
+	}
+	return this.contexts[len(this.contexts)-2]
+}
+
+func (this *testContextRef) EntryContext() *scontext.Context {
+	if len(this.contexts) < 1 {
+		return nil
+	}
+	return this.contexts[0]
+}
+
+func (this *testContextRef) PopContext() {
+	if len(this.contexts) > 0 {
+		this.contexts = this.contexts[:len(this.contexts)-1]
+	}
+}
+
+func (this *testContextRef) CheckWitness(address common.Address) bool {
+	return true
+}
+
+func (this *testContextRef) PushNotifications(notifications []*event.NotifyEventInfo) {
+	this.notifications = append(this.notifications, notifications...)
+}
+
+func (this *testContextRef) NewExecuteEngine(code []byte) (scontext.Engine, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (this *testContextRef) CheckUseGas(gas uint64) bool {
+	return true
+}
+
+func (this *testContextRef) CheckExecStep() bool {
+	return true
+}
+
+func newTestNative() *native.NativeService {
+	ctx := new(testContextRef)
+	ctx.PushContext(&scontext.Context{ContractAddress: utils.GovernanceContractAddress})
+	return &native.NativeService{
+		CloneCache: storage.NewCloneCache(make(mockStateStore)),
+		ServiceMap: make(map[string]native.Handler),
+		ContextRef: ctx,
+	}
+}
+
+// registerTestContract replaces the native contract at address with handlers,
+// the returned function restores the original contract
+func registerTestContract(address common.Address, handlers map[string]native.Handler) func() {
+	origin, ok := native.Contracts[address]
+	native.Contracts[address] = func(native *native.NativeService) {
+		for name, handler := range handlers {
+			native.Register(name, handler)
+		}
+	}
+	return func() {
+		if ok {
+			native.Contracts[address] = origin
+		} else {
+			delete(native.Contracts, address)
+		}
+	}
+}
+
+func testPeerPoolMap(view uint32, stakes ...uint64) *PeerPoolMap {
+	peerPoolMap := &PeerPoolMap{
+		PeerPoolMap: make(map[string]*PeerPoolItem),
+	}
+	for _, peer := range testPeers(stakes...) {
+		peerPoolMap.PeerPoolMap[peer.PeerPubkey] = &PeerPoolItem{
+			Index:      peer.Index,
+			PeerPubkey: peer.PeerPubkey,
+			Status:     ConsensusStatus,
+			InitPos:    peer.Stake,
+			TotalPos:   uint64(view),
+		}
+	}
+	return peerPoolMap
+}
+
+func testConfiguration() *Configuration {
+	return &Configuration{
+		N:                    7,
+		C:                    2,
+		K:                    7,
+		L:                    112,
+		BlockMsgDelay:        10000,
+		HashMsgDelay:         10000,
+		PeerHandshakeTimeout: 10,
+		MaxBlockChangeView:   1000,
+	}
+}
+
+// testPubkey returns the compressed hex pubkey of private key i on P-256
+func testPubkey(i int) string {
+	x, y := elliptic.P256().ScalarBaseMult(big.NewInt(int64(i)).Bytes())
+	buf := make([]byte, 33)
+	buf[0] = 0x02 + byte(y.Bit(0))
+	xBytes := x.Bytes()
+	copy(buf[33-len(xBytes):], xBytes)
+	return hex.EncodeToString(buf)
+}
+
+func testPeers(stakes ...uint64) []*PeerStakeInfo {
+	peers := make([]*PeerStakeInfo, 0, len(stakes))
+	for i, stake := range stakes {
+		peers = append(peers, &PeerStakeInfo{
+			Index:      uint32(i + 1),
+			PeerPubkey: testPubkey(i + 1),
+			Stake:      stake,
+		})
+	}
+	return peers
+}
+
+func TestCalDposTableWithSeed(t *testing.T) {
+	config := testConfiguration()
+	peers := testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000)
+	seed := common.Uint256{1, 2, 3}
+
+	chainPeers, posTable, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if len(chainPeers) != int(config.K) {
+		t.Fatalf("expected %d chain peers, got %d", config.K, len(chainPeers))
+	}
+
+	counts := make(map[uint32]uint64)
+	for _, index := range posTable {
+		counts[index]++
+	}
+	var sum uint64
+	for _, peer := range peers {
+		sum += peer.Stake
+	}
+	scale := uint64(config.L/config.K - 1)
+	for _, peer := range peers {
+		if rank := vbftconfig.CalcPeerRank(peer.Stake, scale, uint64(config.K), sum); counts[peer.Index] != rank {
+			t.Errorf("peer %d appears %d times in pos table, expected %d", peer.Index, counts[peer.Index], rank)
+		}
+	}
+
+	_, again, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(posTable, again) {
+		t.Errorf("pos table is not deterministic: %v != %v", posTable, again)
+	}
+	_, other, err := CalDposTableWithSeed(common.Uint256{4, 5, 6}, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if reflect.DeepEqual(posTable, other) {
+		t.Errorf("different seeds produced the same pos table: %v", posTable)
+	}
+}
+
+// vbft builds the chain config of genesis with GenesisChainConfig and of every
+// later view with CalChainConfig, both must agree before the fork heights
+func TestCalChainConfigMatchesGenesis(t *testing.T) {
+	log.InitLog(log.InfoLog)
+	cfg := testConfiguration()
+	vbftConfig := &config.VBFTConfig{
+		N:                    cfg.N,
+		C:                    cfg.C,
+		K:                    cfg.K,
+		L:                    cfg.L,
+		BlockMsgDelay:        cfg.BlockMsgDelay,
+		HashMsgDelay:         cfg.HashMsgDelay,
+		PeerHandshakeTimeout: cfg.PeerHandshakeTimeout,
+		MaxBlockChangeView:   cfg.MaxBlockChangeView,
+	}
+	for _, stakes := range [][]uint64{
+		{70000, 60000, 50000, 40000, 30000, 20000, 10000},
+		{10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000},
+		{5000, 90000, 1, 80000, 70000, 60000, 50000, 40000, 30000},
+		{0, 0, 0, 0, 0, 0, 0},
+		{1000000, 1, 1, 1, 1, 1, 1},
+	} {
+		peers := testPeers(stakes...)
+		var peersInfo []*config.VBFTPeerStakeInfo
+		for _, peer := range peers {
+			peersInfo = append(peersInfo, &config.VBFTPeerStakeInfo{
+				Index:      peer.Index,
+				PeerPubkey: peer.PeerPubkey,
+				InitPos:    peer.Stake,
+			})
+		}
+		seed := common.Uint256{1, 2, 3}
+		want, err := vbftconfig.GenesisChainConfig(vbftConfig, peersInfo, seed, 100)
+		if err != nil {
+			t.Fatalf("GenesisChainConfig failed: %s", err)
+		}
+		got, err := CalChainConfig(seed, 100, cfg, peers)
+		if err != nil {
+			t.Fatalf("CalChainConfig failed: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("stakes %v: CalChainConfig = %v, GenesisChainConfig = %v", stakes, got, want)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// dposTableGoldenCases are the fixed inputs whose fingerprints are pinned in
+// testdata/dpos_table_fingerprints.json. Never edit a case, add a new one.
+func dposTableGoldenCases() map[string]func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+	return map[string]func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32){
+		"k7_descending": func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+			return testConfiguration(), testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000),
+				common.Uint256{1, 2, 3}, 100
+		},
+		"k7_equal_stakes": func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+			return testConfiguration(), testPeers(10000, 10000, 10000, 10000, 10000, 10000, 10000),
+				common.Uint256{4, 5, 6}, 2000
+		},
+		"k7_of_9_candidates": func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+			return testConfiguration(), testPeers(5000, 90000, 1, 80000, 70000, 60000, 50000, 40000, 30000),
+				common.Uint256{7}, 123456
+		},
+		"k7_max_stake_ratio": func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+			config := testConfiguration()
+			config.MaxStakeRatio = 2000
+			return config, testPeers(1000000, 60000, 50000, 40000, 30000, 20000, 10000),
+				common.Uint256{8, 9}, 500
+		},
+		"k7_sha256_64": func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+			config := testConfiguration()
+			config.HashAlgo = HashAlgoSHA256_64
+			return config, testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000),
+				common.Uint256{1, 2, 3}, 100
+		},
+		"k7_keccak64": func() (*Configuration, []*PeerStakeInfo, common.Uint256, uint32) {
+			config := testConfiguration()
+			config.HashAlgo = HashAlgoKeccak64
+			return config, testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000),
+				common.Uint256{1, 2, 3}, 100
+		},
+	}
+}
+
+func TestDposTableFingerprintGolden(t *testing.T) {
+	golden := filepath.Join("testdata", "dpos_table_fingerprints.json")
+	fingerprints := make(map[string]string)
+	for name, input := range dposTableGoldenCases() {
+		fingerprints[name] = dposTableFingerprint(input())
+	}
+	if *updateGolden {
+		data, err := json.MarshalIndent(fingerprints, "", "  ")
+		if err != nil {
+			t.Fatalf("json.MarshalIndent failed: %s", err)
+		}
+		if err := ioutil.WriteFile(golden, append(data, '\n'), 0644); err != nil {
+			t.Fatalf("write %s failed: %s", golden, err)
+		}
+	}
+	data, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("read %s failed: %s", golden, err)
+	}
+	want := make(map[string]string)
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatalf("parse %s failed: %s", golden, err)
+	}
+	for name, fingerprint := range fingerprints {
+		if want[name] == "" {
+			t.Errorf("%s: no golden fingerprint, run go test -update", name)
+		} else if fingerprint != want[name] {
+			t.Errorf("%s: pos table changed, fingerprint %s, golden %s", name, fingerprint, want[name])
+		}
+	}
+	for name := range want {
+		if _, ok := fingerprints[name]; !ok {
+			t.Errorf("%s: golden fingerprint without a case", name)
+		}
+	}
+
+	// the fingerprint covers both the chain peers and the table order
+	config, peers, seed, height := dposTableGoldenCases()["k7_descending"]()
+	if dposTableFingerprint(config, peers, common.Uint256{1, 2, 4}, height) == fingerprints["k7_descending"] {
+		t.Error("fingerprint does not depend on the seed")
+	}
+	peers[0].PeerPubkey = testPubkey(8)
+	if dposTableFingerprint(config, peers, seed, height) == fingerprints["k7_descending"] {
+		t.Error("fingerprint does not depend on the chain peers")
+	}
+	if fingerprint := dposTableFingerprint(config, peers[:3], seed, height); !strings.HasPrefix(fingerprint, "error: ") {
+		t.Errorf("fingerprint of a failing input = %s", fingerprint)
+	}
+}
+
+func TestCalDposTableWithSeedTooFewPeers(t *testing.T) {
+	if _, _, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), testPeers(1, 2, 3)); err == nil {
+		t.Errorf("expected error when peer count is less than K")
+	}
+}
+
+func TestCalDposTableWithSeedZeroK(t *testing.T) {
+	config := testConfiguration()
+	config.K = 0
+	_, _, err := CalDposTableWithSeed(common.Uint256{}, 1, config, testPeers(1, 2, 3))
+	if err == nil || !strings.Contains(err.Error(), "K can not be 0") {
+		t.Errorf("expected K can not be 0 error, got %v", err)
+	}
+}
+
+func TestCalDposTableWithSeedZeroStakeSum(t *testing.T) {
+	peers := testPeers(0, 0, 0, 0, 0, 0, 0, 0)
+	// before POS_TABLE_CHECK_HEIGHT every peer gets one slot as at genesis
+	_, posTable, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers)
+	if err != nil || len(posTable) != 7 {
+		t.Errorf("legacy zero stake sum: got %v, %v, want 7 slots", posTable, err)
+	}
+	defer func(height uint32) { POS_TABLE_CHECK_HEIGHT = height }(POS_TABLE_CHECK_HEIGHT)
+	POS_TABLE_CHECK_HEIGHT = 1
+	_, _, err = CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers)
+	if err == nil || !strings.Contains(err.Error(), "stake sum of top K peers is 0") {
+		t.Errorf("expected zero stake sum error, got %v", err)
+	}
+	// a zero stake peer among staked ones still gets its slot
+	peers = testPeers(70000, 60000, 50000, 40000, 30000, 20000, 0)
+	if _, _, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers); err != nil {
+		t.Errorf("CalDposTableWithSeed with one zero stake peer failed: %s", err)
+	}
+}
+
+func TestCalDposTableWithSeedDuplicateIndex(t *testing.T) {
+	peers := testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000, 5000)
+	peers[7].Index = 3
+	if _, _, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers); err != nil {
+		t.Errorf("duplicate index rejected before UNIQUE_PEER_INDEX_HEIGHT: %s", err)
+	}
+	defer func(height uint32) { UNIQUE_PEER_INDEX_HEIGHT = height }(UNIQUE_PEER_INDEX_HEIGHT)
+	UNIQUE_PEER_INDEX_HEIGHT = 1
+	_, _, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers)
+	if err == nil || !strings.Contains(err.Error(), "index 3 is shared") {
+		t.Errorf("expected duplicate index error, got %v", err)
+	}
+
+	peerPoolMap := testPeerPoolMap(1, 100, 200)
+	if err := checkPeerIndexFree(peerPoolMap, 1, testPubkey(1)); err != nil {
+		t.Errorf("a peer keeping its own index should pass: %s", err)
+	}
+	if err := checkPeerIndexFree(peerPoolMap, 3, testPubkey(3)); err != nil {
+		t.Errorf("an unused index should pass: %s", err)
+	}
+	if err := checkPeerIndexFree(peerPoolMap, 2, testPubkey(3)); err == nil || !strings.Contains(err.Error(), testPubkey(2)) {
+		t.Errorf("expected error naming the holder of index 2, got %v", err)
+	}
+}
+
+func TestGetPeerPoolMapRange(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	for view := uint32(1); view <= 3; view++ {
+		if err := putPeerPoolMap(native, contract, view, testPeerPoolMap(view, 100, 200)); err != nil {
+			t.Fatalf("putPeerPoolMap failed: %s", err)
+		}
+	}
+
+	peerPoolMaps, err := GetPeerPoolMapRange(context.Background(), native, contract, 0, 5)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMapRange failed: %s", err)
+	}
+	if len(peerPoolMaps) != 3 {
+		t.Fatalf("expected 3 views, got %d", len(peerPoolMaps))
+	}
+	for view := uint32(1); view <= 3; view++ {
+		peerPoolMap, ok := peerPoolMaps[view]
+		if !ok {
+			t.Fatalf("view %d is missing", view)
+		}
+		if !reflect.DeepEqual(peerPoolMap, testPeerPoolMap(view, 100, 200)) {
+			t.Errorf("view %d: unexpected peer pool map", view)
+		}
+	}
+
+	if _, err := GetPeerPoolMap(native, contract, 4); err == nil {
+		t.Errorf("GetPeerPoolMap should fail for a view that is not stored")
+	}
+	if _, err := GetPeerPoolMapRange(context.Background(), native, contract, 3, 1); err == nil {
+		t.Errorf("GetPeerPoolMapRange should fail when startView > endView")
+	}
+}
+
+func TestGetPeerPoolItemsPaged(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	peerPoolMap := testPeerPoolMap(1, 300, 100, 500, 100, 200)
+	if err := putPeerPoolMap(native, contract, 1, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+
+	items, total, err := GetPeerPoolItemsPaged(native, contract, 1, 0, 10, true)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItemsPaged failed: %s", err)
+	}
+	if total != 5 || len(items) != 5 {
+		t.Fatalf("expected 5 items, got %d of %d", len(items), total)
+	}
+	// peers 2 and 4 have the same stake, larger pubkey first
+	expected := []uint32{3, 1, 5, 2, 4}
+	for i, index := range expected {
+		if items[i].Index != index {
+			t.Errorf("position %d: expected peer %d, got %d", i, index, items[i].Index)
+		}
+	}
+
+	items, total, err = GetPeerPoolItemsPaged(native, contract, 1, 1, 2, true)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItemsPaged failed: %s", err)
+	}
+	if total != 5 || len(items) != 2 || items[0].Index != 1 || items[1].Index != 5 {
+		t.Errorf("unexpected page: %v, total %d", items, total)
+	}
+
+	items, _, err = GetPeerPoolItemsPaged(native, contract, 1, 0, 5, false)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItemsPaged failed: %s", err)
+	}
+	for i := 1; i < len(items); i++ {
+		if items[i-1].PeerPubkey < items[i].PeerPubkey {
+			t.Errorf("items are not sorted by PeerPubkey")
+		}
+	}
+
+	items, total, err = GetPeerPoolItemsPaged(native, contract, 1, 5, 10, true)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItemsPaged failed: %s", err)
+	}
+	if total != 5 || len(items) != 0 {
+		t.Errorf("offset beyond the end should return no items, got %d of %d", len(items), total)
+	}
+
+	items, total, err = GetPeerPoolItemsPaged(native, contract, 1, 0, 0, true)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItemsPaged failed: %s", err)
+	}
+	if total != 5 || len(items) != 0 {
+		t.Errorf("limit of zero should return no items, got %d of %d", len(items), total)
+	}
+
+	// a stake which wraps around must not sort as the smallest
+	for _, item := range peerPoolMap.PeerPoolMap {
+		if item.Index == 4 {
+			item.TotalPos = math.MaxUint64
+		}
+	}
+	if err := putPeerPoolMap(native, contract, 1, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	if _, _, err := GetPeerPoolItemsPaged(native, contract, 1, 0, 10, true); errors.RootErr(err) != ErrStakeOverflow {
+		t.Errorf("expected ErrStakeOverflow, got %v", err)
+	}
+	if _, _, err := GetPeerPoolItemsPaged(native, contract, 1, 0, 10, false); err != nil {
+		t.Errorf("unsorted query failed: %s", err)
+	}
+}
+
+func testSplitCurve() *SplitCurve {
+	// rises to the peak at Xi[20] and then falls
+	yi := make([]uint32, len(Xi))
+	for i := range yi {
+		if i <= 20 {
+			yi[i] = uint32(i * 30000)
+		} else {
+			yi[i] = uint32(600000 - (i-20)*5000)
+		}
+	}
+	return &SplitCurve{Xi: Xi, Yi: yi}
+}
+
+func TestSplitCurveDomain(t *testing.T) {
+	// with avg 100 and yita 5, xi = PRECISE * 5 * 2 * pos / (10 * 100) = 10000 * pos,
+	// so every 10 of pos is one 100000 wide segment of the default curve
+	curve := &SplitCurve{Xi: Xi, Yi: Yi}
+	last := len(Xi) - 1
+	vectors := []struct {
+		name string
+		pos  uint64
+		s    uint64
+	}{
+		{"first point, index 0", 0, uint64(Yi[0])},
+		{"second point, index 1", 10, uint64(Yi[1])},
+		// halfway along [Xi[1], Xi[2]]: (95123 + 180968) / 2, floored
+		{"middle of segment 1", 15, 138045},
+		// halfway along the last segment: (70126 + 67380) / 2
+		{"middle of the last segment", 995, 68753},
+		// xi == Xi[last] searches past the end, the index is clamped to last-1
+		{"last point", 1000, uint64(Yi[last])},
+		// (70126 * -50000 + 67380 * 150000) / 100000 on the extended last segment
+		{"past the last point", 1005, 66007},
+	}
+	for _, v := range vectors {
+		s, err := splitCurve(curve, v.pos, 100, 5)
+		if err != nil {
+			t.Errorf("%s: splitCurve(%d) failed: %s", v.name, v.pos, err)
+			continue
+		}
+		if s != v.s {
+			t.Errorf("%s: splitCurve(%d) = %d, want %d", v.name, v.pos, s, v.s)
+		}
+	}
+
+	// the extended last segment crosses 0 between xi 12.4e6 and 12.5e6
+	if s, err := splitCurve(curve, 1250, 100, 5); err == nil {
+		t.Errorf("splitCurve below the extended curve = %d, want error", s)
+	}
+	// xi below Xi[0] of a curve not starting at 0
+	shifted := &SplitCurve{Xi: []uint32{100000, 200000}, Yi: []uint32{10, 20}}
+	if s, err := splitCurve(shifted, 5, 100, 5); err == nil {
+		t.Errorf("splitCurve below Xi[0] = %d, want error", s)
+	}
+	// the smallest curve never indexes past its second point
+	two := &SplitCurve{Xi: []uint32{0, 100000}, Yi: []uint32{0, 100000}}
+	for _, pos := range []uint64{0, 10, 11, 1 << 32} {
+		s, err := splitCurve(two, pos, 100, 5)
+		if err != nil {
+			t.Errorf("splitCurve(two points, %d) failed: %s", pos, err)
+			continue
+		}
+		if s != 10000*pos {
+			t.Errorf("splitCurve(two points, %d) = %d, want %d", pos, s, 10000*pos)
+		}
+	}
+	if _, err := splitCurve(&SplitCurve{Xi: []uint32{0}, Yi: []uint32{0}}, 10, 100, 5); err == nil {
+		t.Errorf("curve of a single point accepted")
+	}
+}
+
+func TestSplitCurve(t *testing.T) {
+	curve := testSplitCurve()
+	vectors := []struct {
+		pos, avg, yita uint64
+		s              uint64
+	}{
+		{0, 100, 5, 0},
+		{100, 100, 5, 300000},
+		{150, 100, 5, 450000},
+		{200, 100, 5, 600000},
+		{250, 100, 5, 575000},
+		{1000, 100, 5, 200000},
+		// extrapolated past the last point of the curve
+		{1050, 100, 5, 175000},
+		// avg * 10 no longer overflows
+		{100, math.MaxUint64, 5, 0},
+	}
+	for _, v := range vectors {
+		s, err := splitCurve(curve, v.pos, v.avg, v.yita)
+		if err != nil {
+			t.Errorf("splitCurve(%d, %d, %d) failed: %s", v.pos, v.avg, v.yita, err)
+			continue
+		}
+		if s != v.s {
+			t.Errorf("splitCurve(%d, %d, %d) = %d, expected %d", v.pos, v.avg, v.yita, s, v.s)
+		}
+	}
+
+	extremes := []struct {
+		pos, avg, yita uint64
+	}{
+		{100, 0, 5},
+		{math.MaxUint64, 1, 5},
+		{1, 1, math.MaxUint32},
+		{1 << 40, 1, 5},
+		// the falling tail extrapolated below zero
+		{5000, 100, 5},
+	}
+	for _, v := range extremes {
+		if s, err := splitCurve(curve, v.pos, v.avg, v.yita); err == nil {
+			t.Errorf("splitCurve(%d, %d, %d) = %d, expected error", v.pos, v.avg, v.yita, s)
+		}
+	}
+
+	// on the identity curve s == xi == pos when avg == PRECISE and yita == 5,
+	// PRECISE * yita * 2 * pos wraps in uint64 for all of these stakes
+	identity := &SplitCurve{Xi: []uint32{0, 1}, Yi: []uint32{0, 1}}
+	for _, pos := range []uint64{1 << 50, 1 << 62, math.MaxUint64 / 2, math.MaxUint64} {
+		s, err := splitCurve(identity, pos, PRECISE, 5)
+		if err != nil {
+			t.Errorf("splitCurve(identity, %d) failed: %s", pos, err)
+			continue
+		}
+		if s != pos {
+			t.Errorf("splitCurve(identity, %d) = %d", pos, s)
+		}
+	}
+	if s, err := splitCurve(identity, math.MaxUint64, PRECISE/2, 5); err == nil {
+		t.Errorf("splitCurve(identity) = %d, expected overflow error", s)
+	}
+
+	if _, err := splitCurve(&SplitCurve{Xi: Xi, Yi: Yi[:10]}, 100, 100, 5); err == nil {
+		t.Errorf("curve with mismatched Xi and Yi accepted")
+	}
+	if _, err := splitCurve(&SplitCurve{Xi: []uint32{0, 10, 10}, Yi: []uint32{0, 1, 2}}, 100, 100, 5); err == nil {
+		t.Errorf("curve with non increasing Xi accepted")
+	}
+}
+
+func TestGetSplitCurve(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	curve, err := getSplitCurve(native, contract)
+	if err != nil {
+		t.Fatalf("getSplitCurve failed: %s", err)
+	}
+	if !reflect.DeepEqual(curve.Xi, Xi) || !reflect.DeepEqual(curve.Yi, Yi) {
+		t.Errorf("expected the default curve")
+	}
+	// the default curve at stake == avg, yita 5
+	s, err := splitCurve(curve, 100, 100, 5)
+	if err != nil {
+		t.Fatalf("splitCurve failed: %s", err)
+	}
+	if s != uint64(Yi[10]) {
+		t.Errorf("expected %d on the default curve, got %d", Yi[10], s)
+	}
+
+	// a custom curve with points twice as far apart
+	custom := testSplitCurve()
+	custom.Xi = make([]uint32, len(Xi))
+	for i := range Xi {
+		custom.Xi[i] = 2 * Xi[i]
+	}
+	if err := putSplitCurve(native, contract, custom); err != nil {
+		t.Fatalf("putSplitCurve failed: %s", err)
+	}
+	curve, err = getSplitCurve(native, contract)
+	if err != nil {
+		t.Fatalf("getSplitCurve failed: %s", err)
+	}
+	if !reflect.DeepEqual(curve, custom) {
+		t.Errorf("expected the custom curve, got %v", curve)
+	}
+	s, err = splitCurve(curve, 300, 100, 5)
+	if err != nil {
+		t.Fatalf("splitCurve failed: %s", err)
+	}
+	if s != 450000 {
+		t.Errorf("expected 450000 on the custom curve, got %d", s)
+	}
+
+	// updating Yi only keeps the custom Xi
+	if err := putSplitCurve(native, contract, &SplitCurve{Yi: Yi}); err != nil {
+		t.Fatalf("putSplitCurve failed: %s", err)
+	}
+	curve, err = getSplitCurve(native, contract)
+	if err != nil {
+		t.Fatalf("getSplitCurve failed: %s", err)
+	}
+	if !reflect.DeepEqual(curve.Xi, custom.Xi) || !reflect.DeepEqual(curve.Yi, Yi) {
+		t.Errorf("unexpected curve after updating Yi")
+	}
+
+	// a curve with mismatched Xi is rejected without writing Yi
+	if err := putSplitCurve(native, contract, &SplitCurve{Yi: custom.Yi, Xi: Xi[1:]}); err == nil {
+		t.Error("putSplitCurve accepted Xi of another length than Yi")
+	}
+	curve, err = getSplitCurve(native, contract)
+	if err != nil {
+		t.Fatalf("getSplitCurve failed: %s", err)
+	}
+	if !reflect.DeepEqual(curve.Xi, custom.Xi) || !reflect.DeepEqual(curve.Yi, Yi) {
+		t.Errorf("rejected curve was partly written: %v", curve)
+	}
+}
+
+func TestUint64Bytes(t *testing.T) {
+	for _, num := range []uint64{0, 1, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64} {
+		b, err := GetUint64Bytes(num)
+		if err != nil {
+			t.Fatalf("GetUint64Bytes(%d) failed: %s", num, err)
+		}
+		if len(b) != 8 {
+			t.Errorf("GetUint64Bytes(%d) returned %d bytes", num, len(b))
+		}
+		n, err := GetBytesUint64(b)
+		if err != nil {
+			t.Fatalf("GetBytesUint64 failed: %s", err)
+		}
+		if n != num {
+			t.Errorf("round trip of %d returned %d", num, n)
+		}
+	}
+	if _, err := GetBytesUint64([]byte{1, 2, 3}); err == nil {
+		t.Errorf("GetBytesUint64 should fail on short input")
+	}
+}
+
+func TestGetGovernanceViewErrors(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	_, err := GetGovernanceView(native, contract)
+	if errors.RootErr(err) != ErrGovernanceViewNotFound {
+		t.Errorf("expected ErrGovernanceViewNotFound, got %v", err)
+	}
+	_, err = GetView(native, contract)
+	if errors.RootErr(err) != ErrGovernanceViewNotFound {
+		t.Errorf("GetView: expected ErrGovernanceViewNotFound, got %v", err)
+	}
+
+	governanceView := &GovernanceView{View: 3, Height: 100}
+	if err := putGovernanceView(native, contract, governanceView); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	view, err := GetGovernanceView(native, contract)
+	if err != nil {
+		t.Fatalf("GetGovernanceView failed: %s", err)
+	}
+	if *view != *governanceView {
+		t.Errorf("expected %v, got %v", governanceView, view)
+	}
+
+	// truncate the stored blob
+	bf := new(bytes.Buffer)
+	if err := governanceView.Serialize(bf); err != nil {
+		t.Fatalf("serialize governanceView failed: %s", err)
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GOVERNANCE_VIEW)),
+		&states.StorageItem{Value: bf.Bytes()[:bf.Len()-3]})
+	_, err = GetGovernanceView(native, contract)
+	if errors.RootErr(err) != ErrGovernanceViewCorrupt {
+		t.Errorf("expected ErrGovernanceViewCorrupt, got %v", err)
+	}
+}
+
+func TestAppCallTransferMulti(t *testing.T) {
+	for _, contract := range []common.Address{utils.OntContractAddress, utils.OngContractAddress} {
+		var calls []*ont.Transfers
+		restore := registerTestContract(contract, map[string]native.Handler{
+			"transfer": func(native *native.NativeService) ([]byte, error) {
+				transfers := new(ont.Transfers)
+				if err := transfers.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+					return utils.BYTE_FALSE, err
+				}
+				calls = append(calls, transfers)
+				return utils.BYTE_TRUE, nil
+			},
+		})
+
+		var sts []*ont.State
+		for i := 0; i < 50; i++ {
+			sts = append(sts, &ont.State{
+				From:  utils.GovernanceContractAddress,
+				To:    common.Address{byte(i + 1)},
+				Value: uint64(i * 100),
+			})
+		}
+		native := newTestNative()
+		var err error
+		if contract == utils.OntContractAddress {
+			err = appCallTransferOntMulti(native, sts)
+		} else {
+			err = appCallTransferOngMulti(native, sts)
+		}
+		restore()
+		if err != nil {
+			t.Fatalf("appCallTransferMulti failed: %s", err)
+		}
+		if len(calls) != 1 {
+			t.Fatalf("expected 1 call of %x, got %d", contract, len(calls))
+		}
+		if !reflect.DeepEqual(calls[0].States, sts) {
+			t.Errorf("transferred states do not match")
+		}
+
+		if err := appCallTransferMulti(newTestNative(), contract, []*ont.State{sts[0], nil}); err == nil {
+			t.Errorf("nil transfer state should be rejected")
+		}
+	}
+}
+
+func TestAppCallApprove(t *testing.T) {
+	from, to := common.Address{1}, common.Address{2}
+	for _, contract := range []common.Address{utils.OntContractAddress, utils.OngContractAddress} {
+		var approved []*ont.State
+		restore := registerTestContract(contract, map[string]native.Handler{
+			"approve": func(native *native.NativeService) ([]byte, error) {
+				state := new(ont.State)
+				if err := state.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+					return utils.BYTE_FALSE, err
+				}
+				approved = append(approved, state)
+				return utils.BYTE_TRUE, nil
+			},
+		})
+
+		var err error
+		if contract == utils.OntContractAddress {
+			err = appCallApproveOnt(newTestNative(), from, to, 12345)
+		} else {
+			err = appCallApproveOng(newTestNative(), from, to, 12345)
+		}
+		restore()
+		if err != nil {
+			t.Fatalf("appCallApprove failed: %s", err)
+		}
+		if len(approved) != 1 {
+			t.Fatalf("expected 1 call of %x, got %d", contract, len(approved))
+		}
+		if approved[0].From != from || approved[0].To != to || approved[0].Value != 12345 {
+			t.Errorf("unexpected approve state: %+v", approved[0])
+		}
+	}
+}
+
+func TestGetOntBalance(t *testing.T) {
+	var result []byte
+	var queried []byte
+	restore := registerTestContract(utils.OntContractAddress, map[string]native.Handler{
+		"balanceOf": func(native *native.NativeService) ([]byte, error) {
+			queried = native.Input
+			return result, nil
+		},
+	})
+	defer restore()
+
+	address := common.Address{1, 2, 3}
+	result = vmtypes.BigIntToBytes(big.NewInt(100000000))
+	balance, err := getOntBalance(newTestNative(), address)
+	if err != nil {
+		t.Fatalf("getOntBalance failed: %s", err)
+	}
+	if balance != 100000000 {
+		t.Errorf("expected balance 100000000, got %d", balance)
+	}
+	bf := new(bytes.Buffer)
+	if err := utils.WriteAddress(bf, address); err != nil {
+		t.Fatalf("WriteAddress failed: %s", err)
+	}
+	if !bytes.Equal(queried, bf.Bytes()) {
+		t.Errorf("unexpected balanceOf input: %x", queried)
+	}
+
+	for _, value := range []interface{}{nil, "100", uint64(100)} {
+		if _, err := parseBalance(value); err == nil {
+			t.Errorf("balanceOf result %#v should be rejected", value)
+		}
+	}
+}
+
+func TestGetOngBalance(t *testing.T) {
+	var result []byte
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"balanceOf": func(native *native.NativeService) ([]byte, error) {
+			return result, nil
+		},
+	})
+	defer restore()
+
+	result = vmtypes.BigIntToBytes(big.NewInt(5000000000))
+	balance, err := getOngBalance(newTestNative(), utils.GovernanceContractAddress)
+	if err != nil {
+		t.Fatalf("getOngBalance failed: %s", err)
+	}
+	if balance != 5000000000 {
+		t.Errorf("expected balance 5000000000, got %d", balance)
+	}
+
+	result = nil
+	balance, err = getOngBalance(newTestNative(), utils.GovernanceContractAddress)
+	if err != nil {
+		t.Fatalf("getOngBalance failed: %s", err)
+	}
+	if balance != 0 {
+		t.Errorf("expected balance 0, got %d", balance)
+	}
+}
+
+func TestAppCallErrorContext(t *testing.T) {
+	failure := errors.NewErr("forced failure")
+	fail := func(native *native.NativeService) ([]byte, error) { return utils.BYTE_FALSE, failure }
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"transfer":  fail,
+		"approve":   fail,
+		"balanceOf": fail,
+	})
+	defer restore()
+	restoreOnt := registerTestContract(utils.OntContractAddress, map[string]native.Handler{"transfer": fail})
+	defer restoreOnt()
+
+	native := newTestNative()
+	_, balanceErr := getOngBalance(native, common.Address{1})
+	cases := []struct {
+		method   string
+		contract common.Address
+		err      error
+	}{
+		{"transfer", utils.OngContractAddress, appCallTransferOng(native, common.Address{1}, common.Address{2}, 1)},
+		{"transfer", utils.OntContractAddress, appCallTransferOnt(native, common.Address{1}, common.Address{2}, 1)},
+		{"approve", utils.OngContractAddress, appCallApproveOng(native, common.Address{1}, common.Address{2}, 1)},
+		{"balanceOf", utils.OngContractAddress, balanceErr},
+	}
+	for _, c := range cases {
+		if c.err == nil {
+			t.Errorf("%s of %s succeeded", c.method, c.contract.ToHexString())
+			continue
+		}
+		if !strings.Contains(c.err.Error(), "appCall "+c.method+" of contract "+c.contract.ToHexString()) {
+			t.Errorf("error %q does not name %s of %s", c.err, c.method, c.contract.ToHexString())
+		}
+		if errors.RootErr(c.err) != failure {
+			t.Errorf("error %q lost its root", c.err)
+		}
+	}
+}
+
+func TestGetOngBalanceReadOnly(t *testing.T) {
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"balanceOf": ong.OngBalanceOf,
+	})
+	defer restore()
+
+	native := newTestNative()
+	native.CloneCache.Add(scommon.ST_STORAGE, ont.GenBalanceKey(utils.OngContractAddress, common.Address{1}),
+		utils.GenUInt64StorageItem(123456789))
+	for _, address := range []common.Address{{1}, {2}} {
+		expected, err := getOngBalance(native, address)
+		if err != nil {
+			t.Fatalf("getOngBalance failed: %s", err)
+		}
+		balance, err := GetOngBalanceReadOnly(native, address)
+		if err != nil {
+			t.Fatalf("GetOngBalanceReadOnly failed: %s", err)
+		}
+		if balance != expected {
+			t.Errorf("balance of %x = %d, balanceOf returns %d", address, balance, expected)
+		}
+	}
+	if balance, _ := GetOngBalanceReadOnly(native, common.Address{1}); balance != 123456789 {
+		t.Errorf("balance = %d, want 123456789", balance)
+	}
+}
+
+func TestReconcileSplitFee(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	if recorded, actual, err := ReconcileSplitFee(native, contract); err != nil || recorded != 0 || actual != 0 {
+		t.Errorf("empty state: got %d, %d, %v, want 0, 0, nil", recorded, actual, err)
+	}
+
+	if err := PutSplitFee(native, contract, 5000); err != nil {
+		t.Fatalf("putSplitFee failed: %s", err)
+	}
+	native.CloneCache.Add(scommon.ST_STORAGE, ont.GenBalanceKey(utils.OngContractAddress, contract),
+		utils.GenUInt64StorageItem(4200))
+	recorded, actual, err := ReconcileSplitFee(native, contract)
+	if err != nil {
+		t.Fatalf("ReconcileSplitFee failed: %s", err)
+	}
+	if recorded != 5000 || actual != 4200 {
+		t.Errorf("got recorded %d, actual %d, want 5000, 4200", recorded, actual)
+	}
+}
+
+func TestPeerSlashCount(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	peer, other := testPubkey(1), testPubkey(2)
+
+	if count, err := GetPeerSlashCount(native, contract, peer); err != nil || count != 0 {
+		t.Fatalf("missing key: got %d, %v, want 0, nil", count, err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		count, err := IncrementPeerSlashCount(native, contract, peer)
+		if err != nil {
+			t.Fatalf("IncrementPeerSlashCount failed: %s", err)
+		}
+		if count != i {
+			t.Errorf("increment %d returned %d", i, count)
+		}
+	}
+	if count, err := GetPeerSlashCount(native, contract, peer); err != nil || count != 3 {
+		t.Errorf("got %d, %v, want 3, nil", count, err)
+	}
+	if count, err := GetPeerSlashCount(native, contract, other); err != nil || count != 0 {
+		t.Errorf("other peer: got %d, %v, want 0, nil", count, err)
+	}
+
+	key, _ := hex.DecodeString(peer)
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(SLASH_COUNT), key),
+		utils.GenUInt32StorageItem(math.MaxUint32))
+	if _, err := IncrementPeerSlashCount(native, contract, peer); err == nil {
+		t.Error("IncrementPeerSlashCount should fail on overflow")
+	}
+	if _, err := GetPeerSlashCount(native, contract, "zz"); err == nil {
+		t.Error("GetPeerSlashCount should fail on a malformed pubkey")
+	}
+}
+
+func TestCanWithdraw(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	peer, address, other := testPubkey(1), common.Address{1}, common.Address{2}
+
+	if ok, unlockHeight, err := CanWithdraw(native, contract, peer, address, 0); err != nil || !ok || unlockHeight != 0 {
+		t.Fatalf("no lockup: got %t, %d, %v", ok, unlockHeight, err)
+	}
+	if err := putLockup(native, contract, peer, address, 1000); err != nil {
+		t.Fatalf("putLockup failed: %s", err)
+	}
+	vectors := []struct {
+		height uint32
+		ok     bool
+	}{
+		{0, false},
+		{999, false},
+		{1000, true},
+		{math.MaxUint32, true},
+	}
+	for _, v := range vectors {
+		ok, unlockHeight, err := CanWithdraw(native, contract, peer, address, v.height)
+		if err != nil {
+			t.Fatalf("CanWithdraw failed: %s", err)
+		}
+		if ok != v.ok || unlockHeight != 1000 {
+			t.Errorf("height %d: got %t, %d, want %t, 1000", v.height, ok, unlockHeight, v.ok)
+		}
+	}
+	if ok, _, err := CanWithdraw(native, contract, peer, other, 0); err != nil || !ok {
+		t.Errorf("other address: got %t, %v", ok, err)
+	}
+	if ok, _, err := CanWithdraw(native, contract, testPubkey(2), address, 0); err != nil || !ok {
+		t.Errorf("other peer: got %t, %v", ok, err)
+	}
+	if _, _, err := CanWithdraw(native, contract, "zz", address, 0); err == nil {
+		t.Error("CanWithdraw should fail on a malformed pubkey")
+	}
+}
+
+func TestGetDelegatedStake(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	peer, other := testPubkey(1), testPubkey(2)
+
+	if stake, err := GetDelegatedStake(native, contract, peer); err != nil || stake != 0 {
+		t.Fatalf("no delegators: got %d, %v, want 0, nil", stake, err)
+	}
+	voteInfos := []*VoteInfo{
+		{PeerPubkey: peer, Address: common.Address{1}, ConsensusPos: 100, FreezePos: 20, NewPos: 3},
+		{PeerPubkey: peer, Address: common.Address{2}, NewPos: 500, WithdrawPos: 7000},
+		{PeerPubkey: peer, Address: common.Address{3}, FreezePos: 40, WithdrawFreezePos: 8000, WithdrawUnfreezePos: 9000},
+		{PeerPubkey: other, Address: common.Address{1}, ConsensusPos: 1 << 40},
+		// a pubkey starting with peer is not part of its namespace
+		{PeerPubkey: peer + "00", Address: common.Address{1}, ConsensusPos: 1 << 50},
+	}
+	for _, voteInfo := range voteInfos {
+		if err := putVoteInfo(native, contract, voteInfo); err != nil {
+			t.Fatalf("putVoteInfo failed: %s", err)
+		}
+	}
+	if stake, err := GetDelegatedStake(native, contract, peer); err != nil || stake != 663 {
+		t.Errorf("peer: got %d, %v, want 663, nil", stake, err)
+	}
+	if stake, err := GetDelegatedStake(native, contract, other); err != nil || stake != 1<<40 {
+		t.Errorf("other peer: got %d, %v, want %d, nil", stake, err, uint64(1<<40))
+	}
+
+	if err := putVoteInfo(native, contract, &VoteInfo{PeerPubkey: peer, Address: common.Address{4},
+		ConsensusPos: math.MaxUint64}); err != nil {
+		t.Fatalf("putVoteInfo failed: %s", err)
+	}
+	if _, err := GetDelegatedStake(native, contract, peer); err == nil {
+		t.Error("GetDelegatedStake should fail on overflow")
+	}
+	if _, err := GetDelegatedStake(native, contract, "zz"); err == nil {
+		t.Error("GetDelegatedStake should fail on a malformed pubkey")
+	}
+}
+
+func TestAppCallVerifyToken(t *testing.T) {
+	var result []byte
+	restore := registerTestContract(utils.AuthContractAddress, map[string]native.Handler{
+		"verifyToken": func(native *native.NativeService) ([]byte, error) {
+			return result, nil
+		},
+	})
+	defer restore()
+
+	contract := utils.GovernanceContractAddress
+	result = utils.BYTE_TRUE
+	if err := appCallVerifyToken(newTestNative(), contract, []byte("did:ont:test"), "updateConfig", 1); err != nil {
+		t.Errorf("appCallVerifyToken failed: %s", err)
+	}
+	for _, result = range [][]byte{nil, utils.BYTE_FALSE} {
+		if err := appCallVerifyToken(newTestNative(), contract, []byte("did:ont:test"), "updateConfig", 1); err == nil {
+			t.Errorf("verifyToken result %v should be rejected", result)
+		}
+	}
+}
+
+func TestShuffleHashVersions(t *testing.T) {
+	seed := common.Uint256{1, 2, 3}
+	peers := testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000)
+
+	// node id of the hash vectors, pinned apart from testPeers
+	nodeId := "020000000000000000000000000000000000000000000000000000000000000001"
+	data, err := shuffleHashJSONInput(seed, 100, nodeId, 5)
+	if err != nil {
+		t.Fatalf("shuffleHashJSONInput failed: %s", err)
+	}
+	// the bytes hashed by every block before BINARY_SHUFFLE_HEIGHT
+	historical := `{"txid":[1,2,3,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"height":100,` +
+		`"node_id":"020000000000000000000000000000000000000000000000000000000000000001","index":5}`
+	if string(data) != historical {
+		t.Errorf("legacy shuffle hash input changed: %s", data)
+	}
+	if h := shufflehash(data); h != 17834403774394226856 {
+		t.Errorf("unexpected legacy shuffle hash %d", h)
+	}
+	if h := shufflehashV2(data); h != 2384341264143275561 {
+		t.Errorf("unexpected sha256 shuffle hash %d", h)
+	}
+	data, err = shuffleHashBinaryInput(seed, 100, nodeId, 5)
+	if err != nil {
+		t.Fatalf("shuffleHashBinaryInput failed: %s", err)
+	}
+	if h := shufflehashV2(data); h != 5587558807727350282 {
+		t.Errorf("unexpected sha256 shuffle hash of the binary input %d", h)
+	}
+
+	config := testConfiguration()
+	config.L = 28
+	legacy := []uint32{6, 2, 5, 3, 3, 4, 3, 6, 1, 1, 5, 1, 5, 3, 2, 2, 7, 2, 1, 4, 4, 1, 1, 2}
+	sha := []uint32{2, 5, 6, 6, 2, 5, 2, 4, 3, 3, 1, 1, 4, 5, 7, 1, 1, 1, 1, 2, 2, 4, 3, 3}
+	binary := []uint32{7, 1, 4, 6, 5, 5, 1, 3, 4, 3, 3, 2, 1, 5, 1, 2, 2, 6, 1, 2, 4, 2, 1, 3}
+	binarySha := []uint32{7, 4, 6, 1, 1, 5, 3, 5, 4, 1, 6, 2, 2, 2, 5, 4, 1, 2, 3, 2, 1, 1, 3, 3}
+
+	_, posTable, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(posTable, legacy) {
+		t.Errorf("legacy pos table changed: %v", posTable)
+	}
+
+	defer func(height uint32) { SHA256_SHUFFLE_HEIGHT = height }(SHA256_SHUFFLE_HEIGHT)
+	SHA256_SHUFFLE_HEIGHT = 100
+	_, posTable, err = CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(posTable, sha) {
+		t.Errorf("unexpected sha256 pos table: %v", posTable)
+	}
+	// heights before the switch still use the legacy hash
+	_, posTable, err = CalDposTableWithSeed(seed, 99, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if reflect.DeepEqual(posTable, sha) {
+		t.Errorf("height below the switch used the sha256 shuffle")
+	}
+
+	defer func(height uint32) { BINARY_SHUFFLE_HEIGHT = height }(BINARY_SHUFFLE_HEIGHT)
+	BINARY_SHUFFLE_HEIGHT = 100
+	_, posTable, err = CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(posTable, binarySha) {
+		t.Errorf("unexpected sha256 pos table of the binary input: %v", posTable)
+	}
+	SHA256_SHUFFLE_HEIGHT = math.MaxUint32
+	_, posTable, err = CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(posTable, binary) {
+		t.Errorf("unexpected fnv pos table of the binary input: %v", posTable)
+	}
+}
+
+func TestUnbiasedShuffle(t *testing.T) {
+	config := testConfiguration()
+	// every peer has rank 1, the pos table is a permutation of the peers
+	config.L = 2 * config.K
+	peers := testPeers(100, 100, 100, 100, 100, 100, 100)
+	const rounds = 7000
+	// break the stake ties by Index so the last peer starts last
+	defer func(height uint32) { INDEX_TIE_BREAK_HEIGHT = height }(INDEX_TIE_BREAK_HEIGHT)
+	INDEX_TIE_BREAK_HEIGHT = 0
+
+	positions := func(height uint32) []int {
+		counts := make([]int, config.K)
+		for r := 0; r < rounds; r++ {
+			seed := common.Uint256{byte(r), byte(r >> 8)}
+			_, posTable, err := CalDposTableWithSeed(seed, height, config, peers)
+			if err != nil {
+				t.Fatalf("CalDposTableWithSeed failed: %s", err)
+			}
+			for i, index := range posTable {
+				if index == peers[len(peers)-1].Index {
+					counts[i]++
+				}
+			}
+		}
+		return counts
+	}
+
+	// the legacy shuffle never leaves the last element in place
+	legacy := positions(100)
+	if legacy[len(legacy)-1] != 0 {
+		t.Errorf("legacy shuffle left the last peer in place %d times", legacy[len(legacy)-1])
+	}
+
+	// fnv64a mixes the two seed bytes too poorly to check the distribution,
+	// use sha256 so only the index selection is under test
+	defer func(height uint32) { UNBIASED_SHUFFLE_HEIGHT = height }(UNBIASED_SHUFFLE_HEIGHT)
+	defer func(height uint32) { SHA256_SHUFFLE_HEIGHT = height }(SHA256_SHUFFLE_HEIGHT)
+	UNBIASED_SHUFFLE_HEIGHT = 100
+	SHA256_SHUFFLE_HEIGHT = 100
+	expected := rounds / int(config.K)
+	for i, count := range positions(100) {
+		if count < expected*8/10 || count > expected*12/10 {
+			t.Errorf("position %d: %d of %d rounds, expected about %d", i, count, rounds, expected)
+		}
+	}
+}
+
+func TestIsEligibleProposer(t *testing.T) {
+	sk, pk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	peerPubkey := vbftconfig.PubkeyID(pk)
+	msg := []byte("block 100")
+	vrfValue, vrfProof, err := vrf.Vrf(sk, msg)
+	if err != nil {
+		t.Fatalf("vrf.Vrf failed: %s", err)
+	}
+	posTable := []uint32{3, 1, 4, 1, 5, 9, 2, 6, 5, 3, 5}
+	slot := int((uint32(vrfValue[0]) | uint32(vrfValue[1])<<8) % uint32(len(posTable)))
+
+	ok, err := IsEligibleProposer(vrfProof, vrfValue, peerPubkey, msg, posTable, slot)
+	if err != nil || !ok {
+		t.Errorf("selected slot %d: got %v, %v, want true, nil", slot, ok, err)
+	}
+	other := (slot + 1) % len(posTable)
+	ok, err = IsEligibleProposer(vrfProof, vrfValue, peerPubkey, msg, posTable, other)
+	if err != nil || ok {
+		t.Errorf("mismatched slot %d: got %v, %v, want false, nil", other, ok, err)
+	}
+
+	if _, err := IsEligibleProposer(vrfProof, vrfValue, peerPubkey, []byte("block 101"), posTable, slot); err == nil {
+		t.Errorf("proof of another message accepted")
+	}
+	for _, bad := range []int{-1, len(posTable)} {
+		if _, err := IsEligibleProposer(vrfProof, vrfValue, peerPubkey, msg, posTable, bad); err == nil {
+			t.Errorf("slot %d out of range accepted", bad)
+		}
+	}
+}
+
+func TestVrfShuffleSeed(t *testing.T) {
+	sk, pk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	peerPubkey := vbftconfig.PubkeyID(pk)
+	msg := []byte("block 100")
+	vrfValue, vrfProof, err := vrf.Vrf(sk, msg)
+	if err != nil {
+		t.Fatalf("vrf.Vrf failed: %s", err)
+	}
+
+	seed, err := VrfShuffleSeed(peerPubkey, msg, vrfValue, vrfProof)
+	if err != nil {
+		t.Fatalf("VrfShuffleSeed failed: %s", err)
+	}
+	if seed != common.Uint256(sha256.Sum256(vrfValue)) {
+		t.Errorf("unexpected seed %x", seed)
+	}
+
+	// forged proof
+	forged := make([]byte, len(vrfProof))
+	copy(forged, vrfProof)
+	forged[len(forged)-1] ^= 0xff
+	if _, err := VrfShuffleSeed(peerPubkey, msg, vrfValue, forged); err == nil {
+		t.Errorf("forged vrf proof accepted")
+	}
+	// proof of another message
+	if _, err := VrfShuffleSeed(peerPubkey, []byte("block 101"), vrfValue, vrfProof); err == nil {
+		t.Errorf("vrf proof of another message accepted")
+	}
+	// proof of another key
+	_, otherPk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	if _, err := VrfShuffleSeed(vbftconfig.PubkeyID(otherPk), msg, vrfValue, vrfProof); err == nil {
+		t.Errorf("vrf proof of another key accepted")
+	}
+}
+
+func TestGetGlobalParam(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	globalParam := &GlobalParam{
+		CandidateFee: 500000000000,
+		MinInitStake: 10000,
+		CandidateNum: 7 * 7,
+		PosLimit:     20,
+		A:            50,
+		B:            50,
+		Yita:         5,
+		Penalty:      5,
+	}
+	if err := putGlobalParam(native, contract, globalParam); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		param, err := getGlobalParam(native, contract)
+		if err != nil {
+			t.Fatalf("getGlobalParam failed: %s", err)
+		}
+		if *param != *globalParam {
+			t.Fatalf("expected %v, got %v", globalParam, param)
+		}
+		// callers may modify the returned param, later reads must not see it
+		param.Yita = 100
+	}
+
+	// update in the middle of the execution
+	updated := *globalParam
+	updated.Yita = 10
+	if err := putGlobalParam(native, contract, &updated); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	param, err := getGlobalParam(native, contract)
+	if err != nil {
+		t.Fatalf("getGlobalParam failed: %s", err)
+	}
+	if *param != updated {
+		t.Errorf("stale global param after update: %v", param)
+	}
+
+	// another execution on a different state reads its own value
+	other := newTestNative()
+	if err := putGlobalParam(other, contract, globalParam); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	param, err = getGlobalParam(other, contract)
+	if err != nil {
+		t.Fatalf("getGlobalParam failed: %s", err)
+	}
+	if *param != *globalParam {
+		t.Errorf("global param of another execution leaked: %v", param)
+	}
+	param, err = getGlobalParam(native, contract)
+	if err != nil {
+		t.Fatalf("getGlobalParam failed: %s", err)
+	}
+	if *param != updated {
+		t.Errorf("expected %v, got %v", updated, param)
+	}
+}
+
+func TestGovernanceViewReadAfterWrite(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	if err := putGovernanceView(native, contract, &GovernanceView{View: 3, Height: 30}); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		governanceView, err := GetGovernanceView(native, contract)
+		if err != nil {
+			t.Fatalf("GetGovernanceView failed: %s", err)
+		}
+		if governanceView.View != 3 || governanceView.Height != 30 {
+			t.Fatalf("got %+v, want view 3 at height 30", governanceView)
+		}
+		// callers may modify the returned view, later reads must not see it
+		governanceView.View = 100
+	}
+
+	// write then read in the same execution
+	newView, err := IncrementGovernanceView(native, contract, common.Uint256{1}, 40)
+	if err != nil {
+		t.Fatalf("IncrementGovernanceView failed: %s", err)
+	}
+	if view, err := GetView(native, contract); err != nil || view != newView || view != 4 {
+		t.Errorf("GetView after write = %d, %v, want 4", view, err)
+	}
+	if governanceView, err := GetGovernanceView(native, contract); err != nil || governanceView.Height != 40 {
+		t.Errorf("stale governance view after write: %+v, %v", governanceView, err)
+	}
+
+	// another execution over the same store sees the committed view
+	native.CloneCache.Commit()
+	other := newTestNative()
+	other.CloneCache = storage.NewCloneCache(native.CloneCache.Store)
+	if view, err := GetView(other, contract); err != nil || view != 4 {
+		t.Errorf("GetView in another execution = %d, %v, want 4", view, err)
+	}
+}
+
+func TestSplitFee(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	splitFee, err := GetSplitFee(native, contract)
+	if err != nil {
+		t.Fatalf("getSplitFee failed: %s", err)
+	}
+	if splitFee != 0 {
+		t.Errorf("expected 0 before any split fee is stored, got %d", splitFee)
+	}
+
+	for _, amount := range []uint64{1, 1000000000, math.MaxUint64} {
+		if err := PutSplitFee(native, contract, amount); err != nil {
+			t.Fatalf("putSplitFee failed: %s", err)
+		}
+		splitFee, err := GetSplitFee(native, contract)
+		if err != nil {
+			t.Fatalf("getSplitFee failed: %s", err)
+		}
+		if splitFee != amount {
+			t.Errorf("expected %d, got %d", amount, splitFee)
+		}
+	}
+
+	if err := PutSplitFee(native, contract, math.MaxUint64-10); err != nil {
+		t.Fatalf("putSplitFee failed: %s", err)
+	}
+	if err := addSplitFee(native, contract, 10); err != nil {
+		t.Fatalf("addSplitFee failed: %s", err)
+	}
+	if err := addSplitFee(native, contract, 1); err == nil {
+		t.Errorf("addSplitFee should fail on overflow")
+	}
+	splitFee, err = GetSplitFee(native, contract)
+	if err != nil {
+		t.Fatalf("getSplitFee failed: %s", err)
+	}
+	if splitFee != math.MaxUint64 {
+		t.Errorf("split fee changed by a failed add: %d", splitFee)
+	}
+}
+
+func TestCalDposTableStakeOverflow(t *testing.T) {
+	peers := testPeers(math.MaxUint64-10, 11, 1, 1, 1, 1, 1)
+	if _, _, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers); err == nil {
+		t.Errorf("expected error when stake sum overflows")
+	}
+	peers = testPeers(math.MaxUint64-10, 5, 1, 1, 1, 1, 1)
+	if _, _, err := CalDposTableWithSeed(common.Uint256{}, 1, testConfiguration(), peers); err != nil {
+		t.Errorf("CalDposTableWithSeed failed: %s", err)
+	}
+}
+
+func TestCalDposTableUnsortedPeers(t *testing.T) {
+	config := testConfiguration()
+	sorted := testPeers(70000, 60000, 50000, 50000, 30000, 20000, 10000, 5000, 1000)
+	unsorted := []*PeerStakeInfo{sorted[8], sorted[3], sorted[0], sorted[6], sorted[2], sorted[7], sorted[1], sorted[5], sorted[4]}
+	input := append([]*PeerStakeInfo(nil), unsorted...)
+
+	expectedPeers, expectedTable, err := CalDposTableWithSeed(common.Uint256{7}, 10, config, sorted)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	chainPeers, posTable, err := CalDposTableWithSeed(common.Uint256{7}, 10, config, unsorted)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(chainPeers, expectedPeers) || !reflect.DeepEqual(posTable, expectedTable) {
+		t.Errorf("unsorted peers produced a different table")
+	}
+	if !reflect.DeepEqual(unsorted, input) {
+		t.Errorf("CalDposTableWithSeed modified the peers of caller")
+	}
+
+	sortPeersByStake(unsorted)
+	if !reflect.DeepEqual(unsorted, sorted) {
+		t.Errorf("sortPeersByStake: unexpected order")
+	}
+}
+
+func TestFindUnderfundedPeers(t *testing.T) {
+	peerPoolMap := testPeerPoolMap(0, 10000, 9999, 20000, 500, 0, 100)
+	peerPoolMap.PeerPoolMap[testPubkey(2)].Status = CandidateStatus
+	// quitting peers are on their way out already
+	peerPoolMap.PeerPoolMap[testPubkey(6)].Status = QuitingStatus
+
+	var indexes []uint32
+	for _, item := range FindUnderfundedPeers(peerPoolMap, 10000) {
+		indexes = append(indexes, item.Index)
+	}
+	if !reflect.DeepEqual(indexes, []uint32{2, 4, 5}) {
+		t.Errorf("underfunded peers %v, want [2 4 5]", indexes)
+	}
+	if peers := FindUnderfundedPeers(peerPoolMap, 0); len(peers) != 0 {
+		t.Errorf("%d peers under a floor of 0", len(peers))
+	}
+}
+
+func TestValidatePoolPubkeys(t *testing.T) {
+	peerPoolMap := testPeerPoolMap(0, 100, 200, 300)
+	if invalid, err := ValidatePoolPubkeys(peerPoolMap); err != nil || len(invalid) != 0 {
+		t.Errorf("valid pool: got %v, %v", invalid, err)
+	}
+
+	bad := "02" + strings.Repeat("ff", 32)
+	peerPoolMap.PeerPoolMap[bad] = &PeerPoolItem{Index: 4, PeerPubkey: bad, Status: ConsensusStatus}
+	invalid, err := ValidatePoolPubkeys(peerPoolMap)
+	if err != nil {
+		t.Fatalf("ValidatePoolPubkeys failed: %s", err)
+	}
+	if !reflect.DeepEqual(invalid, []string{bad}) {
+		t.Errorf("invalid pubkeys %v, want [%s]", invalid, bad)
+	}
+
+	if _, err := ValidatePoolPubkeys(nil); err == nil {
+		t.Errorf("nil pool accepted")
+	}
+}
+
+func TestValidatePeerPubKeyFormat(t *testing.T) {
+	_, p256, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	defer func(height uint32) { PEER_PUBKEY_CHECK_HEIGHT = height }(PEER_PUBKEY_CHECK_HEIGHT)
+	PEER_PUBKEY_CHECK_HEIGHT = 100
+	if err := validatePeerPubKeyFormat(hex.EncodeToString(keypair.SerializePublicKey(p256)), 100); err != nil {
+		t.Errorf("valid P-256 pubkey rejected: %s", err)
+	}
+
+	// P-384 is accepted by vrf but is not the chain's signature scheme
+	_, p384, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P384)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	if err := validatePeerPubKeyFormat(hex.EncodeToString(keypair.SerializePublicKey(p384)), 100); err == nil {
+		t.Error("P-384 pubkey should be rejected")
+	}
+	if err := validatePeerPubKeyFormat(hex.EncodeToString(keypair.SerializePublicKey(p384)), 99); err != nil {
+		t.Errorf("P-384 pubkey rejected before PEER_PUBKEY_CHECK_HEIGHT: %s", err)
+	}
+
+	for _, garbage := range []string{"", "zz", "0102", "02" + strings.Repeat("ff", 32)} {
+		if err := validatePeerPubKeyFormat(garbage, 100); err == nil {
+			t.Errorf("garbage pubkey %q should be rejected", garbage)
+		}
+	}
+
+	// lengths are checked before parsing
+	raw := keypair.SerializePublicKey(p256)
+	uncompressed := elliptic.Marshal(elliptic.P256(), p256.(*ec.PublicKey).X, p256.(*ec.PublicKey).Y)
+	long := hex.EncodeToString(append([]byte{byte(keypair.PK_ECDSA), keypair.P256}, uncompressed...))
+	if len(long) != MAX_PEER_PUBKEY_LEN {
+		t.Fatalf("longest pubkey encoding is %d characters, want %d", len(long), MAX_PEER_PUBKEY_LEN)
+	}
+	if err := validatePeerPubKeyFormat(long, 100); err != nil {
+		t.Errorf("valid uncompressed P-256 pubkey rejected: %s", err)
+	}
+	for _, pubkey := range []string{
+		"",
+		"02",
+		hex.EncodeToString(raw)[:MIN_PEER_PUBKEY_LEN-1],
+		long + "00",
+		strings.Repeat("ab", 1<<20),
+	} {
+		if err := validatePeerPubKeyFormat(pubkey, 100); errors.RootErr(err) != ErrPeerPubkeyLength {
+			t.Errorf("pubkey of length %d: got %v, want ErrPeerPubkeyLength", len(pubkey), err)
+		}
+		if err := validatePeerPubKeyFormat(pubkey, 99); errors.RootErr(err) == ErrPeerPubkeyLength {
+			t.Errorf("pubkey of length %d rejected by length before PEER_PUBKEY_CHECK_HEIGHT: %v", len(pubkey), err)
+		}
+	}
+}
+
+func TestFindDuplicatePeer(t *testing.T) {
+	_, pk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	raw := keypair.SerializePublicKey(pk)
+	pubkey := hex.EncodeToString(raw)
+	peerPoolMap := &PeerPoolMap{
+		PeerPoolMap: map[string]*PeerPoolItem{
+			pubkey: {Index: 1, PeerPubkey: pubkey},
+		},
+	}
+
+	// the long form carries the key type and curve label in front of the point
+	long := hex.EncodeToString(append([]byte{byte(keypair.PK_ECDSA), keypair.P256}, raw...))
+	for _, candidate := range []string{pubkey, strings.ToUpper(pubkey), long, strings.ToUpper(long)} {
+		item, ok := FindDuplicatePeer(peerPoolMap, candidate)
+		if !ok || item.Index != 1 {
+			t.Errorf("FindDuplicatePeer(%s) = %v, %v, want peer 1", candidate, item, ok)
+		}
+	}
+
+	_, other, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	if item, ok := FindDuplicatePeer(peerPoolMap, hex.EncodeToString(keypair.SerializePublicKey(other))); ok {
+		t.Errorf("unexpected duplicate %v", item)
+	}
+	if _, ok := FindDuplicatePeer(peerPoolMap, "zz"); ok {
+		t.Error("garbage pubkey should not match")
+	}
+	if _, ok := FindDuplicatePeer(nil, pubkey); ok {
+		t.Error("nil peer pool should not match")
+	}
+}
+
+func TestEqualPubkey(t *testing.T) {
+	_, pk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	raw := keypair.SerializePublicKey(pk)
+	pubkey := hex.EncodeToString(raw)
+	long := hex.EncodeToString(append([]byte{byte(keypair.PK_ECDSA), keypair.P256}, raw...))
+	for _, other := range []string{pubkey, strings.ToUpper(pubkey), long, strings.ToUpper(long)} {
+		if !EqualPubkey(pubkey, other) || !EqualPubkey(other, pubkey) {
+			t.Errorf("EqualPubkey(%s, %s) = false, want true", pubkey, other)
+		}
+	}
+
+	_, pk2, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	other := hex.EncodeToString(keypair.SerializePublicKey(pk2))
+	vectors := []struct {
+		a, b  string
+		equal bool
+	}{
+		{pubkey, other, false},
+		{pubkey, pubkey[:len(pubkey)-2], false},
+		{pubkey, "", false},
+		{"zz", "ZZ", true},
+		{"zz", "zy", false},
+		{"", "", true},
+	}
+	for _, v := range vectors {
+		if equal := EqualPubkey(v.a, v.b); equal != v.equal {
+			t.Errorf("EqualPubkey(%q, %q) = %v, want %v", v.a, v.b, equal, v.equal)
+		}
+	}
+}
+
+func TestGetViewOrZero(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	view, initialized, err := GetViewOrZero(native, contract)
+	if err != nil || initialized || view != 0 {
+		t.Errorf("no governance view: got %d, %v, %v, want 0, false, nil", view, initialized, err)
+	}
+
+	if err := putGovernanceView(native, contract, &GovernanceView{View: 0, Height: 1}); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	view, initialized, err = GetViewOrZero(native, contract)
+	if err != nil || !initialized || view != 0 {
+		t.Errorf("view 0: got %d, %v, %v, want 0, true, nil", view, initialized, err)
+	}
+	if view, err := GetView(native, contract); err != nil || view != 0 {
+		t.Errorf("GetView: got %d, %v, want 0, nil", view, err)
+	}
+
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(GOVERNANCE_VIEW)),
+		&states.StorageItem{Value: []byte{1}})
+	if _, _, err := GetViewOrZero(native, contract); errors.RootErr(err) != ErrGovernanceViewCorrupt {
+		t.Errorf("expected ErrGovernanceViewCorrupt, got %v", err)
+	}
+}
+
+func TestIncrementGovernanceView(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	if _, err := IncrementGovernanceView(native, contract, common.Uint256{1}, 10); errors.RootErr(err) != ErrGovernanceViewNotFound {
+		t.Errorf("expected ErrGovernanceViewNotFound, got %v", err)
+	}
+
+	if err := putGovernanceView(native, contract, &GovernanceView{View: 4, Height: 1}); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	txHash := common.Uint256{7, 8, 9}
+	newView, err := IncrementGovernanceView(native, contract, txHash, 120)
+	if err != nil {
+		t.Fatalf("IncrementGovernanceView failed: %s", err)
+	}
+	if newView != 5 {
+		t.Errorf("new view %d, want 5", newView)
+	}
+	governanceView, err := GetGovernanceView(native, contract)
+	if err != nil {
+		t.Fatalf("GetGovernanceView failed: %s", err)
+	}
+	want := GovernanceView{View: 5, Height: 120, TxHash: txHash}
+	if *governanceView != want {
+		t.Errorf("stored %+v, want %+v", governanceView, want)
+	}
+
+	overflow := &GovernanceView{View: math.MaxUint32, Height: 1}
+	if err := putGovernanceView(native, contract, overflow); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	if _, err := IncrementGovernanceView(native, contract, txHash, 130); err == nil {
+		t.Errorf("view overflow accepted")
+	}
+	if governanceView, err := GetGovernanceView(native, contract); err != nil || *governanceView != *overflow {
+		t.Errorf("failed increment changed the view: %+v, %v", governanceView, err)
+	}
+}
+
+func TestPutGovernanceViewMonotonic(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	if err := putGovernanceView(native, contract, &GovernanceView{View: 5, Height: 100}); err != nil {
+		t.Fatalf("first putGovernanceView failed: %s", err)
+	}
+	for _, view := range []uint32{5, 4, 0} {
+		err := putGovernanceView(native, contract, &GovernanceView{View: view, Height: 200})
+		if err == nil || !strings.Contains(err.Error(), "not greater than current view 5") {
+			t.Errorf("view %d: expected stale view error, got %v", view, err)
+		}
+	}
+	if governanceView, err := GetGovernanceView(native, contract); err != nil || governanceView.View != 5 || governanceView.Height != 100 {
+		t.Errorf("stale write changed the stored view: %+v, %v", governanceView, err)
+	}
+	if err := putGovernanceView(native, contract, &GovernanceView{View: 6, Height: 200}); err != nil {
+		t.Errorf("putGovernanceView of the next view failed: %s", err)
+	}
+}
+
+func TestStorageKeys(t *testing.T) {
+	contract := utils.GovernanceContractAddress
+	// the layouts stored on chain, spelled out so the builders can not drift
+	prefix := append([]byte(nil), contract[:]...)
+	concat := func(parts ...[]byte) []byte {
+		key := append([]byte(nil), prefix...)
+		for _, part := range parts {
+			key = append(key, part...)
+		}
+		return key
+	}
+
+	if key := governanceViewKey(contract); !bytes.Equal(key, concat([]byte("governanceView"))) {
+		t.Errorf("governanceViewKey = %x", key)
+	}
+	if key := globalParamKey(contract); !bytes.Equal(key, concat([]byte("globalParam"))) {
+		t.Errorf("globalParamKey = %x", key)
+	}
+	key, err := peerPoolKey(contract, 0x01020304)
+	if err != nil {
+		t.Fatalf("peerPoolKey failed: %s", err)
+	}
+	if want := concat([]byte("peerPool"), []byte{4, 3, 2, 1}); !bytes.Equal(key, want) {
+		t.Errorf("peerPoolKey = %x, want %x", key, want)
+	}
+	key, err = peerPoolItemKey(contract, 0x01020304, 7)
+	if err != nil {
+		t.Fatalf("peerPoolItemKey failed: %s", err)
+	}
+	if want := concat([]byte("peerPool"), []byte{4, 3, 2, 1}, []byte{7, 0, 0, 0}); !bytes.Equal(key, want) {
+		t.Errorf("peerPoolItemKey = %x, want %x", key, want)
+	}
+	key, err = posTableKey(contract, 0x01020304)
+	if err != nil {
+		t.Fatalf("posTableKey failed: %s", err)
+	}
+	if want := concat([]byte("posTable"), []byte{4, 3, 2, 1}); !bytes.Equal(key, want) {
+		t.Errorf("posTableKey = %x, want %x", key, want)
+	}
+	key, err = lockupKey(contract, "0a0b", common.Address{9})
+	if err != nil {
+		t.Fatalf("lockupKey failed: %s", err)
+	}
+	if want := concat([]byte("lockup"), []byte{0x0a, 0x0b}, []byte{9}, make([]byte, 19)); !bytes.Equal(key, want) {
+		t.Errorf("lockupKey = %x, want %x", key, want)
+	}
+}
+
+func TestPushGovernanceEvent(t *testing.T) {
+	defer func(enabled bool) { config.DefConfig.Common.EnableEventLog = enabled }(config.DefConfig.Common.EnableEventLog)
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	config.DefConfig.Common.EnableEventLog = false
+	pushGovernanceEvent(native, contract, VIEW_CHANGE_EVENT, uint32(5))
+	if len(native.Notifications) != 0 {
+		t.Fatalf("event pushed with the event log disabled")
+	}
+
+	config.DefConfig.Common.EnableEventLog = true
+	txHash := common.Uint256{1, 2, 3}
+	pushGovernanceEvent(native, contract, VIEW_CHANGE_EVENT, uint32(5), uint32(120), txHash.ToHexString())
+	if len(native.Notifications) != 1 {
+		t.Fatalf("%d notifications, want 1", len(native.Notifications))
+	}
+	notification := native.Notifications[0]
+	if notification.ContractAddress != contract {
+		t.Errorf("notification of contract %x, want %x", notification.ContractAddress, contract)
+	}
+	want := []interface{}{"viewChange", uint32(5), uint32(120), txHash.ToHexString()}
+	if !reflect.DeepEqual(notification.States, want) {
+		t.Errorf("notification states %v, want %v", notification.States, want)
+	}
+}
+
+func TestPeerPoolItemStorage(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	const view = 2
+
+	peerPoolMap := testPeerPoolMap(view, 100, 200, 300)
+	if err := putPeerPoolMap(native, contract, view, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+
+	// blob storage: reads fall back to the whole map
+	item, err := GetPeerPoolItem(native, contract, view, 2)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItem failed: %s", err)
+	}
+	if item.InitPos != 200 {
+		t.Errorf("peer 2 InitPos = %d, want 200", item.InitPos)
+	}
+	if _, err := GetPeerPoolItem(native, contract, view, 9); err == nil {
+		t.Error("GetPeerPoolItem of unknown index should fail")
+	}
+	updated := *item
+	updated.TotalPos = 50
+	if err := PutPeerPoolItem(native, contract, view, &updated); err != nil {
+		t.Fatalf("PutPeerPoolItem failed: %s", err)
+	}
+	blob, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMap failed: %s", err)
+	}
+	if blob.PeerPoolMap[updated.PeerPubkey].TotalPos != 50 {
+		t.Errorf("blob was not updated: %v", blob.PeerPoolMap[updated.PeerPubkey])
+	}
+
+	// per item storage: a single peer update only touches its own key
+	for _, item := range blob.PeerPoolMap {
+		if err := storePeerPoolItem(native, contract, view, item); err != nil {
+			t.Fatalf("storePeerPoolItem failed: %s", err)
+		}
+	}
+	if err := putPeerPoolIndexes(native, contract, view, []uint32{3, 1, 2}); err != nil {
+		t.Fatalf("putPeerPoolIndexes failed: %s", err)
+	}
+	viewBytes, _ := GetUint32Bytes(view)
+	blobKey := utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes)
+	// as MigratePeerPoolToItems, drop the blob so reads use the items
+	native.CloneCache.Delete(scommon.ST_STORAGE, blobKey)
+	blobBefore, _ := native.CloneCache.Get(scommon.ST_STORAGE, blobKey)
+	otherKey, _ := peerPoolItemKey(contract, view, 1)
+	otherBefore, _ := native.CloneCache.Get(scommon.ST_STORAGE, otherKey)
+
+	updated.TotalPos = 70
+	if err := PutPeerPoolItem(native, contract, view, &updated); err != nil {
+		t.Fatalf("PutPeerPoolItem failed: %s", err)
+	}
+	item, err = GetPeerPoolItem(native, contract, view, 2)
+	if err != nil {
+		t.Fatalf("GetPeerPoolItem failed: %s", err)
+	}
+	if item.TotalPos != 70 {
+		t.Errorf("peer 2 TotalPos = %d, want 70", item.TotalPos)
+	}
+	if blobAfter, _ := native.CloneCache.Get(scommon.ST_STORAGE, blobKey); blobAfter != blobBefore {
+		t.Error("PutPeerPoolItem rewrote the blob of a per item view")
+	}
+	if otherAfter, _ := native.CloneCache.Get(scommon.ST_STORAGE, otherKey); otherAfter != otherBefore {
+		t.Error("PutPeerPoolItem rewrote another peer")
+	}
+
+	// a new peer is added to the index list
+	added := &PeerPoolItem{Index: 4, PeerPubkey: testPubkey(5), InitPos: 400}
+	if err := PutPeerPoolItem(native, contract, view, added); err != nil {
+		t.Fatalf("PutPeerPoolItem failed: %s", err)
+	}
+	full, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMap failed: %s", err)
+	}
+	if len(full.PeerPoolMap) != 4 {
+		t.Fatalf("full map has %d peers, want 4", len(full.PeerPoolMap))
+	}
+	if full.PeerPoolMap[updated.PeerPubkey].TotalPos != 70 || full.PeerPoolMap[added.PeerPubkey].InitPos != 400 {
+		t.Errorf("unexpected full map %v", full.PeerPoolMap)
+	}
+
+	// removing a peer from the map drops its item
+	delete(full.PeerPoolMap, added.PeerPubkey)
+	if err := putPeerPoolMap(native, contract, view, full); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	if item, err := loadPeerPoolItem(native, contract, view, 4); err != nil || item != nil {
+		t.Errorf("removed peer still stored: %v, %v", item, err)
+	}
+	if full, err := GetPeerPoolMap(native, contract, view); err != nil || len(full.PeerPoolMap) != 3 {
+		t.Errorf("GetPeerPoolMap after removal: %v, %v", full, err)
+	}
+}
+
+func TestMigratePeerPoolToItems(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	const view = 5
+
+	if _, err := MigratePeerPoolToItems(native, contract, view); err == nil {
+		t.Error("migrating a view without peer pool map should fail")
+	}
+
+	peerPoolMap := testPeerPoolMap(view, 10, 20, 30, 40)
+	if err := putPeerPoolMap(native, contract, view, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	migrated, err := MigratePeerPoolToItems(native, contract, view)
+	if err != nil {
+		t.Fatalf("MigratePeerPoolToItems failed: %s", err)
+	}
+	if migrated != 4 {
+		t.Errorf("migrated %d items, want 4", migrated)
+	}
+	for _, want := range peerPoolMap.PeerPoolMap {
+		got, err := loadPeerPoolItem(native, contract, view, want.Index)
+		if err != nil || got == nil {
+			t.Fatalf("peer %d not stored per item: %v, %v", want.Index, got, err)
+		}
+		got, err = GetPeerPoolItem(native, contract, view, want.Index)
+		if err != nil {
+			t.Fatalf("GetPeerPoolItem(%d) failed: %s", want.Index, err)
+		}
+		if *got != *want {
+			t.Errorf("peer %d: got %v, want %v", want.Index, got, want)
+		}
+	}
+	full, err := GetPeerPoolMap(native, contract, view)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMap failed: %s", err)
+	}
+	if !reflect.DeepEqual(full, peerPoolMap) {
+		t.Errorf("GetPeerPoolMap after migration = %v, want %v", full, peerPoolMap)
+	}
+
+	migrated, err = MigratePeerPoolToItems(native, contract, view)
+	if err != nil || migrated != 0 {
+		t.Errorf("second migration: %d, %v, want 0, nil", migrated, err)
+	}
+}
+
+func TestDeletePeerPoolMap(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	if err := putPeerPoolMap(native, contract, 1, testPeerPoolMap(1, 10, 20)); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	peerPoolMap := testPeerPoolMap(2, 10, 20, 30)
+	if err := putPeerPoolMap(native, contract, 2, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	if _, err := MigratePeerPoolToItems(native, contract, 2); err != nil {
+		t.Fatalf("MigratePeerPoolToItems failed: %s", err)
+	}
+
+	// the next view of a migrated view is stored per item as well
+	if err := putPeerPoolItems(native, contract, 3, peerPoolMap, nil); err != nil {
+		t.Fatalf("putPeerPoolItems failed: %s", err)
+	}
+	if _, migrated, err := getPeerPoolIndexes(native, contract, 3); err != nil || !migrated {
+		t.Errorf("view 3 not stored per item: %v, %v", migrated, err)
+	}
+	blobKey, _ := peerPoolKey(contract, 3)
+	if item, _ := native.CloneCache.Get(scommon.ST_STORAGE, blobKey); item != nil {
+		t.Error("view 3 also stored as a blob")
+	}
+
+	for _, view := range []uint32{1, 2} {
+		if err := deletePeerPoolMap(native, contract, view); err != nil {
+			t.Fatalf("deletePeerPoolMap(%d) failed: %s", view, err)
+		}
+		if peerPoolMap, err := loadPeerPoolMap(native, contract, view); err != nil || peerPoolMap != nil {
+			t.Errorf("view %d still stored: %v, %v", view, peerPoolMap, err)
+		}
+	}
+	if _, migrated, err := getPeerPoolIndexes(native, contract, 2); err != nil || migrated {
+		t.Errorf("index list of view 2 not deleted: %v, %v", migrated, err)
+	}
+	for _, peerPoolItem := range peerPoolMap.PeerPoolMap {
+		if item, err := loadPeerPoolItem(native, contract, 2, peerPoolItem.Index); err != nil || item != nil {
+			t.Errorf("peer %d of view 2 not deleted: %v, %v", peerPoolItem.Index, item, err)
+		}
+	}
+	if got, err := GetPeerPoolMap(native, contract, 3); err != nil || len(got.PeerPoolMap) != 3 {
+		t.Errorf("GetPeerPoolMap(3) = %v, %v", got, err)
+	}
+}
+
+func TestShufflePeersMatchesCalDposTable(t *testing.T) {
+	seed := common.Uint256{1, 2, 3}
+	config := testConfiguration()
+	peers := testPeers(700, 600, 500, 400, 300, 200, 100)
+
+	for _, height := range []uint32{100, 200} {
+		chainPeers, posTable, err := CalDposTableWithSeed(seed, height, config, peers)
+		if err != nil {
+			t.Fatalf("CalDposTableWithSeed failed: %s", err)
+		}
+
+		// rebuild the unshuffled table: ranks in stake order
+		sorted := make([]*PeerStakeInfo, len(peers))
+		copy(sorted, peers)
+		sortPeersByStake(sorted)
+		var sum uint64
+		for _, peer := range sorted {
+			sum += peer.Stake
+		}
+		scale := uint64(config.L/config.K - 1)
+		unshuffled := make([]uint32, 0)
+		for _, peer := range sorted {
+			for j := uint64(0); j < vbftconfig.CalcPeerRank(peer.Stake, scale, uint64(config.K), sum); j++ {
+				unshuffled = append(unshuffled, peer.Index)
+			}
+		}
+		input := make([]uint32, len(unshuffled))
+		copy(input, unshuffled)
+
+		shuffled, err := ShufflePeers(seed, height, input, chainPeers)
+		if err != nil {
+			t.Fatalf("ShufflePeers failed: %s", err)
+		}
+		if !reflect.DeepEqual(shuffled, posTable) {
+			t.Errorf("height %d: ShufflePeers = %v, calDposTable = %v", height, shuffled, posTable)
+		}
+		if !reflect.DeepEqual(input, unshuffled) {
+			t.Errorf("ShufflePeers modified its input")
+		}
+	}
+
+	if _, err := ShufflePeers(seed, 100, []uint32{1, 2}, map[uint32]*vbftconfig.PeerConfig{1: {Index: 1, ID: "01"}}); err == nil {
+		t.Error("ShufflePeers should fail on a peer missing from chainPeers")
+	}
+}
+
+func TestCheckVBFTConfigFaultTolerance(t *testing.T) {
+	// K = 2*C+1 passes the legacy bound but not K >= 3*C+1
+	configuration := &config.VBFTConfig{
+		N:                    7,
+		C:                    3,
+		K:                    7,
+		L:                    112,
+		BlockMsgDelay:        10000,
+		HashMsgDelay:         10000,
+		PeerHandshakeTimeout: 10,
+		MinInitStake:         10000,
+		VrfValue:             strings.Repeat("0", 128),
+		VrfProof:             strings.Repeat("0", 128),
+		Peers:                make([]*config.VBFTPeerStakeInfo, 7),
+	}
+	for i := range configuration.Peers {
+		configuration.Peers[i] = &config.VBFTPeerStakeInfo{Index: uint32(i + 1), PeerPubkey: testPubkey(i + 1)}
+	}
+	if err := CheckVBFTConfig(configuration, 0); err != nil && strings.Contains(err.Error(), "3*C+1") {
+		t.Errorf("K = 2*C+1 rejected before CONFIG_CHECK_HEIGHT: %s", err)
+	}
+	defer func(height uint32) { CONFIG_CHECK_HEIGHT = height }(CONFIG_CHECK_HEIGHT)
+	CONFIG_CHECK_HEIGHT = 0
+	if err := CheckVBFTConfig(configuration, 0); err == nil || !strings.Contains(err.Error(), "3*C+1") {
+		t.Errorf("K = 2*C+1 not rejected from CONFIG_CHECK_HEIGHT: %v", err)
+	}
+}
+
+func TestGetConfiguration(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	if _, err := GetConfiguration(native, contract); errors.RootErr(err) != ErrConfigNotFound {
+		t.Errorf("expected ErrConfigNotFound, got %v", err)
+	}
+
+	config := testConfiguration()
+	if err := putConfig(native, contract, config); err != nil {
+		t.Fatalf("putConfig failed: %s", err)
+	}
+	got, err := GetConfiguration(native, contract)
+	if err != nil {
+		t.Fatalf("GetConfiguration failed: %s", err)
+	}
+	if *got != *config {
+		t.Errorf("GetConfiguration = %v, want %v", got, config)
+	}
+}
+
+func TestGetGlobalParam2(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	got, err := GetGlobalParam2(native, contract)
+	if err != nil {
+		t.Fatalf("GetGlobalParam2 without a stored value failed: %s", err)
+	}
+	if *got != (GlobalParam2{}) {
+		t.Errorf("GetGlobalParam2 default = %v, want zero value", got)
+	}
+
+	globalParam2 := &GlobalParam2{MinAuthorizePos: 500, CandidateFeeSplitNum: 49, PeerCommission: 2000}
+	if err := putGlobalParam2(native, contract, globalParam2); err != nil {
+		t.Fatalf("putGlobalParam2 failed: %s", err)
+	}
+	got, err = GetGlobalParam2(native, contract)
+	if err != nil {
+		t.Fatalf("GetGlobalParam2 failed: %s", err)
+	}
+	if *got != *globalParam2 {
+		t.Errorf("GetGlobalParam2 = %v, want %v", got, globalParam2)
+	}
+
+	globalParam2.MaxCandidateNum = 100
+	if err := putGlobalParam2(native, contract, globalParam2); err != nil {
+		t.Fatalf("putGlobalParam2 failed: %s", err)
+	}
+	got, err = GetGlobalParam2(native, contract)
+	if err != nil {
+		t.Fatalf("GetGlobalParam2 failed: %s", err)
+	}
+	if *got != *globalParam2 {
+		t.Errorf("GetGlobalParam2 = %v, want %v", got, globalParam2)
+	}
+}
+
+func TestCalDposTableMaxCandidateNum(t *testing.T) {
+	native := newTestNative()
+	native.Height = 100
+	native.Tx = &types.Transaction{}
+	contract := utils.GovernanceContractAddress
+	config := testConfiguration()
+	peers := testPeers(90000, 80000, 70000, 60000, 50000, 40000, 30000, 20000, 10000)
+
+	if err := putGlobalParam2(native, contract, &GlobalParam2{MaxCandidateNum: 8}); err != nil {
+		t.Fatalf("putGlobalParam2 failed: %s", err)
+	}
+	if err := storePosTable(native, contract, 1, config, peers); err != nil {
+		t.Fatalf("cap applied before MAX_CANDIDATE_NUM_HEIGHT: %s", err)
+	}
+
+	defer func(height uint32) { MAX_CANDIDATE_NUM_HEIGHT = height }(MAX_CANDIDATE_NUM_HEIGHT)
+	MAX_CANDIDATE_NUM_HEIGHT = 100
+	err := storePosTable(native, contract, 1, config, peers)
+	if err == nil {
+		t.Fatalf("storePosTable accepted 9 peers with MaxCandidateNum 8")
+	}
+	if !strings.Contains(err.Error(), "MaxCandidateNum") {
+		t.Errorf("error %q does not name MaxCandidateNum", err)
+	}
+	if _, err := GetPosTable(native, contract, 1); err == nil {
+		t.Error("pos table stored before POS_TABLE_HEIGHT")
+	}
+
+	if err := putGlobalParam2(native, contract, &GlobalParam2{MaxCandidateNum: 9}); err != nil {
+		t.Fatalf("putGlobalParam2 failed: %s", err)
+	}
+	if err := storePosTable(native, contract, 1, config, peers); err != nil {
+		t.Errorf("storePosTable at the cap failed: %s", err)
+	}
+	if err := putGlobalParam2(native, contract, &GlobalParam2{}); err != nil {
+		t.Fatalf("putGlobalParam2 failed: %s", err)
+	}
+	if err := storePosTable(native, contract, 1, config, peers); err != nil {
+		t.Errorf("storePosTable without a cap failed: %s", err)
+	}
+}
+
+func TestAddSplitStake(t *testing.T) {
+	defer func(height uint32) { SPLIT_PAYOUT_HEIGHT = height }(SPLIT_PAYOUT_HEIGHT)
+	SPLIT_PAYOUT_HEIGHT = 100
+	if sum, err := addSplitStake(99, math.MaxUint64, 2); err != nil || sum != 1 {
+		t.Errorf("legacy split sum = %d, %v, want the wrapped 1", sum, err)
+	}
+	if _, err := addSplitStake(100, math.MaxUint64, 2); err == nil {
+		t.Error("split sum overflow accepted from SPLIT_PAYOUT_HEIGHT")
+	}
+	if sum, err := addSplitStake(100, 3, 4); err != nil || sum != 7 {
+		t.Errorf("split sum = %d, %v, want 7", sum, err)
+	}
+}
+
+func TestGetPosTable(t *testing.T) {
+	native := newTestNative()
+	native.Height = 100
+	native.Tx = &types.Transaction{}
+	contract := utils.GovernanceContractAddress
+	config := testConfiguration()
+	peers := testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000)
+
+	if err := storePosTable(native, contract, 3, config, peers); err != nil {
+		t.Fatalf("storePosTable failed: %s", err)
+	}
+	if _, err := GetPosTable(native, contract, 3); err == nil {
+		t.Error("pos table stored before POS_TABLE_HEIGHT")
+	}
+
+	defer func(height uint32) { POS_TABLE_HEIGHT = height }(POS_TABLE_HEIGHT)
+	POS_TABLE_HEIGHT = 100
+	if err := storePosTable(native, contract, 3, config, peers); err != nil {
+		t.Fatalf("storePosTable failed: %s", err)
+	}
+	_, posTable, err := CalDposTableWithSeed(native.Tx.Hash(), native.Height, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	stored, err := GetPosTable(native, contract, 3)
+	if err != nil {
+		t.Fatalf("GetPosTable failed: %s", err)
+	}
+	if !reflect.DeepEqual(stored, posTable) {
+		t.Errorf("stored pos table %v, computed %v", stored, posTable)
+	}
+	if _, err := GetPosTable(native, contract, 4); err == nil {
+		t.Error("GetPosTable should fail for a view without a table")
+	}
+}
+
+func TestSplitAmounts(t *testing.T) {
+	weights := []uint64{7, 5, 3, 3, 1}
+	for _, pool := range []uint64{0, 1, 18, 1000003, math.MaxUint64} {
+		for _, policy := range []RemainderPolicy{SplitRemainderKeep, SplitRemainderToTopPeer, SplitRemainderCarry} {
+			amounts, remainder, err := splitAmounts(pool, weights, policy)
+			if err != nil {
+				t.Fatalf("splitAmounts(%d, %d) failed: %s", pool, policy, err)
+			}
+			sum := new(big.Int).SetUint64(remainder)
+			for _, amount := range amounts {
+				sum.Add(sum, new(big.Int).SetUint64(amount))
+			}
+			if !sum.IsUint64() || sum.Uint64() != pool {
+				t.Errorf("splitAmounts(%d, %d): payouts + remainder = %s", pool, policy, sum)
+			}
+			if policy == SplitRemainderToTopPeer && remainder != 0 {
+				t.Errorf("splitAmounts(%d): remainder %d not paid to the top peer", pool, remainder)
+			}
+		}
+	}
+	amounts, remainder, _ := splitAmounts(1000003, weights, SplitRemainderKeep)
+	if !reflect.DeepEqual(amounts, []uint64{368422, 263158, 157895, 157895, 52631}) || remainder != 2 {
+		t.Errorf("splitAmounts = %v, %d", amounts, remainder)
+	}
+	if _, _, err := splitAmounts(100, []uint64{0, 0}, SplitRemainderKeep); err == nil {
+		t.Error("splitAmounts should fail on zero weights")
+	}
+}
+
+func TestExecuteSplitRemainder(t *testing.T) {
+	defer func(policy RemainderPolicy) { SPLIT_REMAINDER_POLICY = policy }(SPLIT_REMAINDER_POLICY)
+	defer func(height uint32) { SPLIT_PAYOUT_HEIGHT = height }(SPLIT_PAYOUT_HEIGHT)
+	SPLIT_PAYOUT_HEIGHT = 0
+
+	var balance uint64
+	var paid uint64
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"balanceOf": func(native *native.NativeService) ([]byte, error) {
+			return vmtypes.BigIntToBytes(new(big.Int).SetUint64(balance)), nil
+		},
+		"transfer": func(native *native.NativeService) ([]byte, error) {
+			transfers := new(ont.Transfers)
+			if err := transfers.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			for _, st := range transfers.States {
+				paid += st.Value
+				balance -= st.Value
+			}
+			return utils.BYTE_TRUE, nil
+		},
+	})
+	defer restore()
+
+	contract := utils.GovernanceContractAddress
+	peerPoolMap := testPeerPoolMap(0, 1000, 1100, 900, 1000, 1050, 950, 1000, 300, 200, 77)
+	for _, item := range peerPoolMap.PeerPoolMap {
+		item.Address = common.Address{byte(item.Index)}
+		if item.Index > 7 {
+			item.Status = CandidateStatus
+		}
+	}
+
+	for _, policy := range []RemainderPolicy{SplitRemainderKeep, SplitRemainderToTopPeer, SplitRemainderCarry} {
+		SPLIT_REMAINDER_POLICY = policy
+		native := newTestNative()
+		if err := putConfig(native, contract, testConfiguration()); err != nil {
+			t.Fatalf("putConfig failed: %s", err)
+		}
+		if err := putGlobalParam(native, contract, &GlobalParam{A: 50, B: 50, Yita: 5}); err != nil {
+			t.Fatalf("putGlobalParam failed: %s", err)
+		}
+		balance, paid = 1000003, 0
+		for round := 0; round < 3; round++ {
+			pool := balance
+			paid = 0
+			if err := executeSplit(native, contract, peerPoolMap); err != nil {
+				t.Fatalf("executeSplit failed: %s", err)
+			}
+			carried, err := getSplitFeeRemainder(native, contract)
+			if err != nil {
+				t.Fatalf("getSplitFeeRemainder failed: %s", err)
+			}
+			switch policy {
+			case SplitRemainderToTopPeer:
+				if paid != pool {
+					t.Errorf("round %d: paid %d of pool %d", round, paid, pool)
+				}
+			case SplitRemainderCarry:
+				if paid+carried != pool {
+					t.Errorf("round %d: paid %d + carried %d != pool %d", round, paid, carried, pool)
+				}
+				if carried != balance {
+					t.Errorf("round %d: carried %d, %d left in contract", round, carried, balance)
+				}
+			default:
+				if carried != 0 {
+					t.Errorf("round %d: remainder carried under keep policy", round)
+				}
+			}
+			if policy != SplitRemainderCarry {
+				balance = 1000003
+			} else {
+				balance += 1000003
+			}
+		}
+	}
+}
+
+func TestComputeSplitPlan(t *testing.T) {
+	defer func(policy RemainderPolicy) { SPLIT_REMAINDER_POLICY = policy }(SPLIT_REMAINDER_POLICY)
+	defer func(height uint32) { SPLIT_PAYOUT_HEIGHT = height }(SPLIT_PAYOUT_HEIGHT)
+	SPLIT_PAYOUT_HEIGHT = 0
+
+	const balance uint64 = 1000003
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"balanceOf": func(native *native.NativeService) ([]byte, error) {
+			return vmtypes.BigIntToBytes(new(big.Int).SetUint64(balance)), nil
+		},
+		"transfer": func(native *native.NativeService) ([]byte, error) {
+			t.Error("ComputeSplitPlan should not transfer")
+			return utils.BYTE_FALSE, nil
+		},
+	})
+	defer restore()
+
+	contract := utils.GovernanceContractAddress
+	peerPoolMap := testPeerPoolMap(1, 1000, 1100, 900, 1000, 1050, 950, 1000, 300, 200, 77)
+	for _, item := range peerPoolMap.PeerPoolMap {
+		item.Address = common.Address{byte(item.Index)}
+		if item.Index > 7 {
+			item.Status = CandidateStatus
+		}
+	}
+
+	for _, policy := range []RemainderPolicy{SplitRemainderKeep, SplitRemainderToTopPeer, SplitRemainderCarry} {
+		SPLIT_REMAINDER_POLICY = policy
+		native := newTestNative()
+		if err := putConfig(native, contract, testConfiguration()); err != nil {
+			t.Fatalf("putConfig failed: %s", err)
+		}
+		if err := putGlobalParam(native, contract, &GlobalParam{A: 60, B: 30, Yita: 5}); err != nil {
+			t.Fatalf("putGlobalParam failed: %s", err)
+		}
+		if err := putPeerPoolMap(native, contract, 1, peerPoolMap); err != nil {
+			t.Fatalf("putPeerPoolMap failed: %s", err)
+		}
+
+		plan, err := ComputeSplitPlan(native, contract, 1)
+		if err != nil {
+			t.Fatalf("ComputeSplitPlan failed: %s", err)
+		}
+		_, remainder, err := calcSplitPlan(native, contract, peerPoolMap)
+		if err != nil {
+			t.Fatalf("calcSplitPlan failed: %s", err)
+		}
+		pool := balance*60/100 + balance*30/100
+		if policy != SplitRemainderKeep {
+			pool = balance * 90 / 100
+		}
+		var total uint64
+		reasons := make(map[PayoutReason]int)
+		for _, payout := range plan {
+			total += payout.Amount
+			reasons[payout.Reason]++
+		}
+		if total != pool-remainder {
+			t.Errorf("policy %d: plan total %d, pool %d remainder %d", policy, total, pool, remainder)
+		}
+		if reasons[ConsensusFeePayout] != 7 || reasons[CandidateFeePayout] != 3 {
+			t.Errorf("policy %d: payout reasons %v", policy, reasons)
+		}
+	}
+
+	// before SPLIT_PAYOUT_HEIGHT every payout keeps the legacy formula and
+	// the remainder policy is ignored
+	SPLIT_PAYOUT_HEIGHT = math.MaxUint32
+	SPLIT_REMAINDER_POLICY = SplitRemainderCarry
+	native := newTestNative()
+	if err := putConfig(native, contract, testConfiguration()); err != nil {
+		t.Fatalf("putConfig failed: %s", err)
+	}
+	if err := putGlobalParam(native, contract, &GlobalParam{A: 60, B: 30, Yita: 5}); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	plan, remainder, err := calcSplitPlan(native, contract, peerPoolMap)
+	if err != nil {
+		t.Fatalf("calcSplitPlan failed: %s", err)
+	}
+	if remainder != 0 {
+		t.Errorf("legacy split has remainder %d", remainder)
+	}
+	var candidates []uint64
+	for _, payout := range plan {
+		if payout.Reason == CandidateFeePayout {
+			candidates = append(candidates, payout.Amount)
+		}
+	}
+	// the stakes include the TotalPos of 1 testPeerPoolMap sets
+	want := []uint64{balance * 30 / 100 * 301 / 580, balance * 30 / 100 * 201 / 580, balance * 30 / 100 * 78 / 580}
+	if !reflect.DeepEqual(candidates, want) {
+		t.Errorf("legacy candidate payouts %v, want %v", candidates, want)
+	}
+}
+
+// cancelAfterCtx reports context.Canceled once Err has been called n times
+type cancelAfterCtx struct {
+	context.Context
+	n int
+}
+
+func (this *cancelAfterCtx) Err() error {
+	if this.n <= 0 {
+		return context.Canceled
+	}
+	this.n--
+	return nil
+}
+
+func TestGetPeerPoolMapRangeCanceled(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	for view := uint32(1); view <= 3; view++ {
+		if err := putPeerPoolMap(native, contract, view, testPeerPoolMap(view, 100, 200)); err != nil {
+			t.Fatalf("putPeerPoolMap failed: %s", err)
+		}
+	}
+
+	ctx := &cancelAfterCtx{Context: context.Background(), n: 1}
+	if _, err := GetPeerPoolMapRange(ctx, native, contract, 1, 3); err != context.Canceled {
+		t.Errorf("expected context.Canceled after the first view, got %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GetPeerPoolMapRange(canceled, native, contract, 1, 3); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPeerPoolMapIndexOf(t *testing.T) {
+	_, pk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %s", err)
+	}
+	pubkey := hex.EncodeToString(keypair.SerializePublicKey(pk))
+	peerPoolMap := testPeerPoolMap(1, 100, 200)
+	peerPoolMap.PeerPoolMap[pubkey] = &PeerPoolItem{Index: 9, PeerPubkey: pubkey}
+
+	if index, ok := peerPoolMap.IndexOf(pubkey); !ok || index != 9 {
+		t.Errorf("IndexOf(%s) = %d, %v, want 9, true", pubkey, index, ok)
+	}
+	if index, ok := peerPoolMap.IndexOf(strings.ToUpper(pubkey)); !ok || index != 9 {
+		t.Errorf("IndexOf of upper case pubkey = %d, %v, want 9, true", index, ok)
+	}
+	if index, ok := peerPoolMap.IndexOf(testPubkey(1)); !ok || index != 1 {
+		t.Errorf("IndexOf of test peer 1 = %d, %v, want 1, true", index, ok)
+	}
+	if _, ok := peerPoolMap.IndexOf(testPubkey(99)); ok {
+		t.Error("IndexOf of absent pubkey should fail")
+	}
+}
+
+func TestCalDposTableMaxStakeRatio(t *testing.T) {
+	seed := common.Uint256{1, 2, 3}
+	config := testConfiguration()
+	peers := testPeers(9400, 100, 100, 100, 100, 100, 100)
+
+	slots := func(posTable []uint32) map[uint32]int {
+		count := make(map[uint32]int)
+		for _, index := range posTable {
+			count[index]++
+		}
+		return count
+	}
+
+	_, uncapped, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	// the whale has 94% of the stake: ceil(9400 * 15 * 7 / 10000) of 105 slots
+	if n := slots(uncapped)[1]; n != 99 {
+		t.Errorf("uncapped whale has %d slots, want 99", n)
+	}
+
+	// cap every peer at 25% of the top K stake sum, 2500 of 10000
+	config.MaxStakeRatio = 2500
+	_, capped, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	count := slots(capped)
+	// capped stakes are 2500 and 6 * 100, sum 3100
+	if count[1] != 85 {
+		t.Errorf("capped whale has %d slots, want 85", count[1])
+	}
+	for index := uint32(2); index <= 7; index++ {
+		if count[index] != 4 {
+			t.Errorf("peer %d has %d slots, want 4", index, count[index])
+		}
+	}
+
+	// a cap no peer reaches changes nothing
+	config.MaxStakeRatio = 10000
+	_, same, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(same, uncapped) {
+		t.Errorf("cap of 100%% changed the table")
+	}
+}
+
+func TestCalDposTableHashAlgo(t *testing.T) {
+	seed := common.Uint256{1, 2, 3}
+	config := testConfiguration()
+	config.L = 28
+	peers := testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000)
+
+	_, legacy, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	tables := make(map[HashAlgo][]uint32)
+	for _, algo := range []HashAlgo{HashAlgoFNV64a, HashAlgoSHA256_64, HashAlgoKeccak64} {
+		config.HashAlgo = algo
+		_, posTable, err := CalDposTableWithSeed(seed, 100, config, peers)
+		if err != nil {
+			t.Fatalf("CalDposTableWithSeed with hash algo %d failed: %s", algo, err)
+		}
+		_, again, err := CalDposTableWithSeed(seed, 100, config, peers)
+		if err != nil {
+			t.Fatalf("CalDposTableWithSeed with hash algo %d failed: %s", algo, err)
+		}
+		if !reflect.DeepEqual(posTable, again) {
+			t.Errorf("hash algo %d is not deterministic: %v != %v", algo, posTable, again)
+		}
+		for other, table := range tables {
+			if reflect.DeepEqual(posTable, table) {
+				t.Errorf("hash algos %d and %d produce the same table %v", algo, other, table)
+			}
+		}
+		tables[algo] = posTable
+	}
+	if !reflect.DeepEqual(tables[HashAlgoFNV64a], legacy) {
+		t.Errorf("default hash algo changed the table: %v != %v", tables[HashAlgoFNV64a], legacy)
+	}
+
+	// below SHA256_SHUFFLE_HEIGHT only HashAlgoSHA256_64 hashes with sha256
+	defer func(height uint32) { SHA256_SHUFFLE_HEIGHT = height }(SHA256_SHUFFLE_HEIGHT)
+	SHA256_SHUFFLE_HEIGHT = 100
+	config.HashAlgo = HashAlgoFNV64a
+	_, posTable, err := CalDposTableWithSeed(seed, 100, config, peers)
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if !reflect.DeepEqual(posTable, tables[HashAlgoSHA256_64]) {
+		t.Errorf("HashAlgoSHA256_64 differs from the sha256 fork: %v != %v", tables[HashAlgoSHA256_64], posTable)
+	}
+
+	config.HashAlgo = HashAlgoKeccak64 + 1
+	if _, _, err := CalDposTableWithSeed(seed, 100, config, peers); err == nil {
+		t.Errorf("unknown hash algo accepted")
+	}
+}
+
+func TestPeerPoolMapViewConsistency(t *testing.T) {
+	defer func(height uint32) { PEER_POOL_VIEW_HEIGHT = height }(PEER_POOL_VIEW_HEIGHT)
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	// legacy maps carry no view and are not checked
+	if err := putPeerPoolMap(native, contract, 1, testPeerPoolMap(1, 100, 200)); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	peerPoolMap, err := GetPeerPoolMap(native, contract, 1)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMap failed: %s", err)
+	}
+	if peerPoolMap.Version != 0 {
+		t.Errorf("expected a legacy map, got version %d", peerPoolMap.Version)
+	}
+
+	PEER_POOL_VIEW_HEIGHT = 0
+	if err := putPeerPoolMap(native, contract, 2, testPeerPoolMap(2, 100, 200)); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	peerPoolMap, err = GetPeerPoolMap(native, contract, 2)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMap failed: %s", err)
+	}
+	if peerPoolMap.Version != 1 || peerPoolMap.View != 2 || len(peerPoolMap.PeerPoolMap) != 2 {
+		t.Errorf("unexpected versioned map %+v", peerPoolMap)
+	}
+
+	// the map of view 2 stored under the key of view 3
+	bf := new(bytes.Buffer)
+	if err := peerPoolMap.Serialize(bf); err != nil {
+		t.Fatalf("serialize failed: %s", err)
+	}
+	viewBytes, _ := GetUint32Bytes(3)
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes),
+		&states.StorageItem{Value: bf.Bytes()})
+	if _, err := GetPeerPoolMap(native, contract, 3); err == nil {
+		t.Error("GetPeerPoolMap should fail on a map of another view")
+	}
+}
+
+func TestDposTableStats(t *testing.T) {
+	config := testConfiguration()
+	peers := testPeers(700, 650, 500, 400, 300, 200, 10, 5)
+	for _, ratio := range []uint32{0, 2000} {
+		config.MaxStakeRatio = ratio
+		stats, err := DposTableStats(config, peers, 10)
+		if err != nil {
+			t.Fatalf("DposTableStats failed: %s", err)
+		}
+		_, posTable, err := CalDposTableWithSeed(common.Uint256{4, 5, 6}, 10, config, peers)
+		if err != nil {
+			t.Fatalf("CalDposTableWithSeed failed: %s", err)
+		}
+		count := make(map[uint32]uint64)
+		for _, index := range posTable {
+			count[index]++
+		}
+		if !reflect.DeepEqual(stats, count) {
+			t.Errorf("ratio %d: stats %v, pos table counts %v", ratio, stats, count)
+		}
+		if _, ok := stats[8]; ok {
+			t.Errorf("ratio %d: peer outside the top K has stats", ratio)
+		}
+	}
+	if _, err := DposTableStats(config, testPeers(1, 2), 10); err == nil {
+		t.Error("DposTableStats should fail with fewer than K peers")
+	}
+}
+
+func TestEstimateTableSize(t *testing.T) {
+	config := testConfiguration()
+	for _, peers := range [][]*PeerStakeInfo{
+		testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000),
+		testPeers(700, 650, 500, 400, 300, 200, 10, 5),
+		testPeers(1000000, 1, 1, 1, 1, 1, 1),
+	} {
+		for _, ratio := range []uint32{0, 2000} {
+			config.MaxStakeRatio = ratio
+			size, err := EstimateTableSize(config, peers, 10)
+			if err != nil {
+				t.Fatalf("EstimateTableSize failed: %s", err)
+			}
+			_, posTable, err := CalDposTableWithSeed(common.Uint256{7, 8, 9}, 10, config, peers)
+			if err != nil {
+				t.Fatalf("CalDposTableWithSeed failed: %s", err)
+			}
+			if size != uint64(len(posTable)) {
+				t.Errorf("ratio %d: estimated %d slots, pos table has %d", ratio, size, len(posTable))
+			}
+		}
+	}
+	if _, err := EstimateTableSize(config, testPeers(1, 2), 10); err == nil {
+		t.Error("EstimateTableSize should fail with fewer than K peers")
+	}
+}
+
+func TestAppCallTransferOngResult(t *testing.T) {
+	var result []byte
+	var transferred []*ont.State
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"transfer": func(native *native.NativeService) ([]byte, error) {
+			transfers := new(ont.Transfers)
+			if err := transfers.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			transferred = transfers.States
+			return result, nil
+		},
+	})
+	defer restore()
+
+	from, to := common.Address{1}, common.Address{2}
+	result = utils.BYTE_TRUE
+	value, err := appCallTransferOngResult(newTestNative(), from, to, 100)
+	if err != nil {
+		t.Fatalf("appCallTransferOngResult failed: %s", err)
+	}
+	if !bytes.Equal(value, utils.BYTE_TRUE) {
+		t.Errorf("expected BYTE_TRUE, got %x", value)
+	}
+	want := []*ont.State{{From: from, To: to, Value: 100}}
+	if !reflect.DeepEqual(transferred, want) {
+		t.Errorf("transferred %v, want %v", transferred, want)
+	}
+
+	result = utils.BYTE_FALSE
+	value, err = appCallTransferOngResult(newTestNative(), from, to, 100)
+	if err != nil {
+		t.Fatalf("appCallTransferOngResult failed: %s", err)
+	}
+	if !bytes.Equal(value, utils.BYTE_FALSE) {
+		t.Errorf("expected BYTE_FALSE, got %x", value)
+	}
+	if err := appCallTransferOng(newTestNative(), from, to, 100); err != nil {
+		t.Errorf("appCallTransferOng should ignore the result: %s", err)
+	}
+}
+
+func TestGovernanceSnapshotRoundTrip(t *testing.T) {
+	contract := utils.GovernanceContractAddress
+	native := newTestNative()
+
+	config := testConfiguration()
+	config.MaxStakeRatio = 3000
+	globalParam := &GlobalParam{CandidateFee: 500, MinInitStake: 1, CandidateNum: 14, PosLimit: 20, A: 50, B: 50, Yita: 5, Penalty: 5}
+	governanceView := &GovernanceView{View: 4, Height: 777, TxHash: common.Uint256{9, 9}}
+	if err := putConfig(native, contract, config); err != nil {
+		t.Fatalf("putConfig failed: %s", err)
+	}
+	if err := putGlobalParam(native, contract, globalParam); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	if err := putGovernanceView(native, contract, governanceView); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	for view := uint32(2); view <= 4; view++ {
+		if err := putPeerPoolMap(native, contract, view, testPeerPoolMap(view, 100, 200, 300)); err != nil {
+			t.Fatalf("putPeerPoolMap failed: %s", err)
+		}
+	}
+
+	data, err := ExportGovernanceSnapshot(native, contract)
+	if err != nil {
+		t.Fatalf("ExportGovernanceSnapshot failed: %s", err)
+	}
+	if data[0] != GOVERNANCE_SNAPSHOT_VERSION {
+		t.Errorf("snapshot starts with version %d", data[0])
+	}
+
+	imported := newTestNative()
+	if err := ImportGovernanceSnapshot(imported, contract, data); err != nil {
+		t.Fatalf("ImportGovernanceSnapshot failed: %s", err)
+	}
+	gotConfig, err := GetConfiguration(imported, contract)
+	if err != nil || *gotConfig != *config {
+		t.Errorf("config: got %+v, %v, want %+v", gotConfig, err, config)
+	}
+	gotView, err := GetGovernanceView(imported, contract)
+	if err != nil || *gotView != *governanceView {
+		t.Errorf("governance view: got %+v, %v, want %+v", gotView, err, governanceView)
+	}
+	gotParam, err := getGlobalParam(imported, contract)
+	if err != nil || *gotParam != *globalParam {
+		t.Errorf("global param: got %+v, %v, want %+v", gotParam, err, globalParam)
+	}
+	for view := uint32(3); view <= 4; view++ {
+		peerPoolMap, err := GetPeerPoolMap(imported, contract, view)
+		if err != nil {
+			t.Fatalf("GetPeerPoolMap(%d) failed: %s", view, err)
+		}
+		if !reflect.DeepEqual(peerPoolMap, testPeerPoolMap(view, 100, 200, 300)) {
+			t.Errorf("view %d: unexpected peer pool map %v", view, peerPoolMap)
+		}
+	}
+	if _, err := GetPeerPoolMap(imported, contract, 2); err == nil {
+		t.Error("views before the prior view should not be exported")
+	}
+
+	bad := append([]byte{GOVERNANCE_SNAPSHOT_VERSION + 1}, data[1:]...)
+	if err := ImportGovernanceSnapshot(newTestNative(), contract, bad); err == nil {
+		t.Error("unknown snapshot version accepted")
+	}
+	if err := ImportGovernanceSnapshot(newTestNative(), contract, data[:len(data)-1]); err == nil {
+		t.Error("truncated snapshot accepted")
+	}
+}
+
+func TestAppCallIncreaseAllowanceOng(t *testing.T) {
+	from, to := common.Address{1}, common.Address{2}
+	allowances := map[[2]common.Address]uint64{{from, to}: 700}
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"allowance": func(native *native.NativeService) ([]byte, error) {
+			buf := bytes.NewBuffer(native.Input)
+			owner, err := utils.ReadAddress(buf)
+			if err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			spender, err := utils.ReadAddress(buf)
+			if err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			return vmtypes.BigIntToBytes(new(big.Int).SetUint64(allowances[[2]common.Address{owner, spender}])), nil
+		},
+		"approve": func(native *native.NativeService) ([]byte, error) {
+			state := new(ont.State)
+			if err := state.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			allowances[[2]common.Address{state.From, state.To}] = state.Value
+			return utils.BYTE_TRUE, nil
+		},
+	})
+	defer restore()
+
+	if err := appCallIncreaseAllowanceOng(newTestNative(), from, to, 300); err != nil {
+		t.Fatalf("appCallIncreaseAllowanceOng failed: %s", err)
+	}
+	if allowances[[2]common.Address{from, to}] != 1000 {
+		t.Errorf("allowance = %d, want 1000", allowances[[2]common.Address{from, to}])
+	}
+	// a new spender starts from 0
+	if err := appCallIncreaseAllowanceOng(newTestNative(), from, common.Address{3}, 5); err != nil {
+		t.Fatalf("appCallIncreaseAllowanceOng failed: %s", err)
+	}
+	if allowances[[2]common.Address{from, {3}}] != 5 {
+		t.Errorf("allowance = %d, want 5", allowances[[2]common.Address{from, {3}}])
+	}
+
+	allowances[[2]common.Address{from, to}] = math.MaxInt64
+	if err := appCallIncreaseAllowanceOng(newTestNative(), from, to, math.MaxUint64); err == nil {
+		t.Error("allowance overflow accepted")
+	}
+}
+
+func TestComputeViewTransition(t *testing.T) {
+	config := testConfiguration()
+	current := testPeerPoolMap(0, 100, 2000, 3000, 4000, 5000, 6000, 7000, 9000, 500, 600, 700, 800)
+	status := func(peerPoolMap *PeerPoolMap, index uint32) (Status, bool) {
+		for _, item := range peerPoolMap.PeerPoolMap {
+			if item.Index == index {
+				return item.Status, true
+			}
+		}
+		return 0, false
+	}
+	setStatus := func(index uint32, s Status) {
+		for _, item := range current.PeerPoolMap {
+			if item.Index == index {
+				item.Status = s
+			}
+		}
+	}
+	setStatus(8, CandidateStatus)
+	setStatus(9, QuitingStatus)
+	setStatus(10, BlackStatus)
+	setStatus(11, QuitConsensusStatus)
+	setStatus(12, RegisterCandidateStatus)
+
+	next, err := ComputeViewTransition(current, config, 0)
+	if err != nil {
+		t.Fatalf("ComputeViewTransition failed: %s", err)
+	}
+	expected := map[uint32]Status{
+		1:  CandidateStatus,
+		2:  ConsensusStatus,
+		3:  ConsensusStatus,
+		4:  ConsensusStatus,
+		5:  ConsensusStatus,
+		6:  ConsensusStatus,
+		7:  ConsensusStatus,
+		8:  ConsensusStatus,
+		11: QuitingStatus,
+		12: RegisterCandidateStatus,
+	}
+	if len(next.PeerPoolMap) != len(expected) {
+		t.Fatalf("next view has %d peers, want %d", len(next.PeerPoolMap), len(expected))
+	}
+	for index, want := range expected {
+		if s, ok := status(next, index); !ok || s != want {
+			t.Errorf("peer %d: status %d, want %d", index, s, want)
+		}
+	}
+
+	// current must be left untouched
+	if s, _ := status(current, 1); s != ConsensusStatus {
+		t.Errorf("current peer 1 changed to %d", s)
+	}
+	if s, _ := status(current, 8); s != CandidateStatus {
+		t.Errorf("current peer 8 changed to %d", s)
+	}
+	if _, ok := status(current, 9); !ok {
+		t.Error("current peer 9 was removed")
+	}
+
+	config.K = 9
+	if _, err := ComputeViewTransition(current, config, 0); err == nil {
+		t.Error("ComputeViewTransition should fail with fewer than K peers")
+	}
+
+	// an overflowing stake wraps before STAKE_OVERFLOW_HEIGHT
+	config.K = 7
+	for _, item := range current.PeerPoolMap {
+		if item.Index == 1 {
+			item.TotalPos = math.MaxUint64
+		}
+	}
+	if _, err := ComputeViewTransition(current, config, 0); err != nil {
+		t.Errorf("ComputeViewTransition of a wrapping stake failed: %s", err)
+	}
+	defer func(height uint32) { STAKE_OVERFLOW_HEIGHT = height }(STAKE_OVERFLOW_HEIGHT)
+	STAKE_OVERFLOW_HEIGHT = 0
+	if _, err := ComputeViewTransition(current, config, 0); err == nil {
+		t.Error("ComputeViewTransition accepted an overflowing stake")
+	}
+}
+
+func TestCheckPosTableLength(t *testing.T) {
+	config := testConfiguration()
+	vectors := []struct {
+		length uint64
+		ok     bool
+	}{
+		{0, false},
+		{6, false},
+		{7, true},
+		{112, true},
+		{224, true},
+		{225, false},
+		{math.MaxUint64, false},
+	}
+	for _, v := range vectors {
+		if err := checkPosTableLength(config, v.length); (err == nil) != v.ok {
+			t.Errorf("checkPosTableLength(%d) = %v, want ok %v", v.length, err, v.ok)
+		}
+	}
+
+	// a table built for a much larger L is rejected against the stored config
+	large := testConfiguration()
+	large.L = 7 * 1000
+	stats, err := DposTableStats(large, testPeers(1, 1, 1, 1, 1, 1, 1000000), 10)
+	if err != nil {
+		t.Fatalf("DposTableStats failed: %s", err)
+	}
+	var length uint64
+	for _, rank := range stats {
+		length += rank
+	}
+	if err := checkPosTableLength(config, length); err == nil {
+		t.Errorf("pos table of length %d should be rejected for L %d", length, config.L)
+	}
+
+	// sane configs always produce tables within bounds
+	for _, stakes := range [][]uint64{
+		{1, 1, 1, 1, 1, 1, 1},
+		{1, 2, 3, 4, 5, 6, 7},
+		{1, 1, 1, 1, 1, 1, math.MaxUint64 / 2},
+	} {
+		if _, _, err := CalDposTableWithSeed(common.Uint256{}, 0, config, testPeers(stakes...)); err != nil {
+			t.Errorf("CalDposTableWithSeed(%v) failed: %s", stakes, err)
+		}
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	mulVectors := []struct {
+		a, b, product uint64
+		overflow      bool
+	}{
+		{0, math.MaxUint64, 0, false},
+		{math.MaxUint64, 0, 0, false},
+		{1, math.MaxUint64, math.MaxUint64, false},
+		{1 << 32, 1<<32 - 1, 1<<64 - 1<<32, false},
+		{1 << 32, 1 << 32, 0, true},
+		{math.MaxUint64/3 + 1, 3, 0, true},
+		{math.MaxUint64 / 3, 3, math.MaxUint64, false},
+		{math.MaxUint64, 2, 0, true},
+	}
+	for _, v := range mulVectors {
+		product, err := mulChecked(v.a, v.b)
+		if v.overflow {
+			if err == nil {
+				t.Errorf("mulChecked(%d, %d) = %d, want overflow", v.a, v.b, product)
+			}
+			continue
+		}
+		if err != nil || product != v.product {
+			t.Errorf("mulChecked(%d, %d) = %d, %v, want %d", v.a, v.b, product, err, v.product)
+		}
+	}
+
+	addVectors := []struct {
+		a, b, sum uint64
+		overflow  bool
+	}{
+		{0, 0, 0, false},
+		{math.MaxUint64, 0, math.MaxUint64, false},
+		{math.MaxUint64 - 1, 1, math.MaxUint64, false},
+		{math.MaxUint64, 1, 0, true},
+		{1 << 63, 1 << 63, 0, true},
+	}
+	for _, v := range addVectors {
+		sum, err := addChecked(v.a, v.b)
+		if v.overflow {
+			if err == nil {
+				t.Errorf("addChecked(%d, %d) = %d, want overflow", v.a, v.b, sum)
+			}
+			continue
+		}
+		if err != nil || sum != v.sum {
+			t.Errorf("addChecked(%d, %d) = %d, %v, want %d", v.a, v.b, sum, err, v.sum)
+		}
+	}
+}
+
+func TestSplitPeerReward(t *testing.T) {
+	vectors := []struct {
+		total      uint64
+		commission BasisPoints
+		peer       uint64
+		delegator  uint64
+	}{
+		{1000, 0, 0, 1000},
+		{1000, 10000, 1000, 0},
+		{1000, 2500, 250, 750},
+		{999, 3333, 333, 666},
+		{1, 1, 1, 0},
+		{0, 5000, 0, 0},
+		{math.MaxUint64, 0, 0, math.MaxUint64},
+		{math.MaxUint64, 10000, math.MaxUint64, 0},
+		{math.MaxUint64, 5000, math.MaxUint64/2 + 1, math.MaxUint64 / 2},
+	}
+	for _, v := range vectors {
+		peer, delegator, err := SplitPeerReward(v.total, v.commission)
+		if err != nil {
+			t.Fatalf("SplitPeerReward(%d, %d) failed: %s", v.total, v.commission, err)
+		}
+		if peer != v.peer || delegator != v.delegator {
+			t.Errorf("SplitPeerReward(%d, %d) = %d, %d, want %d, %d", v.total, v.commission, peer, delegator, v.peer, v.delegator)
+		}
+	}
+	for commission := BasisPoints(0); commission <= MAX_BASIS_POINTS; commission += 7 {
+		peer, delegator, err := SplitPeerReward(123456789, commission)
+		if err != nil || peer+delegator != 123456789 {
+			t.Fatalf("SplitPeerReward(123456789, %d) = %d, %d, %v", commission, peer, delegator, err)
+		}
+	}
+	for _, commission := range []BasisPoints{10001, math.MaxUint32} {
+		if _, _, err := SplitPeerReward(1000, commission); err == nil {
+			t.Errorf("SplitPeerReward should reject commission %d", commission)
+		}
+	}
+}
+
+func TestBuildPeerConfigs(t *testing.T) {
+	peers := testPeers(100, 200, 300)
+	chainPeers, err := BuildPeerConfigs(peers)
+	if err != nil {
+		t.Fatalf("BuildPeerConfigs failed: %s", err)
+	}
+	if len(chainPeers) != len(peers) {
+		t.Fatalf("got %d peer configs, want %d", len(chainPeers), len(peers))
+	}
+	for _, peer := range peers {
+		peerConfig, ok := chainPeers[peer.Index]
+		if !ok || peerConfig.Index != peer.Index || peerConfig.ID != peer.PeerPubkey {
+			t.Errorf("peer %d: unexpected config %v", peer.Index, peerConfig)
+		}
+	}
+
+	peers[1].PeerPubkey = "020000000000000000000000000000000000000000000000000000000000000001"
+	if _, err := BuildPeerConfigs(peers); err == nil || !strings.Contains(err.Error(), "peer 2") {
+		t.Errorf("BuildPeerConfigs should name the invalid peer 2, got %v", err)
+	}
+}
+
+func TestGetGlobalParamAtHeight(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	// updates before the fork height are not recorded
+	native.Height = 10
+	if err := putGlobalParam(native, contract, &GlobalParam{CandidateFee: 10}); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	if _, err := GetGlobalParamAtHeight(native, contract, 10); err == nil {
+		t.Error("GetGlobalParamAtHeight should fail without history")
+	}
+
+	defer func(height uint32) { GLOBAL_PARAM_HISTORY_HEIGHT = height }(GLOBAL_PARAM_HISTORY_HEIGHT)
+	GLOBAL_PARAM_HISTORY_HEIGHT = 100
+	// the second update at 200 overwrites the first
+	for _, v := range []struct {
+		height       uint32
+		candidateFee uint64
+	}{{100, 100}, {200, 200}, {200, 201}, {350, 350}} {
+		native.Height = v.height
+		if err := putGlobalParam(native, contract, &GlobalParam{CandidateFee: v.candidateFee}); err != nil {
+			t.Fatalf("putGlobalParam at %d failed: %s", v.height, err)
+		}
+	}
+
+	vectors := []struct {
+		height       uint32
+		candidateFee uint64
+	}{
+		{100, 100},
+		{150, 100},
+		{199, 100},
+		{200, 201},
+		{349, 201},
+		{350, 350},
+		{math.MaxUint32, 350},
+	}
+	for _, v := range vectors {
+		globalParam, err := GetGlobalParamAtHeight(native, contract, v.height)
+		if err != nil {
+			t.Fatalf("GetGlobalParamAtHeight(%d) failed: %s", v.height, err)
+		}
+		if globalParam.CandidateFee != v.candidateFee {
+			t.Errorf("GetGlobalParamAtHeight(%d) = %d, want %d", v.height, globalParam.CandidateFee, v.candidateFee)
+		}
+	}
+	for _, height := range []uint32{0, 10, 99} {
+		if _, err := GetGlobalParamAtHeight(native, contract, height); err == nil {
+			t.Errorf("GetGlobalParamAtHeight(%d) should fail before the first record", height)
+		}
+	}
+	heights, err := getGlobalParamHistoryHeights(native, contract)
+	if err != nil || !reflect.DeepEqual(heights, []uint32{100, 200, 350}) {
+		t.Errorf("history heights = %v, %v", heights, err)
+	}
+
+	native.Height = 300
+	if err := putGlobalParam(native, contract, &GlobalParam{CandidateFee: 300}); err == nil {
+		t.Error("putGlobalParam below the last record should fail")
+	}
+}
+
+func TestGetPeerPoolMapWithSize(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	peerPoolMap := testPeerPoolMap(1, 100, 200, 300)
+	if err := putPeerPoolMap(native, contract, 1, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	viewBytes, err := GetUint32Bytes(1)
+	if err != nil {
+		t.Fatalf("GetUint32Bytes failed: %s", err)
+	}
+	item, err := native.CloneCache.Get(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL), viewBytes))
+	if err != nil || item == nil {
+		t.Fatalf("stored peerPoolMap not found: %v", err)
+	}
+	blobLen := len(item.(*states.StorageItem).Value)
+
+	got, size, err := GetPeerPoolMapWithSize(native, contract, 1)
+	if err != nil {
+		t.Fatalf("GetPeerPoolMapWithSize failed: %s", err)
+	}
+	if size != blobLen {
+		t.Errorf("size = %d, want stored blob length %d", size, blobLen)
+	}
+	if !reflect.DeepEqual(got, peerPoolMap) {
+		t.Errorf("unexpected peer pool map")
+	}
+
+	if _, err := MigratePeerPoolToItems(native, contract, 1); err != nil {
+		t.Fatalf("MigratePeerPoolToItems failed: %s", err)
+	}
+	itemsLen := 0
+	for _, peerPoolItem := range peerPoolMap.PeerPoolMap {
+		key, err := peerPoolItemKey(contract, 1, peerPoolItem.Index)
+		if err != nil {
+			t.Fatalf("peerPoolItemKey failed: %s", err)
+		}
+		item, err := native.CloneCache.Get(scommon.ST_STORAGE, key)
+		if err != nil || item == nil {
+			t.Fatalf("stored peerPoolItem %d not found: %v", peerPoolItem.Index, err)
+		}
+		itemsLen += len(item.(*states.StorageItem).Value)
+	}
+	if _, size, err = GetPeerPoolMapWithSize(native, contract, 1); err != nil || size != itemsLen {
+		t.Errorf("size of migrated view = %d, %v, want %d", size, err, itemsLen)
+	}
+
+	if _, _, err := GetPeerPoolMapWithSize(native, contract, 2); err == nil {
+		t.Error("GetPeerPoolMapWithSize should fail for a view that is not stored")
+	}
+}
+
+func TestListStoredViews(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+
+	views, err := ListStoredViews(native, contract)
+	if err != nil || len(views) != 0 {
+		t.Fatalf("ListStoredViews on empty storage = %v, %v", views, err)
+	}
+
+	for _, view := range []uint32{9, 2, 300, 5} {
+		if err := putPeerPoolMap(native, contract, view, testPeerPoolMap(view, 100, 200)); err != nil {
+			t.Fatalf("putPeerPoolMap failed: %s", err)
+		}
+	}
+	// view 7 is stored per item and also has an index list under the prefix
+	if err := putPeerPoolMap(native, contract, 7, testPeerPoolMap(7, 100, 200)); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	if _, err := MigratePeerPoolToItems(native, contract, 7); err != nil {
+		t.Fatalf("MigratePeerPoolToItems failed: %s", err)
+	}
+	// a key under the prefix which is not a view
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(contract, []byte(PEER_POOL), []byte{1, 2}), &states.StorageItem{Value: []byte{1}})
+	native.CloneCache.Commit()
+
+	views, err = ListStoredViews(native, contract)
+	if err != nil {
+		t.Fatalf("ListStoredViews failed: %s", err)
+	}
+	if !reflect.DeepEqual(views, []uint32{2, 5, 7, 9, 300}) {
+		t.Errorf("ListStoredViews = %v, want [2 5 7 9 300]", views)
+	}
+
+	// views written and deleted in the same transaction, not yet committed
+	if err := putPeerPoolMap(native, contract, 11, testPeerPoolMap(11, 100)); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	for _, view := range []uint32{7, 9} {
+		if err := deletePeerPoolMap(native, contract, view); err != nil {
+			t.Fatalf("deletePeerPoolMap failed: %s", err)
+		}
+	}
+	views, err = ListStoredViews(native, contract)
+	if err != nil {
+		t.Fatalf("ListStoredViews failed: %s", err)
+	}
+	if !reflect.DeepEqual(views, []uint32{2, 5, 11, 300}) {
+		t.Errorf("ListStoredViews = %v, want [2 5 11 300]", views)
+	}
+}
+
+func TestIteratePrefix(t *testing.T) {
+	native := newTestNative()
+	prefix := utils.ConcatKey(utils.GovernanceContractAddress, []byte("scan"))
+	key := func(suffix ...byte) []byte { return append(append([]byte(nil), prefix...), suffix...) }
+
+	native.CloneCache.Add(scommon.ST_STORAGE, key(3), &states.StorageItem{Value: []byte{30}})
+	native.CloneCache.Add(scommon.ST_STORAGE, key(1), &states.StorageItem{Value: []byte{10}})
+	native.CloneCache.Add(scommon.ST_STORAGE, key(2), &states.StorageItem{Value: []byte{20}})
+	native.CloneCache.Add(scommon.ST_STORAGE, utils.ConcatKey(utils.GovernanceContractAddress, []byte("scam")),
+		&states.StorageItem{Value: []byte{99}})
+	native.CloneCache.Commit()
+	native.CloneCache = storage.NewCloneCache(native.CloneCache.Store)
+	// pending writes shadow the store
+	native.CloneCache.Add(scommon.ST_STORAGE, key(2), &states.StorageItem{Value: []byte{21}})
+	native.CloneCache.Add(scommon.ST_STORAGE, key(4), &states.StorageItem{Value: []byte{40}})
+	native.CloneCache.Delete(scommon.ST_STORAGE, key(3))
+
+	var keys, values [][]byte
+	err := iteratePrefix(native, prefix, func(k, v []byte) error {
+		keys = append(keys, k)
+		values = append(values, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iteratePrefix failed: %s", err)
+	}
+	if !reflect.DeepEqual(keys, [][]byte{key(1), key(2), key(4)}) {
+		t.Errorf("keys = %x", keys)
+	}
+	if !reflect.DeepEqual(values, [][]byte{{10}, {21}, {40}}) {
+		t.Errorf("values = %v", values)
+	}
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = iteratePrefix(native, prefix, func(k, v []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("iteratePrefix returned %v after %d calls, want stop after 1", err, calls)
+	}
+}
+
+func TestTypedAmountSerialization(t *testing.T) {
+	inputs := make(map[string][]byte)
+	capture := func(name string) native.Handler {
+		return func(native *native.NativeService) ([]byte, error) {
+			inputs[name] = native.Input
+			return utils.BYTE_TRUE, nil
+		}
+	}
+	defer registerTestContract(utils.OntContractAddress, map[string]native.Handler{
+		"transfer":     capture("ont.transfer"),
+		"transferFrom": capture("ont.transferFrom"),
+	})()
+	defer registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"transfer":     capture("ong.transfer"),
+		"transferFrom": capture("ong.transferFrom"),
+	})()
+
+	sender, from, to := common.Address{9}, common.Address{1}, common.Address{2}
+	for _, value := range []uint64{0, 1, 0xfc, 0xfd, 0xffff, 1 << 32, math.MaxUint64} {
+		bf := new(bytes.Buffer)
+		transfers := &ont.Transfers{States: []*ont.State{{From: from, To: to, Value: value}}}
+		if err := transfers.Serialize(bf); err != nil {
+			t.Fatalf("transfers.Serialize failed: %s", err)
+		}
+		transferBytes := bf.Bytes()
+		bf = new(bytes.Buffer)
+		transferFrom := &ont.TransferFrom{Sender: sender, From: from, To: to, Value: value}
+		if err := transferFrom.Serialize(bf); err != nil {
+			t.Fatalf("transferFrom.Serialize failed: %s", err)
+		}
+		transferFromBytes := bf.Bytes()
+
+		if err := appCallTransferOnt(newTestNative(), from, to, OntAmount(value)); err != nil {
+			t.Fatalf("appCallTransferOnt failed: %s", err)
+		}
+		if err := appCallTransferOng(newTestNative(), from, to, OngAmount(value)); err != nil {
+			t.Fatalf("appCallTransferOng failed: %s", err)
+		}
+		if err := appCallTransferFromOnt(newTestNative(), sender, from, to, OntAmount(value)); err != nil {
+			t.Fatalf("appCallTransferFromOnt failed: %s", err)
+		}
+		if err := appCallTransferFromOng(newTestNative(), sender, from, to, OngAmount(value)); err != nil {
+			t.Fatalf("appCallTransferFromOng failed: %s", err)
+		}
+		for name, want := range map[string][]byte{
+			"ont.transfer":     transferBytes,
+			"ong.transfer":     transferBytes,
+			"ont.transferFrom": transferFromBytes,
+			"ong.transferFrom": transferFromBytes,
+		} {
+			if !bytes.Equal(inputs[name], want) {
+				t.Errorf("%s of %d: input %x, want %x", name, value, inputs[name], want)
+			}
+		}
+		if OntAmount(value).Uint64() != value || OngAmount(value).Uint64() != value {
+			t.Errorf("conversion of %d is not lossless", value)
+		}
+	}
+}
+
+func TestCheckTableStarvation(t *testing.T) {
+	config := testConfiguration()
+	chainPeers, posTable, err := CalDposTableWithSeed(common.Uint256{1}, 100, config, testPeers(1, 1, 1, 1, 1, 1, 1000000))
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if starved := CheckTableStarvation(posTable, chainPeers); len(starved) != 0 {
+		t.Errorf("fresh pos table starves peers %v", starved)
+	}
+
+	// drop every slot of peer 3
+	var table []uint32
+	for _, index := range posTable {
+		if index != 3 {
+			table = append(table, index)
+		}
+	}
+	if starved := CheckTableStarvation(table, chainPeers); !reflect.DeepEqual(starved, []uint32{3}) {
+		t.Errorf("CheckTableStarvation = %v, want [3]", starved)
+	}
+	if starved := CheckTableStarvation(nil, chainPeers); !reflect.DeepEqual(starved, []uint32{1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("CheckTableStarvation of an empty table = %v", starved)
+	}
+	// slots of peers outside chainPeers do not count
+	if starved := CheckTableStarvation([]uint32{8, 9}, map[uint32]*vbftconfig.PeerConfig{8: {Index: 8}, 10: {Index: 10}}); !reflect.DeepEqual(starved, []uint32{10}) {
+		t.Errorf("CheckTableStarvation = %v, want [10]", starved)
+	}
+}
+
+func TestMinConsensusStake(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	if err := putConfig(native, contract, testConfiguration()); err != nil {
+		t.Fatalf("putConfig failed: %s", err)
+	}
+
+	// six peers, one short of K
+	if err := putPeerPoolMap(native, contract, 1, testPeerPoolMap(0, 600, 500, 400, 300, 200, 100)); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	if stake, err := MinConsensusStake(native, contract, 1); err != nil || stake != 0 {
+		t.Errorf("fewer than K peers: got %d, %v, want 0, nil", stake, err)
+	}
+
+	peerPoolMap := testPeerPoolMap(0, 900, 800, 700, 600, 500, 400, 300, 200, 100, 1000)
+	for _, item := range peerPoolMap.PeerPoolMap {
+		switch item.Index {
+		case 1:
+			item.Status = CandidateStatus
+		case 2:
+			item.Status = QuitingStatus
+		case 10:
+			item.Status = BlackStatus
+		}
+	}
+	if err := putPeerPoolMap(native, contract, 2, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+	// the eligible stakes are 900, 700, ..., 100, the 7th largest is 200
+	if stake, err := MinConsensusStake(native, contract, 2); err != nil || stake != 200 {
+		t.Errorf("more than K peers: got %d, %v, want 200, nil", stake, err)
+	}
+}
+
+func TestPeerRank(t *testing.T) {
+	native := newTestNative()
+	contract := utils.GovernanceContractAddress
+	peerPoolMap := testPeerPoolMap(1, 300, 500, 500, 100, 900, 700)
+	peerPoolMap.PeerPoolMap[testPubkey(4)].Status = CandidateStatus
+	peerPoolMap.PeerPoolMap[testPubkey(5)].Status = QuitingStatus
+	if err := putPeerPoolMap(native, contract, 1, peerPoolMap); err != nil {
+		t.Fatalf("putPeerPoolMap failed: %s", err)
+	}
+
+	// ranked: 6 (700), 2 and 3 (500, tie broken by Index), 1 (300), 4 (100)
+	defer func(height uint32) { INDEX_TIE_BREAK_HEIGHT = height }(INDEX_TIE_BREAK_HEIGHT)
+	INDEX_TIE_BREAK_HEIGHT = 0
+	for i, want := range []int{4, 2, 3, 5, 0, 1} {
+		rank, total, err := PeerRank(native, contract, 1, testPubkey(i+1))
+		if err != nil {
+			t.Fatalf("PeerRank failed: %s", err)
+		}
+		if rank != want || total != 5 {
+			t.Errorf("peer %d: got rank %d of %d, want %d of 5", i+1, rank, total, want)
+		}
+	}
+	if rank, total, err := PeerRank(native, contract, 1, testPubkey(9)); err != nil || rank != 0 || total != 5 {
+		t.Errorf("absent peer: got %d of %d, %v, want 0 of 5", rank, total, err)
+	}
+	if _, _, err := PeerRank(native, contract, 2, testPubkey(1)); err == nil {
+		t.Error("PeerRank should fail for a view without a peer pool")
+	}
+}
+
+func TestTopKTieBreaking(t *testing.T) {
+	config := testConfiguration()
+	// peers 7 and 8 tie for the last consensus seat
+	stakes := []uint64{800, 700, 600, 500, 400, 300, 100, 100}
+	consensus := func(peerPoolMap *PeerPoolMap) map[uint32]bool {
+		selected := make(map[uint32]bool)
+		for _, item := range peerPoolMap.PeerPoolMap {
+			if item.Status == ConsensusStatus {
+				selected[item.Index] = true
+			}
+		}
+		return selected
+	}
+
+	defer func(height uint32) { INDEX_TIE_BREAK_HEIGHT = height }(INDEX_TIE_BREAK_HEIGHT)
+	INDEX_TIE_BREAK_HEIGHT = 100
+	for i := 0; i < 20; i++ {
+		next, err := ComputeViewTransition(testPeerPoolMap(0, stakes...), config, 100)
+		if err != nil {
+			t.Fatalf("ComputeViewTransition failed: %s", err)
+		}
+		selected := consensus(next)
+		if !selected[7] || selected[8] {
+			t.Fatalf("tie broken by %v, want peer 7 in and peer 8 out", selected)
+		}
+
+		// feed the peers in every rotation of their order
+		all := testPeers(stakes...)
+		peers := append(all[i%len(all):], all[:i%len(all)]...)
+		chainPeers, _, err := CalDposTableWithSeed(common.Uint256{}, 100, config, peers)
+		if err != nil {
+			t.Fatalf("CalDposTableWithSeed failed: %s", err)
+		}
+		if _, ok := chainPeers[7]; !ok {
+			t.Fatalf("peer 7 missing from the dpos table of %v", peers)
+		}
+		if _, ok := chainPeers[8]; ok {
+			t.Fatalf("peer 8 in the dpos table of %v", peers)
+		}
+	}
+
+	// before the fork the tie goes to the larger pubkey
+	winner := uint32(7)
+	if testPubkey(8) > testPubkey(7) {
+		winner = 8
+	}
+	next, err := ComputeViewTransition(testPeerPoolMap(0, stakes...), config, 99)
+	if err != nil {
+		t.Fatalf("ComputeViewTransition failed: %s", err)
+	}
+	if selected := consensus(next); !selected[winner] || selected[15-winner] {
+		t.Errorf("legacy tie broken by %v, want peer %d in", selected, winner)
+	}
+}
+
+func TestRewardPerSlot(t *testing.T) {
+	config := testConfiguration()
+	_, posTable, err := CalDposTableWithSeed(common.Uint256{1}, 10, config,
+		testPeers(70000, 60000, 50000, 40000, 30000, 20000, 10000))
+	if err != nil {
+		t.Fatalf("CalDposTableWithSeed failed: %s", err)
+	}
+	if len(posTable) != 108 {
+		t.Fatalf("expected a 108 slot table, got %d", len(posTable))
+	}
+	vectors := []struct {
+		splitFee uint64
+		reward   uint64
+	}{
+		{1080000, 10000},
+		{1000000, 9259},
+		{107, 0},
+		{0, 0},
+	}
+	for _, v := range vectors {
+		if reward, err := RewardPerSlot(v.splitFee, posTable); err != nil || reward != v.reward {
+			t.Errorf("RewardPerSlot(%d) = %d, %v, want %d", v.splitFee, reward, err, v.reward)
+		}
+	}
+	if _, err := RewardPerSlot(1000, nil); err == nil {
+		t.Error("RewardPerSlot should fail on an empty table")
+	}
+}
+
+func TestExpectedBlocks(t *testing.T) {
+	// peer 1 holds 6 of 10 slots, peer 2 three and peer 3 one
+	posTable := []uint32{1, 2, 1, 1, 3, 1, 2, 1, 2, 1}
+	vectors := []struct {
+		index  uint32
+		epoch  uint32
+		blocks uint32
+	}{
+		{1, 1000, 600},
+		{2, 1000, 300},
+		{3, 1000, 100},
+		{4, 1000, 0},
+		{1, 7, 4},
+		{3, 9, 0},
+		{2, math.MaxUint32, 1288490188},
+		{1, 0, 0},
+	}
+	for _, v := range vectors {
+		if blocks := ExpectedBlocks(posTable, v.index, v.epoch); blocks != v.blocks {
+			t.Errorf("ExpectedBlocks(%d, %d) = %d, want %d", v.index, v.epoch, blocks, v.blocks)
+		}
+	}
+	if blocks := ExpectedBlocks(nil, 1, 1000); blocks != 0 {
+		t.Errorf("empty table: got %d, want 0", blocks)
+	}
+}
+
+func TestPosTableGiniCoefficient(t *testing.T) {
+	even := []uint32{1, 2, 3, 4, 4, 3, 2, 1, 2, 4, 1, 3}
+	if g := PosTableGiniCoefficient(even); math.Abs(g) > 1e-9 {
+		t.Errorf("even table: Gini = %f, want 0", g)
+	}
+	if g := PosTableGiniCoefficient(nil); g != 0 {
+		t.Errorf("empty table: Gini = %f, want 0", g)
+	}
+
+	// 97 slots for peer 1, one each for peers 2, 3 and 4: counts 1, 1, 1, 97,
+	// 2 * (1 + 2 + 3 + 4 * 97) / (4 * 100) - 5 / 4 = 0.72 of a maximum 0.75
+	dominant := []uint32{2, 3, 4}
+	for i := 0; i < 97; i++ {
+		dominant = append(dominant, 1)
+	}
+	if g := PosTableGiniCoefficient(dominant); math.Abs(g-0.72) > 1e-9 {
+		t.Errorf("dominant table: Gini = %f, want 0.72", g)
+	}
+}
+
+func TestApplyKChange(t *testing.T) {
+	consensus := func(peerPoolMap *PeerPoolMap) []uint32 {
+		var indexes []uint32
+		for _, item := range peerPoolMap.PeersByStatus(ConsensusStatus) {
+			indexes = append(indexes, item.Index)
+		}
+		return indexes
+	}
+	// peers 1 to 7 are the consensus set, 8 to 11 candidates
+	current := testPeerPoolMap(3, 1000, 900, 800, 700, 600, 500, 400, 350, 300, 250, 200)
+	for _, item := range current.PeerPoolMap {
+		if item.Index > 7 {
+			item.Status = CandidateStatus
+		}
+	}
+	current.PeerPoolMap[testPubkey(11)].Status = QuitingStatus
+
+	// grow K from 7 to 9: the two largest candidates join
+	config := testConfiguration()
+	config.N, config.L = 10, 9*16
+	next, err := ApplyKChange(current, 7, 9, config)
+	if err != nil {
+		t.Fatalf("ApplyKChange to a larger K failed: %s", err)
+	}
+	if got := consensus(next); !reflect.DeepEqual(got, []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("consensus set after growing K: %v", got)
+	}
+	if next.PeerPoolMap[testPubkey(10)].Status != CandidateStatus || next.PeerPoolMap[testPubkey(11)].Status != QuitingStatus {
+		t.Errorf("peers outside the new set changed status")
+	}
+	if len(consensus(current)) != 7 {
+		t.Errorf("ApplyKChange modified current")
+	}
+
+	// shrink K from 7 to 4, below the current consensus count
+	config = testConfiguration()
+	config.C = 1
+	next, err = ApplyKChange(current, 7, 4, config)
+	if err != nil {
+		t.Fatalf("ApplyKChange to a smaller K failed: %s", err)
+	}
+	if got := consensus(next); !reflect.DeepEqual(got, []uint32{1, 2, 3, 4}) {
+		t.Errorf("consensus set after shrinking K: %v", got)
+	}
+	for index := 5; index <= 7; index++ {
+		if status := next.PeerPoolMap[testPubkey(index)].Status; status != CandidateStatus {
+			t.Errorf("demoted peer %d has status %s", index, status)
+		}
+	}
+
+	// more peers than there are, an invalid config and a stale oldK are rejected
+	config = testConfiguration()
+	config.N, config.L = 11, 11*16
+	if _, err := ApplyKChange(current, 7, 11, config); err == nil {
+		t.Errorf("K larger than the candidate count accepted")
+	}
+	if _, err := ApplyKChange(current, 7, 8, testConfiguration()); err == nil {
+		t.Errorf("K larger than N accepted")
+	}
+	if _, err := ApplyKChange(current, 5, 7, testConfiguration()); err == nil {
+		t.Errorf("oldK below the consensus count accepted")
+	}
+}
+
+func TestGlobalParamExecutionCache(t *testing.T) {
+	service := newTestNative()
+	contract := utils.GovernanceContractAddress
+	globalParam := &GlobalParam{
+		CandidateFee: 500000000000,
+		MinInitStake: 10000,
+		CandidateNum: 7 * 7,
+		PosLimit:     20,
+		A:            50,
+		B:            50,
+		Yita:         5,
+		Penalty:      5,
+	}
+	if err := putGlobalParam(service, contract, globalParam); err != nil {
+		t.Fatalf("putGlobalParam failed: %s", err)
+	}
+	updated := *globalParam
+	updated.Yita = 10
+	handler := withExecutionCache(func(native *native.NativeService) ([]byte, error) {
+		for i := 0; i < 2; i++ {
+			param, err := getGlobalParam(native, contract)
+			if err != nil {
+				t.Fatalf("getGlobalParam failed: %s", err)
+			}
+			if *param != *globalParam {
+				t.Fatalf("expected %v, got %v", globalParam, param)
+			}
+			// callers may modify the returned param, the cache must not see it
+			param.Yita = 100
+		}
+		if getExecutionCache(native) == nil {
+			t.Fatalf("no execution cache inside the handler")
+		}
+
+		// update in the middle of the execution
+		if err := putGlobalParam(native, contract, &updated); err != nil {
+			t.Fatalf("putGlobalParam failed: %s", err)
+		}
+		param, err := getGlobalParam(native, contract)
+		if err != nil {
+			t.Fatalf("getGlobalParam failed: %s", err)
+		}
+		if *param != updated {
+			t.Errorf("stale global param after update: %v", param)
+		}
+		return utils.BYTE_TRUE, nil
+	})
+	if _, err := handler(service); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+	if getExecutionCache(service) != nil {
+		t.Errorf("execution cache outlived the handler")
+	}
+	param, err := getGlobalParam(service, contract)
+	if err != nil {
+		t.Fatalf("getGlobalParam failed: %s", err)
+	}
+	if *param != updated {
+		t.Errorf("expected %v, got %v", updated, param)
+	}
+}
+
+func TestGovernanceViewExecutionCache(t *testing.T) {
+	service := newTestNative()
+	contract := utils.GovernanceContractAddress
+	if err := putGovernanceView(service, contract, &GovernanceView{View: 1, Height: 10}); err != nil {
+		t.Fatalf("putGovernanceView failed: %s", err)
+	}
+	handler := withExecutionCache(func(native *native.NativeService) ([]byte, error) {
+		governanceView, err := GetGovernanceView(native, contract)
+		if err != nil {
+			t.Fatalf("GetGovernanceView failed: %s", err)
+		}
+		if governanceView.View != 1 || governanceView.Height != 10 {
+			t.Fatalf("unexpected governance view %v", governanceView)
+		}
+		// callers may modify the returned view, the cache must not see it
+		governanceView.View = 100
+
+		view, err := IncrementGovernanceView(native, contract, common.Uint256{1}, 20)
+		if err != nil {
+			t.Fatalf("IncrementGovernanceView failed: %s", err)
+		}
+		if view != 2 {
+			t.Fatalf("expected view 2, got %d", view)
+		}
+		governanceView, err = GetGovernanceView(native, contract)
+		if err != nil {
+			t.Fatalf("GetGovernanceView failed: %s", err)
+		}
+		expected := GovernanceView{View: 2, Height: 20, TxHash: common.Uint256{1}}
+		if *governanceView != expected {
+			t.Errorf("expected %v after the write, got %v", expected, governanceView)
+		}
+		if err := putGovernanceView(native, contract, &GovernanceView{View: 2}); err == nil {
+			t.Errorf("putGovernanceView accepted a view that is not greater than the written one")
+		}
+		return utils.BYTE_TRUE, nil
+	})
+	if _, err := handler(service); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+	view, err := GetView(service, contract)
+	if err != nil {
+		t.Fatalf("GetView failed: %s", err)
+	}
+	if view != 2 {
+		t.Errorf("expected stored view 2, got %d", view)
+	}
+}
+
+func TestOngBalanceExecutionCache(t *testing.T) {
+	balances := map[common.Address]uint64{{1}: 1000, {2}: 0}
+	queries := 0
+	restore := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"balanceOf": func(native *native.NativeService) ([]byte, error) {
+			queries++
+			address, err := utils.ReadAddress(bytes.NewBuffer(native.Input))
+			if err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			return vmtypes.BigIntToBytes(new(big.Int).SetUint64(balances[address])), nil
+		},
+		"transfer": func(native *native.NativeService) ([]byte, error) {
+			transfers := new(ont.Transfers)
+			if err := transfers.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			for _, state := range transfers.States {
+				balances[state.From] -= state.Value
+				balances[state.To] += state.Value
+			}
+			return utils.BYTE_TRUE, nil
+		},
+		"transferFrom": func(native *native.NativeService) ([]byte, error) {
+			state := new(ont.TransferFrom)
+			if err := state.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+				return utils.BYTE_FALSE, err
+			}
+			balances[state.From] -= state.Value
+			balances[state.To] += state.Value
+			return utils.BYTE_TRUE, nil
+		},
+	})
+	defer restore()
+
+	service := newTestNative()
+	handler := withExecutionCache(func(native *native.NativeService) ([]byte, error) {
+		balance := func(address common.Address) OngAmount {
+			balance, err := getOngBalance(native, address)
+			if err != nil {
+				t.Fatalf("getOngBalance failed: %s", err)
+			}
+			return balance
+		}
+		for i := 0; i < 3; i++ {
+			if b := balance(common.Address{1}); b != 1000 {
+				t.Errorf("balance = %d, want 1000", b)
+			}
+		}
+		if queries != 1 {
+			t.Errorf("%d balanceOf calls for one address, want 1", queries)
+		}
+
+		transfers := []struct {
+			name     string
+			transfer func() error
+			from, to OngAmount
+		}{
+			{"appCallTransferOng", func() error {
+				return appCallTransferOng(native, common.Address{1}, common.Address{2}, 300)
+			}, 700, 300},
+			{"appCallTransferOngMulti", func() error {
+				return appCallTransferOngMulti(native, []*ont.State{{From: common.Address{1}, To: common.Address{2}, Value: 200}})
+			}, 500, 500},
+			{"appCallTransferFromOng", func() error {
+				return appCallTransferFromOng(native, common.Address{2}, common.Address{1}, common.Address{2}, 100)
+			}, 400, 600},
+		}
+		for _, test := range transfers {
+			balance(common.Address{1})
+			balance(common.Address{2})
+			if err := test.transfer(); err != nil {
+				t.Fatalf("%s failed: %s", test.name, err)
+			}
+			if b := balance(common.Address{1}); b != test.from {
+				t.Errorf("%s: balance after transfer = %d, want %d", test.name, b, test.from)
+			}
+			if b := balance(common.Address{2}); b != test.to {
+				t.Errorf("%s: balance of receiver after transfer = %d, want %d", test.name, b, test.to)
+			}
+		}
+		return utils.BYTE_TRUE, nil
+	})
+	if _, err := handler(service); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+
+	// outside of an execution every lookup is a call
+	queries = 0
+	balances[common.Address{1}] = 5
+	for i := 0; i < 2; i++ {
+		balance, err := getOngBalance(service, common.Address{1})
+		if err != nil {
+			t.Fatalf("getOngBalance failed: %s", err)
+		}
+		if balance != 5 {
+			t.Errorf("balance = %d, want 5", balance)
+		}
+	}
+	if queries != 2 {
+		t.Errorf("%d balanceOf calls, want 2", queries)
+	}
+}
+
+func TestRegisterCandidateSplitFee(t *testing.T) {
+	restoreAuth := registerTestContract(utils.AuthContractAddress, map[string]native.Handler{
+		"verifyToken": func(native *native.NativeService) ([]byte, error) {
+			return utils.BYTE_TRUE, nil
+		},
+	})
+	defer restoreAuth()
+	transfer := func(native *native.NativeService) ([]byte, error) {
+		return utils.BYTE_TRUE, nil
+	}
+	restoreOnt := registerTestContract(utils.OntContractAddress, map[string]native.Handler{"transfer": transfer})
+	defer restoreOnt()
+	restoreOng := registerTestContract(utils.OngContractAddress, map[string]native.Handler{
+		"transfer":     transfer,
+		"transferFrom": transfer,
+	})
+	defer restoreOng()
+
+	contract := utils.GovernanceContractAddress
+	register := func(native *native.NativeService) {
+		_, pk, err := keypair.GenerateKeyPair(keypair.PK_ECDSA, keypair.P256)
+		if err != nil {
+			t.Fatalf("GenerateKeyPair failed: %s", err)
+		}
+		params := &RegisterCandidateParam{
+			PeerPubkey: hex.EncodeToString(keypair.SerializePublicKey(pk)),
+			Address:    common.Address{1},
+			InitPos:    10000,
+			Caller:     []byte("did:ont:test"),
+			KeyNo:      1,
+		}
+		bf := new(bytes.Buffer)
+		if err := params.Serialize(bf); err != nil {
+			t.Fatalf("serialize params failed: %s", err)
+		}
+		native.Input = bf.Bytes()
+		if err := registerCandidate(native, "transfer"); err != nil {
+			t.Fatalf("registerCandidate failed: %s", err)
+		}
+	}
+	newNative := func() *native.NativeService {
+		native := newTestNative()
+		if err := putGovernanceView(native, contract, &GovernanceView{View: 1}); err != nil {
+			t.Fatalf("putGovernanceView failed: %s", err)
+		}
+		if err := putGlobalParam(native, contract, &GlobalParam{CandidateFee: 500, MinInitStake: 10000}); err != nil {
+			t.Fatalf("putGlobalParam failed: %s", err)
+		}
+		peerPoolMap := &PeerPoolMap{PeerPoolMap: make(map[string]*PeerPoolItem)}
+		if err := putPeerPoolMap(native, contract, 1, peerPoolMap); err != nil {
+			t.Fatalf("putPeerPoolMap failed: %s", err)
+		}
+		return native
+	}
+
+	service := newNative()
+	register(service)
+	if splitFee, err := GetSplitFee(service, contract); err != nil || splitFee != 0 {
+		t.Errorf("GetSplitFee before SPLIT_FEE_HEIGHT = %d, %v, want 0", splitFee, err)
+	}
+
+	defer func(height uint32) { SPLIT_FEE_HEIGHT = height }(SPLIT_FEE_HEIGHT)
+	SPLIT_FEE_HEIGHT = 0
+	service = newNative()
+	if err := PutSplitFee(service, contract, 100); err != nil {
+		t.Fatalf("PutSplitFee failed: %s", err)
+	}
+	register(service)
+	register(service)
+	if splitFee, err := GetSplitFee(service, contract); err != nil || splitFee != 1100 {
+		t.Errorf("GetSplitFee = %d, %v, want 1100", splitFee, err)
+	}
+}